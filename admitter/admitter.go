@@ -31,6 +31,28 @@ var (
 	AccessDenied = errors.New("access denied")
 )
 
+// Event is something that happened at a door which is neither an allow nor a
+// deny.
+type Event string
+
+const (
+	// Enrolled is notified when a new card was registered to a member
+	Enrolled Event = "enrolled"
+	// EnrollmentFailed is notified when an enrollment was attempted but no
+	// card was registered
+	EnrollmentFailed Event = "enrollment failed"
+	// Opened is notified when the door opens after access was allowed, the
+	// context is the one passed to Allow
+	Opened Event = "opened"
+	// ForcedOpen is notified when the door opens without access being
+	// allowed
+	ForcedOpen Event = "forced open"
+	// HeldOpen is notified when the door has been open for too long
+	HeldOpen Event = "held open"
+	// Closed is notified when the door closes
+	Closed Event = "closed"
+)
+
 // Admitter is the interface for consequences of admission attempts, it may be
 // one output such as a strike or a mux of many; such as an LED and a strike.
 type Admitter interface {
@@ -50,8 +72,25 @@ type Admitter interface {
 	Allow(ctx context.Context, message string) error
 }
 
+// Notifier is an optional interface for Admitters which present Events.
+type Notifier interface {
+	// Notify is called when an Event happens. The context will contain the
+	// same values as for Allow and Deny. The message is user presentable.
+	Notify(ctx context.Context, event Event, message string) error
+}
+
+// Notify calls Notify on a if it is a Notifier, otherwise it does nothing.
+func Notify(ctx context.Context, a Admitter, event Event, message string) error {
+	n, ok := a.(Notifier)
+	if !ok {
+		return nil
+	}
+	return n.Notify(ctx, event, message)
+}
+
 // Mux is a container for multiple Admitters, each is called sequentially in
-// order.
+// order and the first error stops the rest being called. Parallel calls them
+// concurrently.
 type Mux []Admitter
 
 func (m Mux) Interrogating(ctx context.Context, message string) {
@@ -77,3 +116,12 @@ func (m Mux) Allow(ctx context.Context, message string) error {
 	}
 	return nil
 }
+
+func (m Mux) Notify(ctx context.Context, event Event, message string) error {
+	for _, a := range m {
+		if err := Notify(ctx, a, event, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -99,6 +99,48 @@ func TestMuxAllow(t *testing.T) {
 	}
 }
 
+func TestMuxNotify(t *testing.T) {
+	for name, test := range map[string]struct {
+		errIndex int
+		wantErr  bool
+	}{
+		"all work": {
+			errIndex: 11,
+		},
+
+		"five fails": {
+			errIndex: 5,
+			wantErr:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var m Mux
+			for i := 0; i < 10; i++ {
+				if i%2 == 0 {
+					// Admitters that are not Notifiers are skipped
+					m = append(m, &testAdmitter{})
+					continue
+				}
+				mockAdmitter := &testNotifier{}
+				mockAdmitter.Test(t)
+				defer func(i int) {
+					if !mockAdmitter.AssertExpectations(t) {
+						t.Errorf("Expectations not met for admitter %d", i)
+					}
+				}(i)
+				if i < test.errIndex {
+					mockAdmitter.On("Notify", mock.Anything, Enrolled, "Card registered").Return(nil).Once()
+				} else if i == test.errIndex {
+					mockAdmitter.On("Notify", mock.Anything, Enrolled, "Card registered").Return(errors.New("fatal")).Once()
+				}
+				m = append(m, mockAdmitter)
+			}
+			err := m.Notify(context.Background(), Enrolled, "Card registered")
+			require.Equal(t, test.wantErr, err != nil, "want error=%t, err=%v", test.wantErr, err)
+		})
+	}
+}
+
 type testAdmitter struct {
 	mock.Mock
 }
@@ -114,3 +156,11 @@ func (a *testAdmitter) Deny(ctx context.Context, msg string, reason error) error
 func (a *testAdmitter) Allow(ctx context.Context, msg string) error {
 	return a.Called(ctx, msg).Error(0)
 }
+
+type testNotifier struct {
+	testAdmitter
+}
+
+func (a *testNotifier) Notify(ctx context.Context, event Event, msg string) error {
+	return a.Called(ctx, event, msg).Error(0)
+}
@@ -0,0 +1,320 @@
+// buzzer is an Admitter which plays tunes on a buzzer or piezo, so that
+// members who cannot see the status light still know what happened.
+package buzzer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+const (
+	// These are the sounds
+	allowed = iota
+	denied
+	failed
+	heldOpen
+
+	// quietCheck is how often quiet hours are checked while the door is held
+	// open, so that the alarm sounds if they end first
+	quietCheck = time.Minute
+)
+
+var (
+	// defaultTunes maps sound to tune
+	defaultTunes = map[int]Tune{
+		// A rising chirp
+		allowed: {{Hz: 2000, Duration: 60 * time.Millisecond}, {Duration: 30 * time.Millisecond}, {Hz: 2700, Duration: 80 * time.Millisecond}},
+		// A low buzz
+		denied: {{Hz: 400, Duration: 500 * time.Millisecond}},
+		// Three short beeps
+		failed: {
+			{Hz: 1500, Duration: 100 * time.Millisecond}, {Duration: 100 * time.Millisecond},
+			{Hz: 1500, Duration: 100 * time.Millisecond}, {Duration: 100 * time.Millisecond},
+			{Hz: 1500, Duration: 100 * time.Millisecond},
+		},
+		// A two tone siren, repeated until the door closes
+		heldOpen: {{Hz: 2500, Duration: 250 * time.Millisecond}, {Hz: 1800, Duration: 250 * time.Millisecond}},
+	}
+)
+
+// soundNames are the names of the sounds for SetTunes
+var soundNames = map[string]int{
+	"allowed":   allowed,
+	"denied":    denied,
+	"error":     failed,
+	"held open": heldOpen,
+}
+
+// Tone is one note of a Tune, a Tone with no Hz is a rest
+type Tone struct {
+	Hz       int
+	Duration time.Duration
+}
+
+// Tune is a sequence of Tones, an empty Tune is silent
+type Tune []Tone
+
+// Hours reports whether t is within quiet hours
+type Hours func(t time.Time) bool
+
+// Pin is a GPIO pin attached to the buzzer, any gpio.PinIO can be used. PWM is
+// only used if the buzzer is Passive.
+type Pin interface {
+	Out(gpio.Level) error
+	PWM(duty gpio.Duty, f physic.Frequency) error
+}
+
+// Buzzer is an Admitter that plays a tune when access is allowed or denied,
+// and an alarm while the door is held open
+type Buzzer struct {
+	// Passive is set for a piezo without its own oscillator, it is driven
+	// with PWM at the pitch of each Tone. Otherwise the pin is on for every
+	// Tone which is not a rest.
+	Passive bool
+	// ActiveLow is set if the buzzer sounds when its pin is low
+	ActiveLow bool
+
+	pin   Pin
+	clock clock
+
+	mux   sync.Mutex
+	tunes map[int]Tune
+	quiet Hours
+	wake  chan struct{}
+	// next is the sound to play next, -1 for none
+	next  int
+	alarm bool
+}
+
+// New returns a Buzzer on pin, it is started with Run once its fields are set.
+func New(pin Pin) *Buzzer {
+	return &Buzzer{
+		pin:   pin,
+		clock: realClock{},
+		tunes: defaultTunes,
+		wake:  make(chan struct{}, 1),
+		next:  -1,
+	}
+}
+
+// Run plays sounds until the buzzer cannot be driven, it does not return
+// otherwise.
+func (b *Buzzer) Run() error {
+	// The buzzer starts silent
+	if err := b.silence(); err != nil {
+		return err
+	}
+	for {
+		if err := b.step(); err != nil {
+			return err
+		}
+	}
+}
+
+// CheckTunes returns an error if tunes cannot be used with SetTunes. The sounds
+// are "allowed", "denied", "error" (denied because access could not be
+// checked) and "held open", which repeats until the door closes.
+func CheckTunes(tunes map[string]Tune) error {
+	for name, tune := range tunes {
+		if _, ok := soundNames[name]; !ok {
+			return fmt.Errorf("unknown buzzer sound %q", name)
+		}
+		for _, tone := range tune {
+			if tone.Hz < 0 {
+				return fmt.Errorf("buzzer sound %q has a negative pitch", name)
+			}
+			if tone.Duration <= 0 {
+				return fmt.Errorf("buzzer sound %q has a tone without a duration", name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetTunes changes the tune of the sounds in tunes, other sounds are
+// unchanged. Nothing is changed if any tune is invalid. It is safe to call
+// while the Buzzer is in use.
+func (b *Buzzer) SetTunes(tunes map[string]Tune) error {
+	if err := CheckTunes(tunes); err != nil {
+		return err
+	}
+
+	b.mux.Lock()
+	next := make(map[int]Tune, len(b.tunes))
+	for sound, t := range b.tunes {
+		next[sound] = t
+	}
+	for name, tune := range tunes {
+		next[soundNames[name]] = append(Tune(nil), tune...)
+	}
+	b.tunes = next
+	b.mux.Unlock()
+	return nil
+}
+
+// SetQuiet sets the quiet hours, nothing is played during them. There are no
+// quiet hours if hours is nil. It is safe to call while the Buzzer is in use.
+func (b *Buzzer) SetQuiet(hours Hours) {
+	b.mux.Lock()
+	b.quiet = hours
+	b.mux.Unlock()
+	b.poke()
+}
+
+// Interrogating does nothing, a buzzer is only for results
+func (b *Buzzer) Interrogating(ctx context.Context, msg string) {}
+
+// Deny plays denied, or error if access could not be checked
+func (b *Buzzer) Deny(ctx context.Context, msg string, reason error) error {
+	if auth.DenyReason(ctx, reason) == auth.Failed {
+		b.play(failed)
+		return nil
+	}
+	b.play(denied)
+	return nil
+}
+
+// Allow plays allowed
+func (b *Buzzer) Allow(ctx context.Context, msg string) error {
+	b.play(allowed)
+	return nil
+}
+
+// Notify sounds the alarm while the door is held open, other events are
+// ignored
+func (b *Buzzer) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	switch event {
+	case admitter.HeldOpen:
+		b.setAlarm(true)
+	case admitter.Closed:
+		b.setAlarm(false)
+	}
+	return nil
+}
+
+// play plays sound next, stopping anything playing now
+func (b *Buzzer) play(sound int) {
+	b.mux.Lock()
+	b.next = sound
+	b.mux.Unlock()
+	b.poke()
+}
+
+// setAlarm starts or stops the held open alarm
+func (b *Buzzer) setAlarm(on bool) {
+	b.mux.Lock()
+	b.alarm = on
+	b.mux.Unlock()
+	b.poke()
+}
+
+// step plays the next sound, or the alarm if there is none, and returns when
+// it ends. In quiet hours the sound is dropped. With nothing to play it waits
+// for a poke.
+func (b *Buzzer) step() error {
+	// The state is about to be read, so any poke so far is handled
+	select {
+	case <-b.wake:
+	default:
+	}
+
+	b.mux.Lock()
+	var tune Tune
+	if b.next >= 0 {
+		tune = b.tunes[b.next]
+	}
+	if len(tune) == 0 && b.alarm {
+		tune = b.tunes[heldOpen]
+	}
+	alarm := b.alarm
+	b.next = -1
+	quiet := b.quiet != nil && b.quiet(b.clock.Now())
+	b.mux.Unlock()
+
+	var wait time.Duration
+	switch {
+	case quiet && alarm:
+		wait = quietCheck
+	case quiet || len(tune) == 0:
+	default:
+		return b.playTune(tune)
+	}
+
+	var expired <-chan time.Time
+	if wait > 0 {
+		expired = b.clock.After(wait)
+	}
+	select {
+	case <-b.wake:
+	case <-expired:
+	}
+	return nil
+}
+
+// playTune plays tune, a poke stops it part way and is left for step
+func (b *Buzzer) playTune(tune Tune) error {
+	for _, tone := range tune {
+		if err := b.sound(tone.Hz); err != nil {
+			return err
+		}
+		select {
+		case <-b.wake:
+			b.poke()
+			return b.silence()
+		case <-b.clock.After(tone.Duration):
+		}
+	}
+	return b.silence()
+}
+
+// sound drives the buzzer at hz, a rest if hz is zero
+func (b *Buzzer) sound(hz int) error {
+	if hz == 0 {
+		return b.silence()
+	}
+	if b.Passive {
+		if err := b.pin.PWM(gpio.DutyHalf, physic.Frequency(hz)*physic.Hertz); err != nil {
+			return fmt.Errorf("failed to drive buzzer: %w", err)
+		}
+		return nil
+	}
+	if err := b.pin.Out(gpio.Level(!b.ActiveLow)); err != nil {
+		return fmt.Errorf("failed to drive buzzer: %w", err)
+	}
+	return nil
+}
+
+// silence stops the buzzer
+func (b *Buzzer) silence() error {
+	if err := b.pin.Out(gpio.Level(b.ActiveLow)); err != nil {
+		return fmt.Errorf("failed to drive buzzer: %w", err)
+	}
+	return nil
+}
+
+// poke causes Run to play the latest sound immediately
+func (b *Buzzer) poke() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// clock is the time source of a Buzzer, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,270 @@
+package buzzer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestBuzzer(t *testing.T) {
+	for name, test := range map[string]struct {
+		passive   bool
+		activeLow bool
+		tunes     map[string]Tune
+		quiet     Hours
+		do        func(ctx context.Context, details *auth.Details, b *Buzzer)
+		steps     int
+		// waits is set if there is nothing left to play after steps, so
+		// another step waits for a poke
+		waits bool
+
+		want []string
+	}{
+		"allowed": {
+			passive: true,
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			steps: 1,
+			want:  []string{"0s 2kHz", "60ms low", "90ms 2.700kHz", "170ms low"},
+		},
+
+		"denied active low": {
+			activeLow: true,
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Deny(ctx, "Access denied", admitter.AccessDenied)
+			},
+			steps: 1,
+			want:  []string{"0s low", "500ms high"},
+		},
+
+		"error": {
+			tunes: map[string]Tune{"error": {{Hz: 1000, Duration: 50 * time.Millisecond}, {Duration: 50 * time.Millisecond}, {Hz: 1000, Duration: 50 * time.Millisecond}}},
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Deny(ctx, "Error", errors.New("dial tcp: i/o timeout"))
+			},
+			steps: 1,
+			want:  []string{"0s high", "50ms low", "100ms high", "150ms low"},
+		},
+
+		"locked out is denied": {
+			do: func(ctx context.Context, details *auth.Details, b *Buzzer) {
+				details.SetReason(auth.LockedOut)
+				_ = b.Deny(ctx, "Locked out", errors.New("locked out, try again in 5 s"))
+			},
+			steps: 1,
+			want:  []string{"0s high", "500ms low"},
+		},
+
+		"allowed then nothing": {
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			steps: 1,
+			waits: true,
+			want:  []string{"0s high", "60ms low", "90ms high", "170ms low"},
+		},
+
+		"only the latest sound plays": {
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Deny(ctx, "Access denied", admitter.AccessDenied)
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			steps: 1,
+			want:  []string{"0s high", "60ms low", "90ms high", "170ms low"},
+		},
+
+		"alarm repeats while held open": {
+			passive: true,
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Notify(ctx, admitter.HeldOpen, "Door held open")
+			},
+			steps: 2,
+			want:  []string{"0s 2.500kHz", "250ms 1.800kHz", "500ms low", "500ms 2.500kHz", "750ms 1.800kHz", "1s low"},
+		},
+
+		"alarm resumes after a sound": {
+			tunes: map[string]Tune{"held open": {{Hz: 2000, Duration: time.Second}}},
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Notify(ctx, admitter.HeldOpen, "Door held open")
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			steps: 2,
+			want:  []string{"0s high", "60ms low", "90ms high", "170ms low", "170ms high", "1.17s low"},
+		},
+
+		"a silent sound does not stop the alarm": {
+			tunes: map[string]Tune{"allowed": {}, "held open": {{Hz: 2000, Duration: time.Second}}},
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Notify(ctx, admitter.HeldOpen, "Door held open")
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			steps: 1,
+			want:  []string{"0s high", "1s low"},
+		},
+
+		"quiet hours": {
+			quiet: func(time.Time) bool { return true },
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Allow(ctx, "Welcome back Bracken")
+			},
+			waits: true,
+		},
+
+		"alarm sounds when quiet hours end": {
+			quiet: func(t time.Time) bool { return t.Before(time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)) },
+			tunes: map[string]Tune{"held open": {{Hz: 2000, Duration: time.Second}}},
+			do: func(ctx context.Context, _ *auth.Details, b *Buzzer) {
+				_ = b.Notify(ctx, admitter.HeldOpen, "Door held open")
+			},
+			steps: 2,
+			want:  []string{"1m0s high", "1m1s low"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := fakeclock.New()
+			timeline := &timeline{clock: clock}
+			b := New(timeline)
+			b.clock = clock
+			b.Passive = test.passive
+			b.ActiveLow = test.activeLow
+			require.NoError(t, b.SetTunes(test.tunes))
+			b.SetQuiet(test.quiet)
+
+			ctx, details := auth.WithDetails(context.Background())
+			test.do(ctx, details, b)
+			for i := 0; i < test.steps; i++ {
+				require.NoError(t, b.step())
+			}
+			if test.waits {
+				require.NoError(t, stepPoked(b))
+			}
+			require.Equal(t, test.want, timeline.events)
+		})
+	}
+}
+
+func TestAlarmStops(t *testing.T) {
+	clock := fakeclock.New()
+	timeline := &timeline{clock: clock}
+	b := New(timeline)
+	b.clock = clock
+
+	require.NoError(t, b.Notify(context.Background(), admitter.HeldOpen, "Door held open"))
+	require.NoError(t, b.step())
+	require.NoError(t, b.Notify(context.Background(), admitter.Closed, "Door closed"))
+	// The alarm is over, so the next step waits for a poke
+	require.NoError(t, stepPoked(b))
+	require.Equal(t, []string{"0s high", "250ms high", "500ms low"}, timeline.events)
+}
+
+func TestRun(t *testing.T) {
+	b := New(&timeline{clock: fakeclock.New(), err: errors.New("pin is busy")})
+	require.EqualError(t, b.Run(), "failed to drive buzzer: pin is busy")
+}
+
+func TestSetTunes(t *testing.T) {
+	for name, test := range map[string]struct {
+		tunes map[string]Tune
+
+		want    map[int]Tune
+		wantErr string
+	}{
+		"changes only the given sounds": {
+			tunes: map[string]Tune{"allowed": {}, "error": {{Hz: 1000, Duration: time.Second}}},
+			want: map[int]Tune{
+				allowed:  nil,
+				denied:   defaultTunes[denied],
+				failed:   {{Hz: 1000, Duration: time.Second}},
+				heldOpen: defaultTunes[heldOpen],
+			},
+		},
+
+		"unknown sound": {
+			tunes:   map[string]Tune{"allowed": {}, "party": {}},
+			want:    defaultTunes,
+			wantErr: `unknown buzzer sound "party"`,
+		},
+
+		"negative pitch": {
+			tunes:   map[string]Tune{"denied": {{Hz: -1, Duration: time.Second}}},
+			want:    defaultTunes,
+			wantErr: `buzzer sound "denied" has a negative pitch`,
+		},
+
+		"no duration": {
+			tunes:   map[string]Tune{"denied": {{Hz: 400}}},
+			want:    defaultTunes,
+			wantErr: `buzzer sound "denied" has a tone without a duration`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := New(nil)
+			err := b.SetTunes(test.tunes)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.wantErr)
+			}
+			require.Equal(t, test.want, b.tunes)
+		})
+	}
+	require.Len(t, defaultTunes[allowed], 3, "defaults must not change")
+}
+
+// stepPoked runs a step which waits for a poke, poking until it returns
+func stepPoked(b *Buzzer) error {
+	done := make(chan error)
+	go func() { done <- b.step() }()
+	for {
+		b.poke()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// timeline is a buzzer pin which records what it is driven to and when
+type timeline struct {
+	clock  *fakeclock.Clock
+	err    error
+	mux    sync.Mutex
+	events []string
+}
+
+func (tl *timeline) record(value string) error {
+	tl.mux.Lock()
+	defer tl.mux.Unlock()
+	if tl.err != nil {
+		return tl.err
+	}
+	tl.events = append(tl.events, fmt.Sprintf("%s %s", tl.clock.Since(), value))
+	return nil
+}
+
+func (tl *timeline) Out(l gpio.Level) error {
+	value := "low"
+	if l {
+		value = "high"
+	}
+	return tl.record(value)
+}
+
+func (tl *timeline) PWM(duty gpio.Duty, f physic.Frequency) error {
+	if duty != gpio.DutyHalf {
+		return fmt.Errorf("wrong duty %s", duty)
+	}
+	return tl.record(f.String())
+}
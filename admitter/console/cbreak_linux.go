@@ -0,0 +1,37 @@
+package console
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Cbreak stops the terminal f echoing keys and buffering them into lines, so
+// that PINs can be entered without being shown. Signal keys such as Ctrl-C
+// still work. restore returns the terminal to how it was.
+func Cbreak(f *os.File) (restore func() error, err error) {
+	fd := f.Fd()
+	var old syscall.Termios
+	if err := termios(fd, syscall.TCGETS, &old); err != nil {
+		return nil, fmt.Errorf("failed to get terminal mode: %w", err)
+	}
+	cbreak := old
+	cbreak.Lflag &^= syscall.ECHO | syscall.ICANON
+	cbreak.Cc[syscall.VMIN] = 1
+	cbreak.Cc[syscall.VTIME] = 0
+	if err := termios(fd, syscall.TCSETS, &cbreak); err != nil {
+		return nil, fmt.Errorf("failed to set terminal mode: %w", err)
+	}
+	return func() error {
+		return termios(fd, syscall.TCSETS, &old)
+	}, nil
+}
+
+// termios gets or sets the mode of the terminal fd
+func termios(fd uintptr, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
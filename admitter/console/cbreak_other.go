@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package console
+
+import (
+	"errors"
+	"os"
+)
+
+// Cbreak stops the terminal f echoing keys and buffering them into lines, it
+// is only supported on Linux.
+func Cbreak(f *os.File) (restore func() error, err error) {
+	return nil, errors.New("terminal mode can only be set on linux")
+}
@@ -0,0 +1,486 @@
+// console is an Admitter which draws a status screen on a terminal, such as
+// the tty doord is started on, and takes masked PIN entry from its keyboard.
+package console
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+)
+
+const (
+	defaultTitle        = "So Make It"
+	defaultMessageTime  = 5 * time.Second
+	defaultPingInterval = 30 * time.Second
+	defaultWidth        = 80
+	defaultPrompt       = "Present your tag"
+
+	// redraw is how often the screen is redrawn while nothing happens, so
+	// that it keeps time
+	redraw = time.Second
+)
+
+// These are the ANSI escape sequences used to draw the screen
+const (
+	home       = "\x1b[H"
+	clear      = "\x1b[2J"
+	hideCursor = "\x1b[?25l"
+	bold       = "\x1b[1m"
+	reset      = "\x1b[0m"
+	onCyan     = "\x1b[30;46m"
+	onGreen    = "\x1b[30;42m"
+	onYellow   = "\x1b[30;43m"
+	onRed      = "\x1b[97;41m"
+	red        = "\x1b[91m"
+)
+
+// These are the states of HMS
+const (
+	hmsUnknown = iota
+	hmsOnline
+	hmsOffline
+)
+
+// message is a welcome or deny message shown in the middle of the screen
+type message struct {
+	text   string
+	colour string
+	at     time.Time
+	member auth.Member
+}
+
+// Console is an Admitter that draws the state of the door and the result of
+// each attempt on a terminal, it is redrawn every second with ANSI escape
+// sequences.
+type Console struct {
+	// Title is shown at the top of the screen
+	Title string
+	// Prompt is shown while nothing else is
+	Prompt string
+	// Width is the width of the terminal in characters
+	Width int
+	// Door describes whether the door is locked, eg: "unlocked for 4s", it
+	// is called on every redraw. Optional.
+	Door func() string
+	// Ping checks whether HMS can be reached and is called every
+	// PingInterval. Without it HMS is only shown as online or offline by the
+	// decisions made.
+	Ping         func(ctx context.Context) error
+	PingInterval time.Duration
+
+	out   io.Writer
+	in    io.Reader
+	clock clock
+
+	pinEntry   bool
+	pins       *io.PipeReader
+	pinsWriter *io.PipeWriter
+
+	mux           sync.Mutex
+	wake          chan struct{}
+	messageTime   time.Duration
+	message       message
+	interrogating string
+	// interrogation is closed when interrogating ends, so that only the
+	// latest Interrogating call can end it
+	interrogation chan struct{}
+	position      admitter.Event
+	hms           int
+	pin           int
+}
+
+// New returns a Console drawing on out and reading keys from in, it is started
+// with Run once its fields are set. in should not echo or buffer lines, see
+// Cbreak.
+func New(out io.Writer, in io.Reader) *Console {
+	pins, pinsWriter := io.Pipe()
+	return &Console{
+		Title:        defaultTitle,
+		Prompt:       defaultPrompt,
+		Width:        defaultWidth,
+		PingInterval: defaultPingInterval,
+
+		out:         out,
+		in:          in,
+		clock:       realClock{},
+		pins:        pins,
+		pinsWriter:  pinsWriter,
+		wake:        make(chan struct{}, 1),
+		messageTime: defaultMessageTime,
+	}
+}
+
+// PINs returns the PINs entered on the keyboard, each terminated by "\n", for
+// a PIN guard. The PIN entry field is only shown once PINs has been called,
+// it must be called before Run.
+func (c *Console) PINs() io.Reader {
+	c.pinEntry = true
+	return c.pins
+}
+
+// SetMessageTime changes how long welcome and deny messages are shown for, it
+// is safe to call while the Console is in use.
+func (c *Console) SetMessageTime(d time.Duration) {
+	c.mux.Lock()
+	c.messageTime = d
+	c.mux.Unlock()
+	c.poke()
+}
+
+// Run draws the screen, and reads PINs if PINs was called, until the terminal
+// cannot be written or read. It does not return otherwise. A panic reading
+// PINs or pinging HMS is raised again by Run, so that it can be recovered by
+// the caller of Run.
+func (c *Console) Run() error {
+	errs := make(chan error, 1)
+	panics := make(chan string, 2)
+	if c.pinEntry {
+		go func() {
+			defer carry(panics)
+			errs <- c.read()
+		}()
+	}
+	if c.Ping != nil {
+		go func() {
+			defer carry(panics)
+			for {
+				c.checkHMS()
+				<-c.clock.After(c.PingInterval)
+			}
+		}()
+	}
+
+	if _, err := io.WriteString(c.out, hideCursor); err != nil {
+		return fmt.Errorf("failed to draw console: %w", err)
+	}
+	for {
+		if _, err := io.WriteString(c.out, home+clear+c.render(c.clock.Now())); err != nil {
+			return fmt.Errorf("failed to draw console: %w", err)
+		}
+		select {
+		case err := <-errs:
+			return err
+		case p := <-panics:
+			panic(p)
+		case <-c.wake:
+		case <-c.clock.After(redraw):
+		}
+	}
+}
+
+// carry sends a panic of the calling goroutine, with its stack, to panics.
+// Defer it at the top of a goroutine.
+func carry(panics chan<- string) {
+	if r := recover(); r != nil {
+		panics <- fmt.Sprintf("%v\n\n%s", r, debug.Stack())
+	}
+}
+
+// Interrogating shows msg until ctx is done or access is allowed or denied
+func (c *Console) Interrogating(ctx context.Context, msg string) {
+	c.mux.Lock()
+	c.endInterrogating()
+	interrogation := make(chan struct{})
+	c.interrogation = interrogation
+	c.interrogating = msg
+	c.mux.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-interrogation:
+			return
+		}
+		c.mux.Lock()
+		if c.interrogation == interrogation {
+			c.endInterrogating()
+		}
+		c.mux.Unlock()
+		c.poke()
+	}()
+	c.poke()
+}
+
+// endInterrogating stops showing the interrogating message. Must be called
+// with mux held.
+func (c *Console) endInterrogating() {
+	if c.interrogation != nil {
+		close(c.interrogation)
+		c.interrogation = nil
+	}
+	c.interrogating = ""
+}
+
+// Deny shows msg in red, or yellow if access could not be checked
+func (c *Console) Deny(ctx context.Context, msg string, reason error) error {
+	colour := onRed
+	if auth.DenyReason(ctx, reason) == auth.Failed {
+		colour = onYellow
+	}
+	c.mux.Lock()
+	c.endInterrogating()
+	c.mux.Unlock()
+	c.show(ctx, msg, colour)
+	return nil
+}
+
+// Allow shows msg in green with the member who was allowed
+func (c *Console) Allow(ctx context.Context, msg string) error {
+	c.mux.Lock()
+	c.endInterrogating()
+	c.mux.Unlock()
+	c.show(ctx, msg, onGreen)
+	c.mux.Lock()
+	if !auth.DecisionFrom(ctx).Offline {
+		// Only HMS makes online decisions
+		c.hms = hmsOnline
+	}
+	c.mux.Unlock()
+	return nil
+}
+
+// Notify shows the position of the door from a sensor and the result of
+// enrollments, other events are ignored
+func (c *Console) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	switch event {
+	case admitter.Opened, admitter.Closed, admitter.HeldOpen, admitter.ForcedOpen:
+		c.mux.Lock()
+		c.position = event
+		c.mux.Unlock()
+		c.poke()
+	case admitter.Enrolled:
+		c.show(ctx, msg, onGreen)
+	case admitter.EnrollmentFailed:
+		c.show(ctx, msg, onRed)
+	}
+	return nil
+}
+
+// show shows msg in colour with the member of the decision on ctx
+func (c *Console) show(ctx context.Context, msg, colour string) {
+	decision := auth.DecisionFrom(ctx)
+	c.mux.Lock()
+	c.message = message{text: msg, colour: colour, at: c.clock.Now(), member: decision.Member}
+	if decision.Offline {
+		c.hms = hmsOffline
+	}
+	c.mux.Unlock()
+	c.poke()
+}
+
+// checkHMS pings HMS and shows whether it answered
+func (c *Console) checkHMS() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.PingInterval)
+	defer cancel()
+	state := hmsOnline
+	if err := c.Ping(ctx); err != nil {
+		state = hmsOffline
+	}
+	c.mux.Lock()
+	c.hms = state
+	c.mux.Unlock()
+	c.poke()
+}
+
+// read reads keys into the PIN entry field, digits are added, backspace
+// removes the last digit, escape clears the field and enter sends the PIN to
+// PINs. Any other key is ignored.
+func (c *Console) read() error {
+	var (
+		pin []byte
+		buf = make([]byte, 64)
+	)
+	for {
+		n, err := c.in.Read(buf)
+		for _, key := range buf[:n] {
+			switch {
+			case key >= '0' && key <= '9':
+				pin = append(pin, key)
+			case key == 0x7f || key == '\b':
+				if len(pin) > 0 {
+					pin = pin[:len(pin)-1]
+				}
+			case key == 0x1b:
+				pin = pin[:0]
+			case key == '\r' || key == '\n':
+				if len(pin) == 0 {
+					continue
+				}
+				line := string(pin) + "\n"
+				pin = pin[:0]
+				c.setPIN(0)
+				// Blocks until the guard is ready for another PIN
+				if _, err := io.WriteString(c.pinsWriter, line); err != nil {
+					return fmt.Errorf("failed to send PIN: %w", err)
+				}
+			}
+		}
+		c.setPIN(len(pin))
+		if err != nil {
+			err = fmt.Errorf("failed to read keyboard: %w", err)
+			c.pinsWriter.CloseWithError(err)
+			return err
+		}
+	}
+}
+
+// setPIN sets the number of digits shown in the PIN entry field
+func (c *Console) setPIN(digits int) {
+	c.mux.Lock()
+	c.pin = digits
+	c.mux.Unlock()
+	c.poke()
+}
+
+// poke causes Run to redraw immediately
+func (c *Console) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// render returns the screen at now
+func (c *Console) render(now time.Time) string {
+	var door []string
+	if c.Door != nil {
+		door = append(door, c.Door())
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var b strings.Builder
+	line := func(s string) {
+		b.WriteString(s)
+		b.WriteString("\n")
+	}
+
+	hms := "HMS ?"
+	switch c.hms {
+	case hmsOnline:
+		hms = "HMS online"
+	case hmsOffline:
+		hms = red + "HMS OFFLINE" + reset
+	}
+	line(bold + c.Title + reset + strings.Repeat(" ", max(1, c.Width-width(c.Title)-width(hms))) + hms)
+	line(strings.Repeat("─", c.Width))
+
+	switch c.position {
+	case "":
+	case admitter.HeldOpen, admitter.ForcedOpen:
+		door = append(door, red+string(c.position)+reset)
+	default:
+		door = append(door, string(c.position))
+	}
+	if len(door) > 0 {
+		line("Door: " + strings.Join(door, ", "))
+	} else {
+		line("")
+	}
+	line("")
+
+	msg := message{text: c.Prompt}
+	switch {
+	case now.Before(c.message.at.Add(c.messageTime)):
+		msg = c.message
+	case c.interrogating != "":
+		msg = message{text: c.interrogating, colour: onCyan}
+	}
+	for _, text := range []string{"", msg.text, ""} {
+		line(msg.colour + centre(text, c.Width) + reset)
+	}
+	line("")
+	line(describe(msg.member))
+	line("")
+
+	if c.pinEntry {
+		line("PIN: " + strings.Repeat("*", c.pin) + "_")
+	}
+	return b.String()
+}
+
+// describe returns the name of member and when they were last seen, empty if
+// the member is not known
+func describe(member auth.Member) string {
+	name := member.Name
+	if name == "" {
+		if member.ID == 0 {
+			return ""
+		}
+		name = fmt.Sprintf("Member %d", member.ID)
+	}
+	ago := member.LastSeen
+	switch {
+	case ago <= 0:
+		return name
+	case ago < time.Minute:
+		return name + ", last seen just now"
+	case ago < time.Hour:
+		return fmt.Sprintf("%s, last seen %s ago", name, plural(int(ago/time.Minute), "minute"))
+	case ago < 48*time.Hour:
+		return fmt.Sprintf("%s, last seen %s ago", name, plural(int(ago/time.Hour), "hour"))
+	}
+	return fmt.Sprintf("%s, last seen %s ago", name, plural(int(ago/(24*time.Hour)), "day"))
+}
+
+// plural returns n of unit, eg: "1 day" or "2 days"
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// centre pads s with spaces to the middle of n characters, it is cut short if
+// it is too long
+func centre(s string, n int) string {
+	if width(s) > n {
+		s = string([]rune(s)[:n])
+	}
+	left := (n - width(s)) / 2
+	return strings.Repeat(" ", left) + s + strings.Repeat(" ", n-left-width(s))
+}
+
+// width returns the number of characters in s, ignoring escape sequences
+func width(s string) int {
+	n := 0
+	escape := false
+	for _, r := range s {
+		switch {
+		case r == 0x1b:
+			escape = true
+		case escape:
+			if r >= '@' && r <= '~' && r != '[' {
+				escape = false
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// clock is the time source of a Console, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,353 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	for name, test := range map[string]struct {
+		door     func() string
+		pinEntry bool
+		do       func(ctx context.Context, details *auth.Details, c *Console)
+		after    time.Duration
+
+		want []string
+	}{
+		"nothing happening": {
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 25) + "HMS ?",
+				"────────────────────────────────────────",
+				"",
+				"",
+				"",
+				"            Present your tag",
+				"",
+				"",
+				"",
+				"",
+			},
+		},
+
+		"allowed": {
+			door: func() string { return "unlocked for 5s" },
+			do: func(ctx context.Context, details *auth.Details, c *Console) {
+				details.SetMember(12, "Bracken")
+				details.SetLastSeen(3 * time.Hour)
+				_ = c.Allow(ctx, "Welcome back Bracken")
+			},
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 20) + "HMS online",
+				"────────────────────────────────────────",
+				"Door: unlocked for 5s",
+				"",
+				"",
+				"          Welcome back Bracken",
+				"",
+				"",
+				"Bracken, last seen 3 hours ago",
+				"",
+			},
+		},
+
+		"allowed offline": {
+			do: func(ctx context.Context, details *auth.Details, c *Console) {
+				details.SetOffline()
+				details.SetMember(12, "")
+				_ = c.Allow(ctx, "Welcome back")
+			},
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 19) + "HMS OFFLINE",
+				"────────────────────────────────────────",
+				"",
+				"",
+				"",
+				"              Welcome back",
+				"",
+				"",
+				"Member 12",
+				"",
+			},
+		},
+
+		"message is gone after its time": {
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				_ = c.Deny(ctx, "Access denied", admitter.AccessDenied)
+			},
+			after: 5 * time.Second,
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 25) + "HMS ?",
+				"────────────────────────────────────────",
+				"",
+				"",
+				"",
+				"            Present your tag",
+				"",
+				"",
+				"",
+				"",
+			},
+		},
+
+		"interrogating with the door held open": {
+			pinEntry: true,
+			door:     func() string { return "locked" },
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				_ = c.Notify(ctx, admitter.HeldOpen, "Door held open")
+				c.Interrogating(ctx, "Authorizing tag...")
+			},
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 25) + "HMS ?",
+				"────────────────────────────────────────",
+				"Door: locked, held open",
+				"",
+				"",
+				"           Authorizing tag...",
+				"",
+				"",
+				"",
+				"",
+				"PIN: _",
+			},
+		},
+
+		"long messages are cut short": {
+			do: func(ctx context.Context, details *auth.Details, c *Console) {
+				details.SetMember(12, "Bracken")
+				details.SetLastSeen(30 * time.Second)
+				_ = c.Notify(ctx, admitter.Enrolled, "Your new card is enrolled, welcome to So Make It")
+			},
+			want: []string{
+				"So Make It" + strings.Repeat(" ", 25) + "HMS ?",
+				"────────────────────────────────────────",
+				"",
+				"",
+				"",
+				"Your new card is enrolled, welcome to So",
+				"",
+				"",
+				"Bracken, last seen just now",
+				"",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := fakeclock.New()
+			c := New(io.Discard, nil)
+			c.clock = clock
+			c.Width = 40
+			c.Door = test.door
+			c.pinEntry = test.pinEntry
+
+			ctx, details := auth.WithDetails(context.Background())
+			if test.do != nil {
+				test.do(ctx, details, c)
+			}
+			screen := plain(c.render(clock.Now().Add(test.after)))
+			require.Equal(t, test.want, strings.Split(strings.TrimSuffix(screen, "\n"), "\n"))
+		})
+	}
+}
+
+func TestColours(t *testing.T) {
+	for name, test := range map[string]struct {
+		do func(ctx context.Context, details *auth.Details, c *Console)
+
+		want string
+	}{
+		"allowed": {
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				_ = c.Allow(ctx, "Welcome back Bracken")
+			},
+			want: onGreen,
+		},
+
+		"denied": {
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				_ = c.Deny(ctx, "Access denied", admitter.AccessDenied)
+			},
+			want: onRed,
+		},
+
+		"error": {
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				_ = c.Deny(ctx, "Error", errors.New("dial tcp: i/o timeout"))
+			},
+			want: onYellow,
+		},
+
+		"locked out is denied": {
+			do: func(ctx context.Context, details *auth.Details, c *Console) {
+				details.SetReason(auth.LockedOut)
+				_ = c.Deny(ctx, "Locked out", errors.New("locked out, try again in 5 s"))
+			},
+			want: onRed,
+		},
+
+		"interrogating": {
+			do: func(ctx context.Context, _ *auth.Details, c *Console) {
+				c.Interrogating(ctx, "Authorizing tag...")
+			},
+			want: onCyan,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := fakeclock.New()
+			c := New(io.Discard, nil)
+			c.clock = clock
+			ctx, details := auth.WithDetails(context.Background())
+			test.do(ctx, details, c)
+			require.Contains(t, c.render(clock.Now()), test.want)
+		})
+	}
+}
+
+func TestInterrogatingEnds(t *testing.T) {
+	c := New(io.Discard, nil)
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	c.Interrogating(first, "Authorizing tag...")
+	c.Interrogating(second, "Authorizing PIN...")
+
+	cancelFirst()
+	// Only the latest attempt ends interrogating
+	time.Sleep(10 * time.Millisecond)
+	require.Contains(t, c.render(time.Now()), "Authorizing PIN...")
+
+	cancelSecond()
+	require.Eventually(t, func() bool {
+		return strings.Contains(c.render(time.Now()), defaultPrompt)
+	}, time.Second, time.Millisecond)
+
+	// Access being denied ends interrogating without the context ending
+	c.Interrogating(context.Background(), "Authorizing tag...")
+	require.NoError(t, c.Deny(context.Background(), "Access denied", admitter.AccessDenied))
+	require.NotContains(t, c.render(time.Now()), "Authorizing tag...")
+	require.Nil(t, c.interrogation)
+}
+
+func TestRunPanics(t *testing.T) {
+	c := New(io.Discard, nil)
+	c.Ping = func(context.Context) error { panic("no HMS") }
+	require.Panics(t, func() { _ = c.Run() }, "a panic pinging HMS is raised by Run")
+}
+
+func TestPINs(t *testing.T) {
+	keys, keyboard := io.Pipe()
+	c := New(io.Discard, keys)
+	pins := bufio.NewReader(c.PINs())
+	read := make(chan error, 1)
+	go func() { read <- c.read() }()
+
+	_, err := io.WriteString(keyboard, "12\x7f34\r")
+	require.NoError(t, err)
+	pin, err := pins.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "134\n", pin)
+
+	_, err = io.WriteString(keyboard, "99\x1b[A5a")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(c.render(time.Now()), "PIN: *_")
+	}, time.Second, time.Millisecond, "only the digit after escape is in the field")
+
+	_, err = io.WriteString(keyboard, "\n\n6\n")
+	require.NoError(t, err)
+	pin, err = pins.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "5\n", pin)
+	pin, err = pins.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "6\n", pin, "empty PINs are not sent")
+
+	keyboard.CloseWithError(errors.New("tty hung up"))
+	require.EqualError(t, <-read, "failed to read keyboard: tty hung up")
+	_, err = pins.ReadString('\n')
+	require.EqualError(t, err, "failed to read keyboard: tty hung up")
+}
+
+func TestCheckHMS(t *testing.T) {
+	c := New(io.Discard, nil)
+	c.Ping = func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		require.True(t, ok, "ping has no deadline")
+		return errors.New("connection refused")
+	}
+	c.checkHMS()
+	require.Contains(t, plain(c.render(time.Now())), "HMS OFFLINE")
+
+	c.Ping = func(context.Context) error { return nil }
+	c.checkHMS()
+	require.Contains(t, plain(c.render(time.Now())), "HMS online")
+}
+
+func TestRun(t *testing.T) {
+	keys, keyboard := io.Pipe()
+	out := &lockedBuilder{}
+	c := New(out, keys)
+	c.PINs()
+	run := make(chan error, 1)
+	go func() { run <- c.Run() }()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), hideCursor+home+clear)
+	}, time.Second, time.Millisecond)
+	keyboard.CloseWithError(errors.New("tty hung up"))
+	require.EqualError(t, <-run, "failed to read keyboard: tty hung up")
+}
+
+func TestDescribe(t *testing.T) {
+	for member, want := range map[auth.Member]string{
+		{}:                                       "",
+		{ID: 7}:                                  "Member 7",
+		{ID: 7, Name: "Bracken"}:                 "Bracken",
+		{Name: "Bracken", LastSeen: time.Minute}: "Bracken, last seen 1 minute ago",
+		{Name: "Bracken", LastSeen: 59 * time.Minute}:    "Bracken, last seen 59 minutes ago",
+		{Name: "Bracken", LastSeen: 47 * time.Hour}:      "Bracken, last seen 47 hours ago",
+		{Name: "Bracken", LastSeen: 30 * 24 * time.Hour}: "Bracken, last seen 30 days ago",
+	} {
+		require.Equal(t, want, describe(member))
+	}
+}
+
+// escapes matches the ANSI escape sequences used to draw the screen
+var escapes = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+
+// plain returns the screen s without its escape sequences or trailing spaces
+func plain(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(escapes.ReplaceAllString(line, ""), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lockedBuilder is a strings.Builder which is safe to use concurrently
+type lockedBuilder struct {
+	mux sync.Mutex
+	b   strings.Builder
+}
+
+func (l *lockedBuilder) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuilder) String() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.b.String()
+}
@@ -3,39 +3,108 @@ package led
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
 	"periph.io/x/conn/v3/gpio"
 )
 
-// blink is a type to define a status light's behaviour
-type blink struct {
-	on, off time.Duration
-}
-
 const (
 	// These are the LED states
 	heartbeat = iota
 	interrogating
 	allowed
+	offline
 	denied
+	lockout
+	failed
+	enrolling
+	enrolled
+	enrollmentFailed
 
-	defaultAllowedTime = time.Second
-	defaultDeniedTime  = time.Second
+	defaultAllowedTime    = time.Second
+	defaultDeniedTime     = time.Second
+	defaultEnrollmentTime = 2 * time.Second
 )
 
 var (
 	// defaultRates maps led state to blink pattern. Every pattern must have one non-zero
 	// duration
-	defaultRates = map[int]blink{
+	defaultRates = map[int]Pattern{
 		heartbeat:     {50 * time.Millisecond, 4950 * time.Millisecond},
 		interrogating: {50 * time.Millisecond, 50 * time.Millisecond},
 		allowed:       {time.Second, 0},
+		offline:       {450 * time.Millisecond, 50 * time.Millisecond},
 		denied:        {0, time.Second},
+		lockout:       {50 * time.Millisecond, 450 * time.Millisecond},
+		// SOS
+		failed: {
+			100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond,
+			300 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond,
+			100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 700 * time.Millisecond,
+		},
+		enrolling:        {200 * time.Millisecond, 200 * time.Millisecond},
+		enrolled:         {400 * time.Millisecond, 100 * time.Millisecond},
+		enrollmentFailed: {100 * time.Millisecond, 400 * time.Millisecond},
+	}
+
+	// defaultReasons maps the reason for a denial to the state shown, any
+	// other reason is shown as denied
+	defaultReasons = map[auth.Reason]int{
+		auth.LockedOut:  lockout,
+		auth.Enrollment: enrolling,
+		auth.Failed:     failed,
 	}
 )
 
+// stateNames are the names of the LED states for SetRates and SetPatterns
+var stateNames = map[string]int{
+	"heartbeat":         heartbeat,
+	"interrogating":     interrogating,
+	"allowed":           allowed,
+	"offline":           offline,
+	"denied":            denied,
+	"lockout":           lockout,
+	"error":             failed,
+	"enrolling":         enrolling,
+	"enrolled":          enrolled,
+	"enrollment failed": enrollmentFailed,
+}
+
+// reasonNames are the reasons for a denial which SetReasons can map
+var reasonNames = map[string]auth.Reason{
+	string(auth.Denied):     auth.Denied,
+	string(auth.UnknownID):  auth.UnknownID,
+	string(auth.LockedOut):  auth.LockedOut,
+	string(auth.Closed):     auth.Closed,
+	string(auth.Enrollment): auth.Enrollment,
+	string(auth.Failed):     auth.Failed,
+}
+
+// Rate is the blink pattern of an LED state, the LED is on for On and then off
+// for Off. One of them must be non-zero.
+type Rate struct {
+	On, Off time.Duration
+}
+
+// Pattern is the blink sequence of an LED state, the durations alternate
+// between on and off starting with on and the sequence repeats for as long as
+// the state lasts. Zero durations are skipped, at least one must be non-zero.
+// For example a double blink is {100ms, 100ms, 100ms, 700ms}.
+type Pattern []time.Duration
+
+// duration is the time the pattern takes to run once
+func (p Pattern) duration() time.Duration {
+	var total time.Duration
+	for _, d := range p {
+		total += d
+	}
+	return total
+}
+
 // Pin is a GPIO pin attached to the LED
 type Pin interface {
 	Out(gpio.Level) error
@@ -44,91 +113,254 @@ type Pin interface {
 // LED is an Admitter that impliments a status LED
 type LED struct {
 	allowedTime, deniedTime time.Duration
-	rate                    map[int]blink
+	enrollmentTime          time.Duration
+	rate                    map[int]Pattern
+	reasons                 map[auth.Reason]int
 
-	pin Pin
+	pin   Pin
+	clock clock
 
-	mux           sync.Mutex
-	wake          chan struct{}
-	interrogating bool
+	mux  sync.Mutex
+	wake chan struct{}
+	// interrogation is closed when interrogating ends, nil when not
+	// interrogating
+	interrogation chan struct{}
 	lastAllow     time.Time
+	allowState    int
 	lastDeny      time.Time
+	denyState     int
+	lastEnroll    time.Time
+	enrollEvent   admitter.Event
 }
 
-// New returns a started LED
+// New returns an LED, it is started with Run
 func New(led Pin) *LED {
-	l := &LED{
-		allowedTime: defaultAllowedTime,
-		deniedTime:  defaultDeniedTime,
-		rate:        defaultRates,
+	return &LED{
+		allowedTime:    defaultAllowedTime,
+		deniedTime:     defaultDeniedTime,
+		enrollmentTime: defaultEnrollmentTime,
+		rate:           defaultRates,
+		reasons:        defaultReasons,
+
+		pin:   led,
+		clock: realClock{},
+		wake:  make(chan struct{}),
+	}
+}
 
-		pin:  led,
-		wake: make(chan struct{}),
+// CheckRates returns an error if rates cannot be used with SetRates. The
+// states are "heartbeat", "interrogating", "allowed", "offline" (allowed
+// without HMS), "denied", "lockout", "error" (denied because access could not
+// be checked), "enrolling", "enrolled" and "enrollment failed".
+func CheckRates(rates map[string]Rate) error {
+	for name, rate := range rates {
+		if _, ok := stateNames[name]; !ok {
+			return fmt.Errorf("unknown LED state %q", name)
+		}
+		if rate.On <= 0 && rate.Off <= 0 {
+			return fmt.Errorf("LED state %q must have an on or off time", name)
+		}
+		if rate.On < 0 || rate.Off < 0 {
+			return fmt.Errorf("LED state %q has a negative time", name)
+		}
 	}
-	go l.run()
-	return l
+	return nil
 }
 
+// SetRates changes the blink pattern of the states in rates, other states are
+// unchanged. Nothing is changed if any rate is invalid. It is safe to call
+// while the LED is in use.
+func (l *LED) SetRates(rates map[string]Rate) error {
+	if err := CheckRates(rates); err != nil {
+		return err
+	}
+	patterns := make(map[string]Pattern, len(rates))
+	for name, rate := range rates {
+		patterns[name] = Pattern{rate.On, rate.Off}
+	}
+	return l.SetPatterns(patterns)
+}
+
+// CheckPatterns returns an error if patterns cannot be used with SetPatterns,
+// the states are the same as for CheckRates.
+func CheckPatterns(patterns map[string]Pattern) error {
+	for name, pattern := range patterns {
+		if _, ok := stateNames[name]; !ok {
+			return fmt.Errorf("unknown LED state %q", name)
+		}
+		for _, d := range pattern {
+			if d < 0 {
+				return fmt.Errorf("LED state %q has a negative time", name)
+			}
+		}
+		if pattern.duration() <= 0 {
+			return fmt.Errorf("LED state %q must have an on or off time", name)
+		}
+	}
+	return nil
+}
+
+// SetPatterns changes the blink pattern of the states in patterns, other
+// states are unchanged. Nothing is changed if any pattern is invalid. It is
+// safe to call while the LED is in use.
+func (l *LED) SetPatterns(patterns map[string]Pattern) error {
+	if err := CheckPatterns(patterns); err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	next := make(map[int]Pattern, len(l.rate))
+	for state, p := range l.rate {
+		next[state] = p
+	}
+	for name, pattern := range patterns {
+		next[stateNames[name]] = append(Pattern(nil), pattern...)
+	}
+	l.rate = next
+	l.mux.Unlock()
+	l.poke()
+	return nil
+}
+
+// CheckReasons returns an error if reasons cannot be used with SetReasons. The
+// reasons are "denied", "unknown id", "locked out", "closed", "enrollment" and
+// "error", the states are the same as for CheckRates.
+func CheckReasons(reasons map[string]string) error {
+	for reason, state := range reasons {
+		if _, ok := reasonNames[reason]; !ok {
+			return fmt.Errorf("unknown deny reason %q", reason)
+		}
+		if _, ok := stateNames[state]; !ok {
+			return fmt.Errorf("unknown LED state %q for deny reason %q", state, reason)
+		}
+	}
+	return nil
+}
+
+// SetReasons changes the state shown for the deny reasons in reasons, other
+// reasons are unchanged. By default "locked out" shows lockout, "enrollment"
+// shows enrolling, "error" shows error and the others show denied. Nothing is
+// changed if any reason is invalid. It is safe to call while the LED is in
+// use.
+func (l *LED) SetReasons(reasons map[string]string) error {
+	if err := CheckReasons(reasons); err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	next := make(map[auth.Reason]int, len(l.reasons)+len(reasons))
+	for reason, state := range l.reasons {
+		next[reason] = state
+	}
+	for reason, state := range reasons {
+		next[reasonNames[reason]] = stateNames[state]
+	}
+	l.reasons = next
+	l.mux.Unlock()
+	l.poke()
+	return nil
+}
+
+// Interrogating shows interrogating until ctx is done or access is allowed or
+// denied
 func (l *LED) Interrogating(ctx context.Context, msg string) {
 	l.mux.Lock()
-	l.interrogating = true
+	l.endInterrogating()
+	interrogation := make(chan struct{})
+	l.interrogation = interrogation
 	l.mux.Unlock()
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-interrogation:
+			return
+		}
 		l.mux.Lock()
-		l.interrogating = false
+		if l.interrogation == interrogation {
+			l.endInterrogating()
+		}
 		l.mux.Unlock()
 		l.poke()
 	}()
 	l.poke()
 }
 
+// endInterrogating stops showing interrogating. Must be called with mux held.
+func (l *LED) endInterrogating() {
+	if l.interrogation != nil {
+		close(l.interrogation)
+		l.interrogation = nil
+	}
+}
+
+// Deny shows the state for the reason access was denied, see SetReasons
 func (l *LED) Deny(ctx context.Context, msg string, reason error) error {
 	l.mux.Lock()
-	l.lastDeny = time.Now()
+	l.endInterrogating()
+	l.lastDeny = l.clock.Now()
+	l.denyState = denied
+	if state, ok := l.reasons[auth.DenyReason(ctx, reason)]; ok {
+		l.denyState = state
+	}
 	l.mux.Unlock()
 	l.poke()
 	return nil
 }
 
+// Allow shows allowed, or offline if HMS did not make the decision
 func (l *LED) Allow(ctx context.Context, msg string) error {
 	l.mux.Lock()
-	l.lastAllow = time.Now()
+	l.endInterrogating()
+	l.lastAllow = l.clock.Now()
+	l.allowState = allowed
+	if auth.DecisionFrom(ctx).Offline {
+		l.allowState = offline
+	}
+	l.mux.Unlock()
+	l.poke()
+	return nil
+}
+
+// Notify shows the result of an enrollment, other events are ignored
+func (l *LED) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	if event != admitter.Enrolled && event != admitter.EnrollmentFailed {
+		return nil
+	}
+	l.mux.Lock()
+	l.lastEnroll = l.clock.Now()
+	l.enrollEvent = event
 	l.mux.Unlock()
 	l.poke()
 	return nil
 }
 
-// run is the background thread for LED
-func (l *LED) run() {
+// Run shows the state of the LED, it does not return
+func (l *LED) Run() {
 	for {
 		l.loop()
 	}
 }
 
+// loop runs the pattern of the current state once, it returns early if the
+// LED is poked.
 func (l *LED) loop() {
-	blink := l.rate[l.state()]
+	state := l.state()
+	l.mux.Lock()
+	pattern := l.rate[state]
+	l.mux.Unlock()
 
-	if blink.on > 0 {
-		timer := time.NewTimer(blink.on)
-		_ = l.pin.Out(gpio.High)
-		select {
-		case <-timer.C:
-		case <-l.wake:
-			// stopping the timer prevents an adversary from growing a
-			// gorouting horde by getting denied repeatedly.
-			timer.Stop()
-			return
+	for i, d := range pattern {
+		if d <= 0 {
+			continue
 		}
-	}
-
-	if blink.off > 0 {
-		timer := time.NewTimer(blink.off)
-		_ = l.pin.Out(gpio.Low)
+		level := gpio.Low
+		if i%2 == 0 {
+			level = gpio.High
+		}
+		_ = l.pin.Out(level)
 		select {
-		case <-timer.C:
+		case <-l.clock.After(d):
 		case <-l.wake:
-			timer.Stop()
 			return
 		}
 	}
@@ -139,17 +371,49 @@ func (l *LED) poke() {
 	l.wake <- struct{}{}
 }
 
-// state returns the current intended led state
+// state returns the current intended led state, a state shown after an event
+// lasts for its time or one run of its pattern, whichever is longer.
 func (l *LED) state() int {
 	l.mux.Lock()
 	defer l.mux.Unlock()
 	switch {
-	case time.Since(l.lastAllow) < l.allowedTime:
-		return allowed
-	case l.interrogating:
+	case l.showing(l.lastAllow, l.allowedTime, l.allowState):
+		return l.allowState
+	case l.showing(l.lastEnroll, l.enrollmentTime, l.enrollState()):
+		return l.enrollState()
+	case l.interrogation != nil:
 		return interrogating
-	case time.Since(l.lastDeny) < l.deniedTime:
-		return denied
+	case l.showing(l.lastDeny, l.deniedTime, l.denyState):
+		return l.denyState
 	}
 	return heartbeat
 }
+
+// showing reports whether state, shown since for d, is still showing. l.mux
+// must be held.
+func (l *LED) showing(since time.Time, d time.Duration, state int) bool {
+	if pattern := l.rate[state].duration(); pattern > d {
+		d = pattern
+	}
+	return l.clock.Now().Sub(since) < d
+}
+
+// enrollState is the state for the last enrollment, l.mux must be held
+func (l *LED) enrollState() int {
+	if l.enrollEvent == admitter.Enrolled {
+		return enrolled
+	}
+	return enrollmentFailed
+}
+
+// clock is the time source of an LED, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
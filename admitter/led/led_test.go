@@ -6,35 +6,35 @@ import (
 	"testing"
 	"time"
 
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"periph.io/x/conn/v3/gpio"
 )
 
 func TestLED(t *testing.T) {
-	type input struct {
-		after time.Duration
-		do    func(*testing.T, *LED)
-		done  bool
-	}
 	for name, test := range map[string]struct {
 		allowedTime, deniedTime time.Duration
-		rates                   map[int]blink
+		enrollmentTime          time.Duration
+		rates                   map[int]Pattern
 		calls                   []gpio.Level
 		inputs                  []input
 	}{
 		"blinks when nothing happens": {
 			// twice in 1 second: 0-on, 300-off, 600-on, 900-off...
-			rates: map[int]blink{
-				heartbeat: {on: 300 * time.Millisecond, off: 300 * time.Millisecond},
+			rates: map[int]Pattern{
+				heartbeat: {300 * time.Millisecond, 300 * time.Millisecond},
 			},
 			calls: []gpio.Level{gpio.High, gpio.Low, gpio.High, gpio.Low},
 		},
 
 		"doesn't blink on if disabled": {
 			// off twice in 1 second: 0-off, 600-off...
-			rates: map[int]blink{
-				heartbeat: {on: 0, off: 600 * time.Millisecond},
+			rates: map[int]Pattern{
+				heartbeat: {0, 600 * time.Millisecond},
 			},
 			calls: []gpio.Level{gpio.Low, gpio.Low},
 		},
@@ -42,9 +42,9 @@ func TestLED(t *testing.T) {
 		"blinks once when allowed": { // as long as allowedTime is smaller than the total allowed blink period.
 			// on for half a second: 0-off, 50-Allow, 50-on, 300-on, 550-off, 650-off, 750-off, 850-off, 950-off...
 			allowedTime: 500 * time.Millisecond,
-			rates: map[int]blink{
-				heartbeat: {on: 0, off: 100 * time.Millisecond},
-				allowed:   {on: 250 * time.Millisecond, off: 0},
+			rates: map[int]Pattern{
+				heartbeat: {0, 100 * time.Millisecond},
+				allowed:   {250 * time.Millisecond, 0},
 			},
 			inputs: []input{
 				{after: 50 * time.Millisecond, do: func(t *testing.T, l *LED) { _ = l.Allow(context.Background(), "yea") }},
@@ -55,9 +55,9 @@ func TestLED(t *testing.T) {
 		"blinks once when allowed several times quickly": {
 			// on for half a second: 0-off, 50-Allow, 50-on, 80-Allow, 80-on, 110-Allow, 110-on, 360-on, 610-off, 710-off, 810-off, 910-off...
 			allowedTime: 500 * time.Millisecond,
-			rates: map[int]blink{
-				heartbeat: {on: 0, off: 100 * time.Millisecond},
-				allowed:   {on: 250 * time.Millisecond, off: 0},
+			rates: map[int]Pattern{
+				heartbeat: {0, 100 * time.Millisecond},
+				allowed:   {250 * time.Millisecond, 0},
 			},
 			inputs: []input{
 				{after: 50 * time.Millisecond, do: func(t *testing.T, l *LED) { _ = l.Allow(context.Background(), "yea") }},
@@ -70,37 +70,92 @@ func TestLED(t *testing.T) {
 		"does not blink when denied": {
 			// blinks evey 100 except a 500 gap: 0-on, 10-off, 110-on, 120-off, 200-Deny, 200-off, 450-off, 700-on, 710-off, 810-on, 820-off, 920-on, 930-off...
 			deniedTime: 500 * time.Millisecond,
-			rates: map[int]blink{
-				heartbeat: {on: 10 * time.Millisecond, off: 100 * time.Millisecond},
-				denied:    {on: 0, off: 250 * time.Millisecond},
+			rates: map[int]Pattern{
+				heartbeat: {10 * time.Millisecond, 100 * time.Millisecond},
+				denied:    {0, 250 * time.Millisecond},
 			},
 			inputs: []input{
-				{after: 200 * time.Millisecond, do: func(t *testing.T, l *LED) { _ = l.Deny(context.Background(), "nah", errors.New("said no")) }},
+				{after: 200 * time.Millisecond, do: func(t *testing.T, l *LED) { _ = l.Deny(context.Background(), "nah", admitter.AccessDenied) }},
 			},
 			calls: []gpio.Level{gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low},
 		},
 
-		"blinks until context is cancelled on interrogating": {
-			// blinks 3 times fast: 0-off, 100-off, 180-Interrogating(230), 180-on, 230-off, 280-on, 330-off, 380-on, 410-off, 510-off, 610-off, 710-off, 810-off, 910-off...
-			rates: map[int]blink{
-				heartbeat:     {on: 0, off: 100 * time.Millisecond},
-				interrogating: {on: 50 * time.Millisecond, off: 50 * time.Millisecond},
+		"shows enrollment": {
+			// slow blink for enrollment: 0-off, 100-Notify, 100-on, 300-off, 400-on, 600-off, 700-off, 800-off, 900-off...
+			enrollmentTime: 500 * time.Millisecond,
+			rates: map[int]Pattern{
+				heartbeat: {0, 100 * time.Millisecond},
+				enrolled:  {200 * time.Millisecond, 100 * time.Millisecond},
 			},
 			inputs: []input{
-				{after: 180 * time.Millisecond, do: func(t *testing.T, l *LED) {
-					ctx, cancel := context.WithTimeout(context.Background(), 230*time.Millisecond)
-					t.Cleanup(cancel)
-					l.Interrogating(ctx, "checking...")
+				{after: 100 * time.Millisecond, do: func(t *testing.T, l *LED) {
+					_ = l.Notify(context.Background(), admitter.Enrolled, "Card registered")
 				}},
 			},
+			calls: []gpio.Level{gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.Low},
+		},
+
+		"shows failed enrollment": {
+			// fast blink for failure: 0-off, 100-Notify, 100-on, 150-off, 250-on, 300-off, 400-on, 450-off, 550-on, 600-off, 700-off, 800-off, 900-off...
+			enrollmentTime: 500 * time.Millisecond,
+			rates: map[int]Pattern{
+				heartbeat:        {0, 100 * time.Millisecond},
+				enrollmentFailed: {50 * time.Millisecond, 100 * time.Millisecond},
+			},
+			inputs: []input{
+				{after: 100 * time.Millisecond, do: func(t *testing.T, l *LED) {
+					_ = l.Notify(context.Background(), admitter.EnrollmentFailed, "Card was not registered")
+				}},
+			},
+			calls: []gpio.Level{gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.Low},
+		},
+
+		"runs a sequence": {
+			// double blink: 0-on, 100-off, 200-on, 300-off...
+			rates: map[int]Pattern{
+				heartbeat: {100 * time.Millisecond, 100 * time.Millisecond, 0, 0, 100 * time.Millisecond, 700 * time.Millisecond},
+			},
+			calls: []gpio.Level{gpio.High, gpio.Low, gpio.High, gpio.Low},
+		},
+
+		"shows a state for one run of a longer pattern": {
+			// the whole pattern is shown: 0-off, 100-Deny, 100-on, 150-off, 200-on, 250-off, 300-on, 350-off, 500-off, 800-off...
+			deniedTime: 100 * time.Millisecond,
+			rates: map[int]Pattern{
+				heartbeat: {0, 300 * time.Millisecond},
+				failed:    {50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 150 * time.Millisecond},
+			},
+			inputs: []input{
+				{after: 100 * time.Millisecond, do: func(t *testing.T, l *LED) { _ = l.Deny(context.Background(), "Error", errors.New("db down")) }},
+			},
+			calls: []gpio.Level{gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low},
+		},
+
+		"blinks until context is cancelled on interrogating": {
+			// blinks 3 times fast: 0-off, 100-off, 180-Interrogating, 180-on, 230-off, 280-on, 330-off, 380-on, 410-cancel, 410-off, 510-off, 610-off, 710-off, 810-off, 910-off...
+			rates: map[int]Pattern{
+				heartbeat:     {0, 100 * time.Millisecond},
+				interrogating: {50 * time.Millisecond, 50 * time.Millisecond},
+			},
+			inputs: func() []input {
+				ctx, cancel := context.WithCancel(context.Background())
+				return []input{
+					{after: 180 * time.Millisecond, do: func(t *testing.T, l *LED) { l.Interrogating(ctx, "checking...") }},
+					{after: 410 * time.Millisecond, do: func(t *testing.T, l *LED) {
+						cancel()
+						// wait for the LED to be poked once interrogating is over
+						require.Eventually(t, func() bool { return len(l.wake) > 0 }, time.Second, time.Millisecond)
+					}},
+				}
+			}(),
 			calls: []gpio.Level{gpio.Low, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.Low},
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			start := time.Now()
+			clock := fakeclock.New()
 			pin := &pinMock{
 				t:     t,
-				start: start,
+				clock: clock,
 			}
 			pin.Test(t)
 			defer pin.AssertExpectations(t)
@@ -110,42 +165,227 @@ func TestLED(t *testing.T) {
 			}
 
 			l := &LED{
-				allowedTime: test.allowedTime,
-				deniedTime:  test.deniedTime,
-				rate:        test.rates,
-				pin:         pin,
-				wake:        make(chan struct{}),
+				allowedTime:    test.allowedTime,
+				deniedTime:     test.deniedTime,
+				enrollmentTime: test.enrollmentTime,
+				rate:           test.rates,
+				reasons:        defaultReasons,
+				pin:            pin,
+				wake:           make(chan struct{}, 1),
 			}
-
-			// do the inputs at the right times
-			go func(inputs []input) {
-				for {
-					inputsLeft := false
-					for i := range inputs {
-						if inputs[i].done {
-							continue
-						}
-						inputsLeft = true
-						if time.Since(start) < inputs[i].after {
-							continue
-						}
-						inputs[i].do(t, l)
-						inputs[i].done = true
-					}
-					if !inputsLeft {
-						break
-					}
-				}
-			}(test.inputs)
+			l.clock = &inputClock{Clock: clock, t: t, l: l, inputs: test.inputs}
 
 			// runs for 1 second
-			for time.Since(start) < time.Second {
+			for clock.Since() < time.Second {
 				l.loop()
 			}
 		})
 	}
 }
 
+func TestStates(t *testing.T) {
+	for name, test := range map[string]struct {
+		do func(ctx context.Context, details *auth.Details, l *LED)
+
+		wantState int
+	}{
+		"nothing": {
+			do:        func(context.Context, *auth.Details, *LED) {},
+			wantState: heartbeat,
+		},
+
+		"allowed": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				_ = l.Allow(ctx, "Welcome back Bracken")
+			},
+			wantState: allowed,
+		},
+
+		"interrogating": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				l.Interrogating(ctx, "Authorizing tag...")
+			},
+			wantState: interrogating,
+		},
+
+		"allowed ends interrogating": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				l.Interrogating(ctx, "Authorizing tag...")
+				_ = l.Allow(ctx, "Welcome back Bracken")
+			},
+			wantState: allowed,
+		},
+
+		"allowed offline": {
+			do: func(ctx context.Context, details *auth.Details, l *LED) {
+				details.SetOffline()
+				_ = l.Allow(ctx, "Welcome back Bracken")
+			},
+			wantState: offline,
+		},
+
+		"denied": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				_ = l.Deny(ctx, "Access denied", admitter.AccessDenied)
+			},
+			wantState: denied,
+		},
+
+		"closed is denied": {
+			do: func(ctx context.Context, details *auth.Details, l *LED) {
+				details.SetReason(auth.Closed)
+				_ = l.Deny(ctx, "Closed", admitter.AccessDenied)
+			},
+			wantState: denied,
+		},
+
+		"locked out": {
+			do: func(ctx context.Context, details *auth.Details, l *LED) {
+				details.SetReason(auth.LockedOut)
+				_ = l.Deny(ctx, "Locked out", errors.New("locked out, try again in 5 s"))
+			},
+			wantState: lockout,
+		},
+
+		"hms unreachable": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				_ = l.Deny(ctx, "Error", errors.New("dial tcp: i/o timeout"))
+			},
+			wantState: failed,
+		},
+
+		"denied ends interrogating": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				l.Interrogating(ctx, "Authorizing tag...")
+				_ = l.Deny(ctx, "Access denied", admitter.AccessDenied)
+				l.mux.Lock()
+				defer l.mux.Unlock()
+				require.Nil(t, l.interrogation)
+			},
+			wantState: denied,
+		},
+
+		"enrollment tag": {
+			do: func(ctx context.Context, _ *auth.Details, l *LED) {
+				_ = l.Deny(ctx, "Enrolling", auth.ErrEnrollment)
+			},
+			wantState: enrolling,
+		},
+
+		"mapped reason": {
+			do: func(ctx context.Context, details *auth.Details, l *LED) {
+				require.NoError(t, l.SetReasons(map[string]string{"closed": "lockout"}))
+				details.SetReason(auth.Closed)
+				_ = l.Deny(ctx, "Closed", admitter.AccessDenied)
+			},
+			wantState: lockout,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := &LED{
+				allowedTime:    defaultAllowedTime,
+				deniedTime:     defaultDeniedTime,
+				enrollmentTime: defaultEnrollmentTime,
+				rate:           defaultRates,
+				reasons:        defaultReasons,
+				clock:          fakeclock.New(),
+				wake:           make(chan struct{}, 10),
+			}
+			ctx, details := auth.WithDetails(context.Background())
+			test.do(ctx, details, l)
+			require.Equal(t, test.wantState, l.state())
+		})
+	}
+}
+
+func TestSetReasons(t *testing.T) {
+	l := &LED{
+		reasons: defaultReasons,
+		wake:    make(chan struct{}, 1),
+	}
+	require.EqualError(t, l.SetReasons(map[string]string{"closed": "lockout", "bored": "denied"}), `unknown deny reason "bored"`)
+	require.EqualError(t, l.SetReasons(map[string]string{"closed": "party"}), `unknown LED state "party" for deny reason "closed"`)
+	require.Equal(t, defaultReasons, l.reasons)
+
+	require.NoError(t, l.SetReasons(map[string]string{"closed": "lockout"}))
+	require.Equal(t, lockout, l.reasons[auth.Closed])
+	require.Equal(t, failed, l.reasons[auth.Failed])
+	require.Len(t, defaultReasons, 3, "defaults must not change")
+}
+
+func TestSetPatterns(t *testing.T) {
+	l := &LED{
+		rate: defaultRates,
+		wake: make(chan struct{}, 1),
+	}
+	require.EqualError(t, l.SetPatterns(map[string]Pattern{"denied": {0, 0}}), `LED state "denied" must have an on or off time`)
+	require.EqualError(t, l.SetPatterns(map[string]Pattern{"denied": {time.Second, -time.Second}}), `LED state "denied" has a negative time`)
+	require.Equal(t, defaultRates, l.rate)
+
+	doubleBlink := Pattern{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 700 * time.Millisecond}
+	require.NoError(t, l.SetPatterns(map[string]Pattern{"denied": doubleBlink}))
+	require.Equal(t, doubleBlink, l.rate[denied])
+	require.Equal(t, Pattern{0, time.Second}, defaultRates[denied], "defaults must not change")
+}
+
+func TestSetRates(t *testing.T) {
+	for name, test := range map[string]struct {
+		rates map[string]Rate
+
+		want    map[int]Pattern
+		wantErr string
+	}{
+		"changes only the given states": {
+			rates: map[string]Rate{
+				"heartbeat":         {On: 100 * time.Millisecond, Off: time.Second},
+				"enrollment failed": {Off: time.Second},
+			},
+			want: map[int]Pattern{
+				heartbeat:        {100 * time.Millisecond, time.Second},
+				interrogating:    defaultRates[interrogating],
+				allowed:          defaultRates[allowed],
+				offline:          defaultRates[offline],
+				denied:           defaultRates[denied],
+				lockout:          defaultRates[lockout],
+				failed:           defaultRates[failed],
+				enrolling:        defaultRates[enrolling],
+				enrolled:         defaultRates[enrolled],
+				enrollmentFailed: {0, time.Second},
+			},
+		},
+
+		"unknown state": {
+			rates: map[string]Rate{
+				"heartbeat": {On: 100 * time.Millisecond},
+				"party":     {On: 100 * time.Millisecond},
+			},
+			want:    defaultRates,
+			wantErr: `unknown LED state "party"`,
+		},
+
+		"all zero": {
+			rates:   map[string]Rate{"denied": {}},
+			want:    defaultRates,
+			wantErr: `LED state "denied" must have an on or off time`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := &LED{
+				rate: defaultRates,
+				wake: make(chan struct{}, 1),
+			}
+			err := l.SetRates(test.rates)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.wantErr)
+			}
+			require.Equal(t, test.want, l.rate)
+		})
+	}
+	require.Equal(t, Pattern{50 * time.Millisecond, 4950 * time.Millisecond}, defaultRates[heartbeat], "defaults must not change")
+}
+
 func assertCallOrder(t *testing.T, calls []mock.Call, expected []gpio.Level) {
 	assert.Len(t, calls, len(expected), "Wrong number of calls to Out(), got %d, want %d.", len(calls), len(expected))
 	for i := range expected {
@@ -155,11 +395,38 @@ func assertCallOrder(t *testing.T, calls []mock.Call, expected []gpio.Level) {
 
 type pinMock struct {
 	t     *testing.T
-	start time.Time
+	clock *fakeclock.Clock
 	mock.Mock
 }
 
 func (p *pinMock) Out(level gpio.Level) error {
-	p.t.Log(level, time.Since(p.start))
+	p.t.Log(level, p.clock.Since())
 	return p.Called(level).Error(0)
 }
+
+// input is done to an LED after some time
+type input struct {
+	after time.Duration
+	do    func(*testing.T, *LED)
+}
+
+// inputClock is a fake clock which does inputs, in order, when their time
+// comes. An input interrupts the wait it falls in, it must poke the LED.
+type inputClock struct {
+	*fakeclock.Clock
+	t      *testing.T
+	l      *LED
+	inputs []input
+}
+
+func (c *inputClock) After(d time.Duration) <-chan time.Time {
+	if len(c.inputs) == 0 || c.inputs[0].after > c.Since()+d {
+		return c.Clock.After(d)
+	}
+	next := c.inputs[0]
+	c.inputs = c.inputs[1:]
+	<-c.Clock.After(next.after - c.Since())
+	next.do(c.t, c.l)
+	// The wait is over when the poke is seen
+	return make(chan time.Time)
+}
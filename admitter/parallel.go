@@ -0,0 +1,158 @@
+package admitter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Logger can be used to interface any logger to this package, by default
+// it discards all logs
+var Logger ContextLogger = logDiscarder{}
+
+// ContextLogger is an interface which allows you to use any logger and include
+// context fields.
+type ContextLogger interface {
+	Warnf(ctx context.Context, format string, args ...interface{})
+}
+
+type logDiscarder struct{}
+
+func (logDiscarder) Warnf(context.Context, string, ...interface{}) {}
+
+// Member is one Admitter in a Parallel
+type Member struct {
+	// Name identifies the Admitter in errors
+	Name     string
+	Admitter Admitter
+	// Timeout limits the time waited for the Admitter, zero is no limit. The
+	// Admitter is reported as failed if it has not returned by then, it is
+	// left to finish on its own with the caller's context.
+	Timeout time.Duration
+	// Critical Admitters, such as a strike, are always waited for whatever
+	// their Timeout and only their errors are returned. Other Members which
+	// fail are logged.
+	Critical bool
+}
+
+// Parallel is a container for multiple Admitters which calls them all
+// concurrently, unlike Mux an error or panic from one Member does not stop the
+// others being called. Each Member is waited for until it returns or its
+// Timeout, the errors of Critical Members are returned together as Errors and
+// the others are logged so that a slow status light cannot stop a guard.
+type Parallel []Member
+
+// Error is the error from one Member of a Parallel
+type Error struct {
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors are the errors from the Critical Members of a Parallel which failed,
+// in Member order
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Interrogating calls Interrogating on all Members, there is no error so any
+// panic is discarded.
+func (p Parallel) Interrogating(ctx context.Context, message string) {
+	p.call(ctx, func(ctx context.Context, a Admitter) error {
+		a.Interrogating(ctx, message)
+		return nil
+	})
+}
+
+func (p Parallel) Deny(ctx context.Context, message string, reason error) error {
+	return p.call(ctx, func(ctx context.Context, a Admitter) error {
+		return a.Deny(ctx, message, reason)
+	})
+}
+
+func (p Parallel) Allow(ctx context.Context, message string) error {
+	return p.call(ctx, func(ctx context.Context, a Admitter) error {
+		return a.Allow(ctx, message)
+	})
+}
+
+// Notify calls Notify on all Members which are Notifiers
+func (p Parallel) Notify(ctx context.Context, event Event, message string) error {
+	return p.call(ctx, func(ctx context.Context, a Admitter) error {
+		return Notify(ctx, a, event, message)
+	})
+}
+
+// call calls f with every Member concurrently and returns Errors if any
+// Critical Member failed, other failures are logged.
+func (p Parallel) call(ctx context.Context, f func(context.Context, Admitter) error) error {
+	start := time.Now()
+	results := make([]chan error, len(p))
+	for i, m := range p {
+		results[i] = make(chan error, 1)
+		go m.call(ctx, f, results[i])
+	}
+
+	var errs Errors
+	for i, m := range p {
+		err := m.wait(start, results[i])
+		switch {
+		case err == nil:
+		case m.Critical:
+			errs = append(errs, &Error{Name: m.Name, Err: err})
+		default:
+			Logger.Warnf(ctx, "Admitter %s failed: %s", m.Name, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// call calls f with the Admitter and sends the result to result, a panic is
+// sent as an error.
+func (m Member) call(ctx context.Context, f func(context.Context, Admitter) error, result chan<- error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result <- fmt.Errorf("panic: %v", r)
+		}
+	}()
+	result <- f(ctx, m.Admitter)
+}
+
+// wait returns the result of the Member, or an error if it is not Critical
+// and its Timeout since start passes first.
+func (m Member) wait(start time.Time, result <-chan error) error {
+	if m.Critical || m.Timeout <= 0 {
+		return <-result
+	}
+	// An answer in time is preferred to a timeout that has also passed
+	select {
+	case err := <-result:
+		return err
+	default:
+	}
+	timeout := time.NewTimer(time.Until(start.Add(m.Timeout)))
+	defer timeout.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timeout.C:
+		return fmt.Errorf("no answer within %s: %w", m.Timeout, context.DeadlineExceeded)
+	}
+}
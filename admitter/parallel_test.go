@@ -0,0 +1,174 @@
+package admitter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelAllow(t *testing.T) {
+	for name, test := range map[string]struct {
+		fail  map[int]error
+		panic map[int]bool
+		slow  map[int]bool
+
+		wantErr  string
+		wantLogs []string
+	}{
+		"all work": {},
+
+		"one fails": {
+			fail:     map[int]error{1: errors.New("webhook down")},
+			wantLogs: []string{"Admitter admitter 1 failed: webhook down"},
+		},
+
+		"critical failures are returned": {
+			fail:     map[int]error{0: errors.New("oops"), 2: errors.New("webhook down")},
+			wantErr:  "strike: oops",
+			wantLogs: []string{"Admitter admitter 2 failed: webhook down"},
+		},
+
+		"panics are errors": {
+			panic:    map[int]bool{0: true, 1: true},
+			wantErr:  "strike: panic: oops",
+			wantLogs: []string{"Admitter admitter 1 failed: panic: oops"},
+		},
+
+		"slow admitters time out": {
+			slow:     map[int]bool{2: true},
+			wantLogs: []string{"Admitter admitter 2 failed: no answer within 50ms: context deadline exceeded"},
+		},
+
+		"critical admitters are waited for": {
+			slow: map[int]bool{0: true},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs := &testLogger{}
+			Logger = logs
+			defer func() { Logger = logDiscarder{} }()
+			release := make(chan struct{})
+			defer close(release)
+			var p Parallel
+			for i := 0; i < 3; i++ {
+				mockAdmitter := &testAdmitter{}
+				mockAdmitter.Test(t)
+				defer mockAdmitter.AssertExpectations(t)
+				call := mockAdmitter.On("Allow", mock.Anything, "Welcome back Bracken").Return(test.fail[i]).Once()
+				panics, slow := test.panic[i], test.slow[i]
+				call.Run(func(mock.Arguments) {
+					if panics {
+						panic("oops")
+					}
+					if slow {
+						// Ignoring the deadline
+						select {
+						case <-time.After(100 * time.Millisecond):
+						case <-release:
+						}
+					}
+				})
+				m := Member{Name: "admitter " + string(rune('0'+i)), Admitter: mockAdmitter, Timeout: 50 * time.Millisecond}
+				if i == 0 {
+					m.Name, m.Critical = "strike", true
+				}
+				p = append(p, m)
+			}
+
+			err := p.Allow(context.Background(), "Welcome back Bracken")
+			require.Equal(t, test.wantLogs, logs.lines)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestParallelContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	given := make(chan context.Context, 1)
+	mockAdmitter := &testAdmitter{}
+	mockAdmitter.Test(t)
+	defer mockAdmitter.AssertExpectations(t)
+	mockAdmitter.On("Interrogating", mock.Anything, "Authorizing tag...").Return().Run(func(args mock.Arguments) {
+		given <- args.Get(0).(context.Context)
+	}).Once()
+
+	Parallel{{Name: "led", Admitter: mockAdmitter, Timeout: time.Millisecond}}.Interrogating(ctx, "Authorizing tag...")
+	// Interrogating lasts until the caller is done, not the Timeout
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, (<-given).Err())
+}
+
+func TestParallelConcurrent(t *testing.T) {
+	var p Parallel
+	for i := 0; i < 10; i++ {
+		mockAdmitter := &testAdmitter{}
+		mockAdmitter.Test(t)
+		defer mockAdmitter.AssertExpectations(t)
+		mockAdmitter.On("Deny", mock.Anything, "Tag not known", AccessDenied).Return(nil).Run(func(mock.Arguments) {
+			time.Sleep(50 * time.Millisecond)
+		}).Once()
+		p = append(p, Member{Name: "slow", Admitter: mockAdmitter})
+	}
+
+	start := time.Now()
+	require.NoError(t, p.Deny(context.Background(), "Tag not known", AccessDenied))
+	require.Less(t, time.Since(start), 250*time.Millisecond, "admitters were called one after another")
+}
+
+func TestParallelPanic(t *testing.T) {
+	called := make(chan string, 2)
+	critical := &testAdmitter{}
+	critical.On("Interrogating", mock.Anything, "Authorizing tag...").Return().Run(func(mock.Arguments) {
+		called <- "strike"
+	}).Once()
+	other := &testAdmitter{}
+	other.On("Interrogating", mock.Anything, "Authorizing tag...").Return().Run(func(mock.Arguments) {
+		panic("oops")
+	}).Once()
+
+	Parallel{
+		{Name: "webhook", Admitter: other},
+		{Name: "strike", Admitter: critical, Critical: true},
+	}.Interrogating(context.Background(), "Authorizing tag...")
+	require.Equal(t, "strike", <-called)
+	critical.AssertExpectations(t)
+	other.AssertExpectations(t)
+}
+
+func TestParallelNotify(t *testing.T) {
+	notifier := &testNotifier{}
+	notifier.Test(t)
+	defer notifier.AssertExpectations(t)
+	notifier.On("Notify", mock.Anything, Opened, "Door opened").Return(errors.New("oops")).Once()
+	admitter := &testAdmitter{}
+	admitter.Test(t)
+	defer admitter.AssertExpectations(t)
+
+	err := Parallel{
+		{Name: "admitter", Admitter: admitter},
+		{Name: "notifier", Admitter: notifier, Critical: true},
+	}.Notify(context.Background(), Opened, "Door opened")
+	require.EqualError(t, err, "notifier: oops")
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Equal(t, "notifier", errs[0].Name)
+}
+
+// testLogger records the lines logged
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Warnf(_ context.Context, format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,367 @@
+// rgb is a status light Admitter for red, green and blue LEDs, each state is
+// shown as a colour.
+package rgb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+const (
+	// These are the indicator states
+	idle = iota
+	interrogating
+	allowed
+	offline
+	denied
+	failed
+
+	defaultAllowedTime = time.Second
+	defaultDeniedTime  = time.Second
+	// fadeStep is the time between colours while fading
+	fadeStep = 20 * time.Millisecond
+)
+
+var (
+	// defaultColours maps indicator state to colour
+	defaultColours = map[int]Colour{
+		idle:          {0, 0, 0x20},
+		interrogating: {0xff, 0xff, 0xff},
+		allowed:       {0, 0xff, 0},
+		offline:       {0xff, 0xa0, 0},
+		denied:        {0xff, 0, 0},
+		failed:        {0xff, 0, 0xff},
+	}
+)
+
+// stateNames are the names of the indicator states for SetColours
+var stateNames = map[string]int{
+	"idle":          idle,
+	"interrogating": interrogating,
+	"allowed":       allowed,
+	"offline":       offline,
+	"denied":        denied,
+	"error":         failed,
+}
+
+// Colour is the brightness of the red, green and blue LEDs, 0 is off and 255
+// is fully on. Without PWM an LED is on if it is at least half brightness.
+type Colour struct {
+	R, G, B uint8
+}
+
+// ParseColour parses a colour in the form "#rrggbb"
+func ParseColour(s string) (Colour, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return Colour{}, fmt.Errorf("colour %q is not in the form #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 24)
+	if err != nil {
+		return Colour{}, fmt.Errorf("colour %q is not in the form #rrggbb", s)
+	}
+	return Colour{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v)}, nil
+}
+
+func (c Colour) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Pin is a GPIO pin attached to one of the LEDs, any gpio.PinIO can be used.
+// PWM is only used if the RGB has a Frequency.
+type Pin interface {
+	Out(gpio.Level) error
+	PWM(duty gpio.Duty, f physic.Frequency) error
+}
+
+// RGB is an Admitter that shows the state of the door as a colour
+type RGB struct {
+	// Frequency is the PWM frequency to drive the LEDs at, if it is zero the
+	// LEDs are only turned on or off
+	Frequency physic.Frequency
+	// Fade is the time taken to change colour, it needs a Frequency
+	Fade time.Duration
+	// ActiveLow is set if the LEDs are on when their pins are low, as with a
+	// common anode LED
+	ActiveLow bool
+
+	allowedTime, deniedTime time.Duration
+	red, green, blue        Pin
+	clock                   clock
+
+	mux     sync.Mutex
+	colours map[int]Colour
+	wake    chan struct{}
+	current Colour
+	// interrogation is closed when interrogating ends, nil when not
+	// interrogating
+	interrogation chan struct{}
+	lastAllow     time.Time
+	allowState    int
+	lastDeny      time.Time
+	denyState     int
+}
+
+// New returns an RGB for the LEDs on red, green and blue, it is started with
+// Run once its fields are set.
+func New(red, green, blue Pin) *RGB {
+	return &RGB{
+		allowedTime: defaultAllowedTime,
+		deniedTime:  defaultDeniedTime,
+		red:         red,
+		green:       green,
+		blue:        blue,
+		clock:       realClock{},
+		colours:     defaultColours,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Run shows the state until an LED cannot be driven, it does not return
+// otherwise.
+func (r *RGB) Run() error {
+	// The LEDs start off
+	if err := r.set(Colour{}); err != nil {
+		return err
+	}
+	for {
+		until, err := r.update()
+		if err != nil {
+			return err
+		}
+		r.wait(until)
+	}
+}
+
+// CheckColours returns an error if colours cannot be used with SetColours. The
+// states are "idle", "interrogating", "allowed", "offline" (allowed without
+// HMS), "denied" and "error" (denied because access could not be checked).
+func CheckColours(colours map[string]string) error {
+	for name, colour := range colours {
+		if _, ok := stateNames[name]; !ok {
+			return fmt.Errorf("unknown RGB state %q", name)
+		}
+		if _, err := ParseColour(colour); err != nil {
+			return fmt.Errorf("RGB state %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// SetColours changes the colour of the states in colours, other states are
+// unchanged. Nothing is changed if any colour is invalid. It is safe to call
+// while the RGB is in use.
+func (r *RGB) SetColours(colours map[string]string) error {
+	if err := CheckColours(colours); err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	next := make(map[int]Colour, len(r.colours))
+	for state, c := range r.colours {
+		next[state] = c
+	}
+	for name, colour := range colours {
+		next[stateNames[name]], _ = ParseColour(colour)
+	}
+	r.colours = next
+	r.mux.Unlock()
+	r.poke()
+	return nil
+}
+
+// Interrogating shows interrogating until ctx is done or access is allowed or
+// denied
+func (r *RGB) Interrogating(ctx context.Context, msg string) {
+	r.mux.Lock()
+	r.endInterrogating()
+	interrogation := make(chan struct{})
+	r.interrogation = interrogation
+	r.mux.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-interrogation:
+			return
+		}
+		r.mux.Lock()
+		if r.interrogation == interrogation {
+			r.endInterrogating()
+		}
+		r.mux.Unlock()
+		r.poke()
+	}()
+	r.poke()
+}
+
+// endInterrogating stops showing interrogating. Must be called with mux held.
+func (r *RGB) endInterrogating() {
+	if r.interrogation != nil {
+		close(r.interrogation)
+		r.interrogation = nil
+	}
+}
+
+// Deny shows denied, or error if access could not be checked
+func (r *RGB) Deny(ctx context.Context, msg string, reason error) error {
+	r.mux.Lock()
+	r.endInterrogating()
+	r.lastDeny = r.clock.Now()
+	r.denyState = denied
+	if auth.DenyReason(ctx, reason) == auth.Failed {
+		r.denyState = failed
+	}
+	r.mux.Unlock()
+	r.poke()
+	return nil
+}
+
+// Allow shows allowed, or offline if HMS did not make the decision
+func (r *RGB) Allow(ctx context.Context, msg string) error {
+	r.mux.Lock()
+	r.endInterrogating()
+	r.lastAllow = r.clock.Now()
+	r.allowState = allowed
+	if auth.DecisionFrom(ctx).Offline {
+		r.allowState = offline
+	}
+	r.mux.Unlock()
+	r.poke()
+	return nil
+}
+
+// update changes to the colour of the current state and returns when the
+// state ends, zero if it only ends with a poke.
+func (r *RGB) update() (time.Time, error) {
+	// The state is about to be read, so any poke so far is handled
+	select {
+	case <-r.wake:
+	default:
+	}
+
+	state, until := r.state()
+	r.mux.Lock()
+	colour := r.colours[state]
+	r.mux.Unlock()
+	return until, r.show(colour)
+}
+
+// wait waits until a poke or until, if it is not zero
+func (r *RGB) wait(until time.Time) {
+	var expired <-chan time.Time
+	if !until.IsZero() {
+		expired = r.clock.After(until.Sub(r.clock.Now()))
+	}
+	select {
+	case <-r.wake:
+	case <-expired:
+	}
+}
+
+// show changes the LEDs to colour, fading if there is a Frequency and Fade.
+// A poke stops the fade part way and is left for wait.
+func (r *RGB) show(colour Colour) error {
+	from := r.current
+	if colour == from {
+		return nil
+	}
+	steps := 1
+	if r.Frequency > 0 && r.Fade > 0 {
+		steps = int(r.Fade / fadeStep)
+	}
+	for i := 1; i < steps; i++ {
+		if err := r.set(blend(from, colour, i, steps)); err != nil {
+			return err
+		}
+		select {
+		case <-r.wake:
+			r.poke()
+			return nil
+		case <-r.clock.After(fadeStep):
+		}
+	}
+	return r.set(colour)
+}
+
+// set drives the LEDs to show c
+func (r *RGB) set(c Colour) error {
+	for _, led := range []struct {
+		name  string
+		pin   Pin
+		value uint8
+	}{
+		{"red", r.red, c.R},
+		{"green", r.green, c.G},
+		{"blue", r.blue, c.B},
+	} {
+		if err := r.drive(led.pin, led.value); err != nil {
+			return fmt.Errorf("failed to drive %s LED: %w", led.name, err)
+		}
+	}
+	r.current = c
+	return nil
+}
+
+// drive sets pin to value, with PWM if there is a Frequency
+func (r *RGB) drive(pin Pin, value uint8) error {
+	if r.Frequency <= 0 {
+		on := value >= 0x80
+		return pin.Out(gpio.Level(on != r.ActiveLow))
+	}
+	duty := gpio.Duty(uint64(value) * uint64(gpio.DutyMax) / 0xff)
+	if r.ActiveLow {
+		duty = gpio.DutyMax - duty
+	}
+	return pin.PWM(duty, r.Frequency)
+}
+
+// poke causes loop to show the current state immediately
+func (r *RGB) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// state returns the current intended indicator state and when it will end,
+// zero if it only ends with a poke
+func (r *RGB) state() (int, time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := r.clock.Now()
+	switch {
+	case now.Before(r.lastAllow.Add(r.allowedTime)):
+		return r.allowState, r.lastAllow.Add(r.allowedTime)
+	case r.interrogation != nil:
+		return interrogating, time.Time{}
+	case now.Before(r.lastDeny.Add(r.deniedTime)):
+		return r.denyState, r.lastDeny.Add(r.deniedTime)
+	}
+	return idle, time.Time{}
+}
+
+// blend returns the colour step of steps of the way from a to b
+func blend(a, b Colour, step, steps int) Colour {
+	mix := func(x, y uint8) uint8 {
+		return uint8(int(x) + (int(y)-int(x))*step/steps)
+	}
+	return Colour{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B)}
+}
+
+// clock is the time source of an RGB, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
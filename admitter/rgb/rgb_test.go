@@ -0,0 +1,284 @@
+package rgb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestRGB(t *testing.T) {
+	for name, test := range map[string]struct {
+		frequency physic.Frequency
+		fade      time.Duration
+		activeLow bool
+		colours   map[string]string
+		do        func(ctx context.Context, details *auth.Details, r *RGB)
+
+		want []string
+	}{
+		"allowed": {
+			do: func(ctx context.Context, _ *auth.Details, r *RGB) {
+				_ = r.Allow(ctx, "Welcome back Bracken")
+			},
+			want: []string{
+				"0s red low", "0s green low", "0s blue low",
+				"0s red low", "0s green high", "0s blue low",
+				"1s red low", "1s green low", "1s blue low",
+			},
+		},
+
+		"allowed offline": {
+			do: func(ctx context.Context, details *auth.Details, r *RGB) {
+				details.SetOffline()
+				_ = r.Allow(ctx, "Welcome back Bracken")
+			},
+			want: []string{
+				"0s red low", "0s green low", "0s blue low",
+				"0s red high", "0s green high", "0s blue low",
+				"1s red low", "1s green low", "1s blue low",
+			},
+		},
+
+		"denied active low": {
+			activeLow: true,
+			do: func(ctx context.Context, _ *auth.Details, r *RGB) {
+				_ = r.Deny(ctx, "Access denied", admitter.AccessDenied)
+			},
+			want: []string{
+				"0s red high", "0s green high", "0s blue high",
+				"0s red low", "0s green high", "0s blue high",
+				"1s red high", "1s green high", "1s blue high",
+			},
+		},
+
+		"error with pwm": {
+			frequency: physic.KiloHertz,
+			colours:   map[string]string{"idle": "#000000"},
+			do: func(ctx context.Context, _ *auth.Details, r *RGB) {
+				_ = r.Deny(ctx, "Error", errors.New("dial tcp: i/o timeout"))
+			},
+			want: []string{
+				"0s red 0%", "0s green 0%", "0s blue 0%",
+				"0s red 100%", "0s green 0%", "0s blue 100%",
+				"1s red 0%", "1s green 0%", "1s blue 0%",
+			},
+		},
+
+		"locked out is denied": {
+			frequency: physic.KiloHertz,
+			activeLow: true,
+			colours:   map[string]string{"idle": "#000000", "denied": "#800000"},
+			do: func(ctx context.Context, details *auth.Details, r *RGB) {
+				details.SetReason(auth.LockedOut)
+				_ = r.Deny(ctx, "Locked out", errors.New("locked out, try again in 5 s"))
+			},
+			want: []string{
+				"0s red 100%", "0s green 100%", "0s blue 100%",
+				"0s red 49%", "0s green 100%", "0s blue 100%",
+				"1s red 100%", "1s green 100%", "1s blue 100%",
+			},
+		},
+
+		"fades": {
+			frequency: physic.KiloHertz,
+			fade:      80 * time.Millisecond,
+			colours:   map[string]string{"idle": "#000000"},
+			do: func(ctx context.Context, _ *auth.Details, r *RGB) {
+				_ = r.Allow(ctx, "Welcome back Bracken")
+			},
+			want: []string{
+				"0s red 0%", "0s green 0%", "0s blue 0%",
+				"0s red 0%", "0s green 24%", "0s blue 0%",
+				"20ms red 0%", "20ms green 49%", "20ms blue 0%",
+				"40ms red 0%", "40ms green 74%", "40ms blue 0%",
+				"60ms red 0%", "60ms green 100%", "60ms blue 0%",
+				"1s red 0%", "1s green 75%", "1s blue 0%",
+				"1.02s red 0%", "1.02s green 50%", "1.02s blue 0%",
+				"1.04s red 0%", "1.04s green 25%", "1.04s blue 0%",
+				"1.06s red 0%", "1.06s green 0%", "1.06s blue 0%",
+			},
+		},
+
+		"fading needs pwm": {
+			fade:    80 * time.Millisecond,
+			colours: map[string]string{"allowed": "#00ff00"},
+			do: func(ctx context.Context, _ *auth.Details, r *RGB) {
+				_ = r.Allow(ctx, "Welcome back Bracken")
+			},
+			want: []string{
+				"0s red low", "0s green low", "0s blue low",
+				"0s red low", "0s green high", "0s blue low",
+				"1s red low", "1s green low", "1s blue low",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := fakeclock.New()
+			timeline := &timeline{clock: clock}
+			r := New(timeline.pin("red"), timeline.pin("green"), timeline.pin("blue"))
+			r.clock = clock
+			r.Frequency = test.frequency
+			r.Fade = test.fade
+			r.ActiveLow = test.activeLow
+			require.NoError(t, r.SetColours(test.colours))
+
+			// As Run does
+			require.NoError(t, r.set(Colour{}))
+			ctx, details := auth.WithDetails(context.Background())
+			test.do(ctx, details, r)
+			until, err := r.update()
+			require.NoError(t, err)
+			require.False(t, until.IsZero())
+			r.wait(until)
+			until, err = r.update()
+			require.NoError(t, err)
+			require.True(t, until.IsZero())
+
+			require.Equal(t, test.want, timeline.events)
+		})
+	}
+}
+
+func TestInterrogating(t *testing.T) {
+	clock := fakeclock.New()
+	timeline := &timeline{clock: clock}
+	r := New(timeline.pin("red"), timeline.pin("green"), timeline.pin("blue"))
+	r.clock = clock
+	require.NoError(t, r.set(Colour{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Interrogating(ctx, "Authorizing tag...")
+	until, err := r.update()
+	require.NoError(t, err)
+	require.True(t, until.IsZero(), "interrogating lasts until the context is done")
+
+	cancel()
+	// Interrogating ending pokes the RGB
+	r.wait(until)
+	_, err = r.update()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"0s red low", "0s green low", "0s blue low",
+		"0s red high", "0s green high", "0s blue high",
+		"0s red low", "0s green low", "0s blue low",
+	}, timeline.events)
+
+	// Access being denied ends interrogating without the context ending
+	r.Interrogating(context.Background(), "Authorizing tag...")
+	require.NoError(t, r.Deny(context.Background(), "Access denied", admitter.AccessDenied))
+	state, _ := r.state()
+	require.Equal(t, denied, state)
+	require.Nil(t, r.interrogation)
+}
+
+func TestRun(t *testing.T) {
+	clock := fakeclock.New()
+	timeline := &timeline{clock: clock, err: errors.New("no PWM on this pin")}
+	r := New(timeline.pin("red"), timeline.pin("green"), timeline.pin("blue"))
+	r.Frequency = physic.KiloHertz
+	require.EqualError(t, r.Run(), "failed to drive red LED: no PWM on this pin")
+}
+
+func TestSetColours(t *testing.T) {
+	for name, test := range map[string]struct {
+		colours map[string]string
+
+		want    map[int]Colour
+		wantErr string
+	}{
+		"changes only the given states": {
+			colours: map[string]string{"idle": "#000000", "error": "#Ff8000"},
+			want: map[int]Colour{
+				idle:          {},
+				interrogating: defaultColours[interrogating],
+				allowed:       defaultColours[allowed],
+				offline:       defaultColours[offline],
+				denied:        defaultColours[denied],
+				failed:        {0xff, 0x80, 0},
+			},
+		},
+
+		"unknown state": {
+			colours: map[string]string{"idle": "#000000", "party": "#ff00ff"},
+			want:    defaultColours,
+			wantErr: `unknown RGB state "party"`,
+		},
+
+		"bad colour": {
+			colours: map[string]string{"denied": "red"},
+			want:    defaultColours,
+			wantErr: `RGB state "denied": colour "red" is not in the form #rrggbb`,
+		},
+
+		"bad hex": {
+			colours: map[string]string{"denied": "#ff00gg"},
+			want:    defaultColours,
+			wantErr: `RGB state "denied": colour "#ff00gg" is not in the form #rrggbb`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := New(nil, nil, nil)
+			err := r.SetColours(test.colours)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.wantErr)
+			}
+			require.Equal(t, test.want, r.colours)
+		})
+	}
+	require.Equal(t, Colour{0, 0, 0x20}, defaultColours[idle], "defaults must not change")
+	require.Equal(t, "#0000ff", Colour{B: 0xff}.String())
+}
+
+// timeline records what the pins of an RGB are driven to and when
+type timeline struct {
+	clock  *fakeclock.Clock
+	err    error
+	mux    sync.Mutex
+	events []string
+}
+
+func (tl *timeline) pin(name string) *testPin {
+	return &testPin{name: name, timeline: tl}
+}
+
+func (tl *timeline) record(name, value string) error {
+	tl.mux.Lock()
+	defer tl.mux.Unlock()
+	if tl.err != nil {
+		return tl.err
+	}
+	tl.events = append(tl.events, fmt.Sprintf("%s %s %s", tl.clock.Since(), name, value))
+	return nil
+}
+
+type testPin struct {
+	name     string
+	timeline *timeline
+}
+
+func (p *testPin) Out(l gpio.Level) error {
+	value := "low"
+	if l {
+		value = "high"
+	}
+	return p.timeline.record(p.name, value)
+}
+
+func (p *testPin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	if f != physic.KiloHertz {
+		return fmt.Errorf("wrong frequency %s", f)
+	}
+	return p.timeline.record(p.name, duty.String())
+}
@@ -0,0 +1,272 @@
+// Package sensor is a door position sensor, it watches a contact such as a
+// reed switch and notifies admitters when the door opens and closes. It is
+// an Admitter so that it knows when the door was released, any opening
+// without a release while the door is locked is a forced opening.
+package sensor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"periph.io/x/conn/v3/gpio"
+)
+
+const (
+	defaultDebounceMS = 50
+	defaultReleaseS   = 5
+	defaultHeldOpenS  = 30
+	sensorType        = "sensor"
+)
+
+// ErrHalted is returned by Guard if the pin stops reporting edges
+var ErrHalted = errors.New("sensor pin halted")
+
+// Pin is a GPIO input with edge detection attached to the door contact, any
+// gpio.PinIn can be used.
+type Pin interface {
+	In(pull gpio.Pull, edge gpio.Edge) error
+	Read() gpio.Level
+	WaitForEdge(timeout time.Duration) bool
+}
+
+// Sensor is a door position sensor
+type Sensor struct {
+	// Debounce is how long the contact must settle for before a change is
+	// believed, the default is 50 milliseconds.
+	Debounce time.Duration
+	// Unlocked, if set, reports whether the strike is unlocked, eg: held open
+	// or in its scheduled hours. The door may be opened or left open while it
+	// is unlocked.
+	Unlocked func() bool
+
+	settings sync.Mutex
+	// Release is how long the door may be opened for after an Allow, usually
+	// the time the strike is open for. The default is 5 seconds. Use
+	// SetTimes to change it once the Sensor is in use.
+	Release time.Duration
+	// HeldOpen is how long the door may be open for before HeldOpen is
+	// notified. The default is 30 seconds. Use SetTimes to change it once the
+	// Sensor is in use.
+	HeldOpen time.Duration
+
+	door   int32
+	pin    Pin
+	open   gpio.Level
+	events admitter.Admitter
+	clock  clock
+
+	mux sync.Mutex
+	// released is the context of the last Allow, it is nil once the door
+	// has been opened with it
+	released      context.Context
+	releasedUntil time.Time
+	isOpen        bool
+	opened        context.Context
+	openedAt      time.Time
+	heldNotified  bool
+}
+
+// New returns a Sensor for the door contact on pin, events are notified to
+// events. If activeLow is set the pin is low while the door is open. The pin
+// is pulled towards the open level so that a broken wire looks like an open
+// door.
+func New(door int32, pin Pin, activeLow bool, events admitter.Admitter) (*Sensor, error) {
+	pull, open := gpio.PullUp, gpio.High
+	if activeLow {
+		pull, open = gpio.PullDown, gpio.Low
+	}
+	if err := pin.In(pull, gpio.BothEdges); err != nil {
+		return nil, fmt.Errorf("failed to set up sensor pin: %w", err)
+	}
+	return &Sensor{
+		Debounce: defaultDebounceMS * time.Millisecond,
+		Release:  defaultReleaseS * time.Second,
+		HeldOpen: defaultHeldOpenS * time.Second,
+		door:     door,
+		pin:      pin,
+		open:     open,
+		events:   events,
+		clock:    realClock{},
+	}, nil
+}
+
+// SetTimes changes Release and HeldOpen, it is safe to call while the Sensor
+// is in use.
+func (s *Sensor) SetTimes(release, heldOpen time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.Release = release
+	s.HeldOpen = heldOpen
+}
+
+// times returns Release and HeldOpen
+func (s *Sensor) times() (release, heldOpen time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	return s.Release, s.HeldOpen
+}
+
+// Open reports whether the door is open
+func (s *Sensor) Open() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.isOpen
+}
+
+// Interrogating has no effect on a Sensor
+func (s *Sensor) Interrogating(context.Context, string) {}
+
+// Deny has no effect on a Sensor
+func (s *Sensor) Deny(context.Context, string, error) error { return nil }
+
+// Allow lets the door be opened once within Release without it being forced,
+// the opening is notified with ctx.
+func (s *Sensor) Allow(ctx context.Context, msg string) error {
+	release, _ := s.times()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.released = ctx
+	s.releasedUntil = s.clock.Now().Add(release)
+	return nil
+}
+
+// Guard watches the door, it is named so that a Sensor can be used as a
+// guard.Guard. Any error returned is fatal.
+func (s *Sensor) Guard() error {
+	s.start()
+	for {
+		if err := s.watch(); err != nil {
+			return err
+		}
+	}
+}
+
+// start reads the position of the door before it is watched
+func (s *Sensor) start() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// The door may already be open, that is nobody's fault
+	s.isOpen = s.pin.Read() == s.open
+	s.opened = s.context()
+	s.openedAt = s.clock.Now()
+}
+
+// watch is one iteration of the Guard loop, it waits for the door to move or
+// for it to be held open.
+func (s *Sensor) watch() error {
+	timeout := s.heldOpenIn()
+	start := s.clock.Now()
+	if !s.pin.WaitForEdge(timeout) {
+		// A halted pin returns at once
+		if timeout < 0 || s.clock.Now().Sub(start) < timeout {
+			return ErrHalted
+		}
+		return s.checkHeldOpen()
+	}
+	<-s.clock.After(s.Debounce)
+	return s.changed(s.pin.Read() == s.open)
+}
+
+// heldOpenIn returns the time until the door will have been held open, or -1
+// if the door is closed or HeldOpen was already notified.
+func (s *Sensor) heldOpenIn() time.Duration {
+	_, heldOpen := s.times()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.isOpen || s.heldNotified {
+		return -1
+	}
+	if in := heldOpen - s.clock.Now().Sub(s.openedAt); in > 0 {
+		return in
+	}
+	return 0
+}
+
+func (s *Sensor) checkHeldOpen() error {
+	_, heldOpen := s.times()
+	unlocked := s.unlocked()
+	s.mux.Lock()
+	if !s.isOpen || s.heldNotified || s.clock.Now().Sub(s.openedAt) < heldOpen {
+		s.mux.Unlock()
+		return nil
+	}
+	if unlocked {
+		// The door is only held open once the strike locks again
+		s.openedAt = s.clock.Now()
+		s.mux.Unlock()
+		return nil
+	}
+	s.heldNotified = true
+	ctx := s.opened
+	s.mux.Unlock()
+	return s.notify(ctx, admitter.HeldOpen, "Door held open")
+}
+
+// changed notifies the door opening or closing, it does nothing if the door has
+// not moved.
+func (s *Sensor) changed(open bool) error {
+	unlocked := open && s.unlocked()
+	s.mux.Lock()
+	if open == s.isOpen {
+		s.mux.Unlock()
+		return nil
+	}
+	s.isOpen = open
+	if !open {
+		ctx := s.opened
+		s.mux.Unlock()
+		return s.notify(ctx, admitter.Closed, "Door closed")
+	}
+
+	event, msg := admitter.ForcedOpen, "Door forced open"
+	ctx := s.context()
+	switch {
+	case s.released != nil && s.clock.Now().Before(s.releasedUntil):
+		event, msg = admitter.Opened, "Door opened"
+		ctx = s.released
+	case unlocked:
+		event, msg = admitter.Opened, "Door opened"
+	}
+	s.released = nil
+	s.opened = ctx
+	s.openedAt = s.clock.Now()
+	s.heldNotified = false
+	s.mux.Unlock()
+	return s.notify(ctx, event, msg)
+}
+
+// unlocked reports whether the strike is unlocked
+func (s *Sensor) unlocked() bool {
+	return s.Unlocked != nil && s.Unlocked()
+}
+
+// context returns the context for events with no Allow
+func (s *Sensor) context() context.Context {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, admitter.Door, s.door)
+	ctx = context.WithValue(ctx, admitter.Type, sensorType)
+	return ctx
+}
+
+func (s *Sensor) notify(ctx context.Context, event admitter.Event, msg string) error {
+	if err := admitter.Notify(ctx, s.events, event, msg); err != nil {
+		return fmt.Errorf("failed to notify %s: %w", event, err)
+	}
+	return nil
+}
+
+// clock is the time source of a Sensor, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,301 @@
+package sensor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+)
+
+var _ Pin = gpio.PinIn(nil)
+
+type releaseKey struct{}
+
+func TestSensor(t *testing.T) {
+	const (
+		open   = gpio.High
+		closed = gpio.Low
+	)
+	type step struct {
+		level gpio.Level
+		allow bool
+		hold  time.Duration
+	}
+	for name, test := range map[string]struct {
+		steps     []step
+		notifyErr error
+		// unlocked is set if the strike is held open
+		unlocked bool
+
+		wantEvents []admitter.Event
+		// wantReleased is set for each event expected with the context of
+		// Allow
+		wantReleased []bool
+		wantErr      error
+	}{
+		"forced open": {
+			steps: []step{{level: open, hold: 30 * time.Millisecond}, {level: closed, hold: 30 * time.Millisecond}},
+
+			wantEvents: []admitter.Event{admitter.ForcedOpen, admitter.Closed},
+			wantErr:    ErrHalted,
+		},
+		"opened after allow": {
+			steps: []step{
+				{allow: true},
+				{level: open, hold: 30 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantEvents:   []admitter.Event{admitter.Opened, admitter.Closed},
+			wantReleased: []bool{true, true},
+			wantErr:      ErrHalted,
+		},
+		"opened after release ended": {
+			steps: []step{
+				{allow: true, hold: 150 * time.Millisecond},
+				{level: open, hold: 30 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantEvents: []admitter.Event{admitter.ForcedOpen, admitter.Closed},
+			wantErr:    ErrHalted,
+		},
+		"one allow is one opening": {
+			steps: []step{
+				{allow: true},
+				{level: open, hold: 30 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+				{level: open, hold: 30 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantEvents:   []admitter.Event{admitter.Opened, admitter.Closed, admitter.ForcedOpen, admitter.Closed},
+			wantReleased: []bool{true, true, false, false},
+			wantErr:      ErrHalted,
+		},
+		"held open": {
+			steps: []step{
+				{allow: true},
+				{level: open, hold: 250 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantEvents:   []admitter.Event{admitter.Opened, admitter.HeldOpen, admitter.Closed},
+			wantReleased: []bool{true, true, true},
+			wantErr:      ErrHalted,
+		},
+		"opened and held while the strike is held open": {
+			unlocked: true,
+			steps: []step{
+				{level: open, hold: 250 * time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantEvents: []admitter.Event{admitter.Opened, admitter.Closed},
+			wantErr:    ErrHalted,
+		},
+		"bounce ignored": {
+			steps: []step{
+				{level: open, hold: time.Millisecond},
+				{level: closed, hold: 30 * time.Millisecond},
+			},
+
+			wantErr: ErrHalted,
+		},
+		"admitter errors fatal": {
+			steps:     []step{{level: open, hold: 30 * time.Millisecond}},
+			notifyErr: errors.New("siren broken"),
+
+			wantEvents: []admitter.Event{admitter.ForcedOpen},
+			wantErr:    errors.New("failed to notify forced open: siren broken"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := fakeclock.New()
+			pin := newTestPin(clock, closed)
+			events := &testNotifier{}
+			s, err := New(7, pin, false, events)
+			require.NoError(t, err)
+			require.Equal(t, gpio.PullUp, pin.pull)
+			require.Equal(t, gpio.BothEdges, pin.edge)
+			s.clock = clock
+			s.Debounce = 5 * time.Millisecond
+			s.Unlocked = func() bool { return test.unlocked }
+			s.SetTimes(100*time.Millisecond, 200*time.Millisecond)
+			events.err = test.notifyErr
+
+			released := context.WithValue(context.Background(), admitter.Door, int32(7))
+			released = context.WithValue(released, releaseKey{}, true)
+			// The door moves at the times of the steps, after Guard has read
+			// the starting position. The pin halts after the last one.
+			at := 10 * time.Millisecond
+			for _, step := range test.steps {
+				if step.allow {
+					require.Empty(t, pin.changes, "access can only be allowed before the door moves")
+					require.NoError(t, s.Allow(released, "Access granted"))
+				} else {
+					pin.change(at, step.level)
+				}
+				at += step.hold
+			}
+
+			err = s.Guard()
+			require.Equal(t, test.wantErr.Error(), err.Error())
+
+			var (
+				gotEvents   []admitter.Event
+				gotReleased []bool
+			)
+			for _, n := range events.got() {
+				gotEvents = append(gotEvents, n.event)
+				gotReleased = append(gotReleased, n.ctx.Value(releaseKey{}) != nil)
+				assert.Equal(t, int32(7), n.ctx.Value(admitter.Door), n.event)
+			}
+			require.Equal(t, test.wantEvents, gotEvents)
+			if test.wantReleased == nil && len(test.wantEvents) > 0 {
+				test.wantReleased = make([]bool, len(test.wantEvents))
+			}
+			require.Equal(t, test.wantReleased, gotReleased)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	clock := fakeclock.New()
+	pin := newTestPin(clock, gpio.High)
+	s, err := New(7, pin, true, &testNotifier{})
+	require.NoError(t, err)
+	require.Equal(t, gpio.PullDown, pin.pull)
+	s.clock = clock
+	s.Debounce = time.Millisecond
+
+	s.start()
+	require.False(t, s.Open())
+
+	pin.change(10*time.Millisecond, gpio.Low)
+	require.NoError(t, s.watch())
+	require.True(t, s.Open())
+
+	require.Equal(t, ErrHalted, s.watch())
+}
+
+func TestNewPinError(t *testing.T) {
+	pin := newTestPin(fakeclock.New(), gpio.Low)
+	pin.inErr = errors.New("no such pin")
+	_, err := New(7, pin, false, &testNotifier{})
+	require.Error(t, err)
+}
+
+// testPin is a door contact which changes at set times on a fake clock, each
+// change is an edge. It halts once there are no more changes.
+type testPin struct {
+	inErr error
+	pull  gpio.Pull
+	edge  gpio.Edge
+
+	clock   *fakeclock.Clock
+	level   gpio.Level
+	changes []change
+	// edges is the number of changes returned by WaitForEdge
+	edges int
+}
+
+// change is the level of a pin from a time
+type change struct {
+	at    time.Duration
+	level gpio.Level
+}
+
+func newTestPin(clock *fakeclock.Clock, level gpio.Level) *testPin {
+	return &testPin{clock: clock, level: level}
+}
+
+func (p *testPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.pull, p.edge = pull, edge
+	return p.inErr
+}
+
+// Read returns the level after the changes so far, including any that were
+// not waited for
+func (p *testPin) Read() gpio.Level {
+	level := p.level
+	for _, c := range p.changes {
+		if c.at <= p.clock.Since() {
+			level = c.level
+		}
+	}
+	return level
+}
+
+// WaitForEdge moves the clock on to the next change, or by timeout if that is
+// sooner. Like real pins, a change that was not waited for is returned at
+// once.
+func (p *testPin) WaitForEdge(timeout time.Duration) bool {
+	if p.edges == len(p.changes) {
+		// halted
+		return false
+	}
+	wait := p.changes[p.edges].at - p.clock.Since()
+	if timeout >= 0 && wait > timeout {
+		<-p.clock.After(timeout)
+		return false
+	}
+	if wait > 0 {
+		<-p.clock.After(wait)
+	}
+	p.edges++
+	return true
+}
+
+// change sets the level of the pin at a time since the clock started, changes
+// must be in order
+func (p *testPin) change(at time.Duration, level gpio.Level) {
+	p.changes = append(p.changes, change{at: at, level: level})
+}
+
+type notification struct {
+	ctx   context.Context
+	event admitter.Event
+}
+
+// testNotifier records every event, it returns err from Notify
+type testNotifier struct {
+	mock.Mock
+	err error
+
+	mux           sync.Mutex
+	notifications []notification
+}
+
+func (n *testNotifier) Interrogating(ctx context.Context, msg string) {
+	n.Called(ctx, msg)
+}
+
+func (n *testNotifier) Deny(ctx context.Context, msg string, reason error) error {
+	return n.Called(ctx, msg, reason).Error(0)
+}
+
+func (n *testNotifier) Allow(ctx context.Context, msg string) error {
+	return n.Called(ctx, msg).Error(0)
+}
+
+func (n *testNotifier) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.notifications = append(n.notifications, notification{ctx: ctx, event: event})
+	return n.err
+}
+
+func (n *testNotifier) got() []notification {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.notifications
+}
@@ -0,0 +1,70 @@
+package strike
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Policy is the state a Strike is left in when doord stops or fails
+type Policy string
+
+const (
+	// FailSecure leaves the door locked, it is the default
+	FailSecure Policy = "secure"
+	// FailSafe leaves the door unlocked, for doors that must never trap
+	// anyone
+	FailSafe Policy = "safe"
+)
+
+// Fail drives the strike to the state of its Policy and keeps it there,
+// nothing changes the strike afterwards. It is for stopping doord and may be
+// called at any time, including from a Logger.Fatal made by the Strike. It is
+// safe to call more than once, each call drives the pin again.
+func (s *Strike) Fail() error {
+	s.pinMux.Lock()
+	defer s.pinMux.Unlock()
+	s.failed = true
+	if err := s.pin.Out(s.Logic[s.Policy == FailSafe]); err != nil {
+		return fmt.Errorf("failed to leave door fail %s: %w", s.Policy, err)
+	}
+	return nil
+}
+
+// FailOnPanic calls Fail if the calling goroutine panics, the panic carries on
+// afterwards. Defer it at the top of a goroutine.
+func (s *Strike) FailOnPanic() {
+	if r := recover(); r != nil {
+		if err := s.Fail(); err != nil {
+			Logger.Error(context.Background(), err)
+		}
+		panic(r)
+	}
+}
+
+// FailOnSignal waits for a signal on signals then calls Fail, it returns the
+// signal and any error from Fail.
+func (s *Strike) FailOnSignal(signals <-chan os.Signal) (os.Signal, error) {
+	sig := <-signals
+	return sig, s.Fail()
+}
+
+// out drives the pin active or inactive unless the strike has failed, once
+// it has failed the pin is left alone.
+func (s *Strike) out(active bool) error {
+	s.pinMux.Lock()
+	defer s.pinMux.Unlock()
+	if s.failed {
+		return nil
+	}
+	return s.pin.Out(s.Logic[active])
+}
+
+// fatal leaves the door in the state of the Policy then calls Logger.Fatal
+// with args, s.mux must be held.
+func (s *Strike) fatal(args ...interface{}) {
+	if err := s.Fail(); err != nil {
+		Logger.Error(s.ctx, err)
+	}
+	Logger.Fatal(s.ctx, args...)
+}
@@ -0,0 +1,138 @@
+package strike
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+)
+
+func TestFail(t *testing.T) {
+	for name, test := range map[string]struct {
+		policy Policy
+		logic  LogicLevel
+
+		wantLevel gpio.Level
+	}{
+		"secure": {
+			policy:    FailSecure,
+			logic:     ActiveHigh,
+			wantLevel: gpio.Low,
+		},
+		"secure active low": {
+			policy:    FailSecure,
+			logic:     ActiveLow,
+			wantLevel: gpio.High,
+		},
+		"safe": {
+			policy:    FailSafe,
+			logic:     ActiveHigh,
+			wantLevel: gpio.High,
+		},
+		"safe active low": {
+			policy:    FailSafe,
+			logic:     ActiveLow,
+			wantLevel: gpio.Low,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mockStrike := &testPin{}
+			mockStrike.Test(t)
+			defer mockStrike.AssertExpectations(t)
+			mockStrike.On("Out", test.logic[true]).Return(nil).Once()
+			mockStrike.On("Out", test.wantLevel).Return(nil).Once()
+			mockLogger.Test(t)
+			mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+			clock := newTestClock()
+			s := New(mockStrike)
+			s.clock = clock
+			s.Logic = test.logic
+			s.Policy = test.policy
+			require.NoError(t, s.Allow(context.Background(), "Welcome back Bracken"))
+			require.NoError(t, s.Fail())
+
+			// Nothing drives the pin once it has failed
+			clock.advance(time.Minute)
+			require.NoError(t, s.Allow(context.Background(), "Welcome back Bracken"))
+			clock.advance(time.Minute)
+			mockStrike.AssertNumberOfCalls(t, "Out", 2)
+		})
+	}
+}
+
+func TestFailError(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.On("Out", gpio.Low).Return(errors.New("io error"))
+
+	s := New(mockStrike)
+	require.EqualError(t, s.Fail(), "failed to leave door fail secure: io error")
+}
+
+func TestFailFatal(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	defer mockStrike.AssertExpectations(t)
+	mockStrike.On("Out", gpio.High).Return(errors.New("io error")).Once()
+	mockStrike.On("Out", gpio.High).Return(nil).Once()
+	// A Logger of its own as Fatal panics here
+	fatalLogger := &testLogger{}
+	fatalLogger.Test(t)
+	defer fatalLogger.AssertExpectations(t)
+	Logger = fatalLogger
+	defer func() { Logger = mockLogger }()
+	fatalLogger.On("Debug", mock.Anything, mock.Anything).Return()
+	// The default Logger panics on Fatal, the door must be left first
+	fatalLogger.On("Fatal", mock.Anything, mock.Anything).Return().Run(func(mock.Arguments) {
+		mockStrike.AssertNumberOfCalls(t, "Out", 2)
+		panic("fatal")
+	}).Once()
+
+	s := New(mockStrike)
+	s.Policy = FailSafe
+	require.PanicsWithValue(t, "fatal", func() {
+		_ = s.Allow(context.Background(), "Welcome back Bracken")
+	})
+}
+
+func TestFailOnPanic(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	defer mockStrike.AssertExpectations(t)
+	mockStrike.On("Out", gpio.Low).Return(nil).Once()
+
+	s := New(mockStrike)
+	require.PanicsWithValue(t, "oops", func() {
+		defer s.FailOnPanic()
+		panic("oops")
+	})
+
+	// Without a panic nothing happens
+	func() {
+		defer s.FailOnPanic()
+	}()
+}
+
+func TestFailOnSignal(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	defer mockStrike.AssertExpectations(t)
+	mockStrike.On("Out", gpio.Low).Return(nil).Once()
+
+	s := New(mockStrike)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+
+	sig, err := s.FailOnSignal(signals)
+	require.NoError(t, err)
+	require.Equal(t, syscall.SIGUSR1, sig)
+}
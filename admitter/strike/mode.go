@@ -0,0 +1,141 @@
+package strike
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+)
+
+// Mode is how the strike responds to Allow
+type Mode string
+
+const (
+	// Momentary unlocks the strike for OpenFor on each Allow
+	Momentary Mode = "momentary"
+	// Scheduled holds the strike unlocked during its Hours and is Momentary
+	// outside them
+	Scheduled Mode = "scheduled"
+	// HeldOpen holds the strike unlocked until a keyholder toggles it back
+	HeldOpen Mode = "held open"
+)
+
+// Hours reports whether the strike is held unlocked at t in Scheduled mode
+type Hours func(t time.Time) bool
+
+// modeFile is the format of the file the mode is saved in
+type modeFile struct {
+	Mode Mode `json:"mode"`
+}
+
+// SetHours sets the hours the strike is held unlocked for, the mode is
+// Scheduled if hours is not nil and Momentary otherwise. A HeldOpen strike
+// stays held open until it is toggled back. It is safe to call while the
+// Strike is in use.
+func (s *Strike) SetHours(hours Hours) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.hours = hours
+	if s.mode != HeldOpen {
+		s.mode = s.baseMode()
+	}
+	s.update(s.now())
+}
+
+// SetKeyholders sets the members, by HMS member ID, who may toggle HeldOpen.
+// It is safe to call while the Strike is in use.
+func (s *Strike) SetKeyholders(memberIDs []int32) {
+	keyholders := make(map[int32]bool, len(memberIDs))
+	for _, id := range memberIDs {
+		keyholders[id] = true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.keyholders = keyholders
+}
+
+// LoadMode restores HeldOpen if it was saved in the file at path and saves
+// the mode there whenever it is toggled, so that restarting does not change
+// whether the door is held open. A missing file is not an error.
+func (s *Strike) LoadMode(path string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.modeFile = path
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read strike mode: %w", err)
+	}
+	var saved modeFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse strike mode: %w", err)
+	}
+	if saved.Mode == HeldOpen {
+		Logger.Info(s.ctx, "Door held open since before restart")
+		s.mode = HeldOpen
+		s.update(s.now())
+	}
+	return nil
+}
+
+// baseMode is the mode when not HeldOpen, s.mux must be held
+func (s *Strike) baseMode() Mode {
+	if s.hours != nil {
+		return Scheduled
+	}
+	return Momentary
+}
+
+// held reports whether the mode holds the strike unlocked at now, s.mux must
+// be held
+func (s *Strike) held(now time.Time) bool {
+	switch s.mode {
+	case HeldOpen:
+		return true
+	case Scheduled:
+		return s.hours != nil && s.hours(now)
+	}
+	return false
+}
+
+// toggled reports whether an Allow with ctx toggles HeldOpen, which is when
+// the same keyholder is allowed twice within toggleWithin. s.mux must be
+// held.
+func (s *Strike) toggled(ctx context.Context, now time.Time, toggleWithin time.Duration) bool {
+	member := auth.DecisionFrom(ctx).Member.ID
+	if member == 0 || !s.keyholders[member] {
+		s.lastKeyholder = 0
+		return false
+	}
+	if member == s.lastKeyholder && now.Sub(s.lastKeyholderAt) < toggleWithin {
+		s.lastKeyholder = 0
+		return true
+	}
+	s.lastKeyholder, s.lastKeyholderAt = member, now
+	return false
+}
+
+// toggle switches between HeldOpen and the base mode and saves the mode,
+// s.mux must be held
+func (s *Strike) toggle() error {
+	if s.mode == HeldOpen {
+		s.mode = s.baseMode()
+		Logger.Info(s.ctx, "Door no longer held open")
+	} else {
+		s.mode = HeldOpen
+		Logger.Info(s.ctx, "Door held open")
+	}
+	if s.modeFile == "" {
+		return nil
+	}
+	return atomicfile.WriteJSON(s.modeFile, modeFile{Mode: s.mode})
+}
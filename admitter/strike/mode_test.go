@@ -0,0 +1,170 @@
+package strike
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// memberContext returns a context for an Allow of member
+func memberContext(member int32) context.Context {
+	ctx, details := auth.WithDetails(context.Background())
+	details.SetMember(member, "Bracken")
+	return ctx
+}
+
+func TestToggle(t *testing.T) {
+	for name, test := range map[string]struct {
+		member int32
+		gap    time.Duration
+
+		wantMode Mode
+	}{
+		"keyholder twice": {
+			member:   7,
+			gap:      time.Second,
+			wantMode: HeldOpen,
+		},
+		"keyholder too slow": {
+			member:   7,
+			gap:      3 * time.Second,
+			wantMode: Momentary,
+		},
+		"not a keyholder": {
+			member:   8,
+			gap:      time.Second,
+			wantMode: Momentary,
+		},
+		"unknown member": {
+			gap:      time.Second,
+			wantMode: Momentary,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mockStrike := &testPin{}
+			mockStrike.On("Out", mock.Anything).Return(nil)
+			mockLogger.Test(t)
+			mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+			mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+			clock := newTestClock()
+			s := New(mockStrike)
+			s.clock = clock
+			s.SetKeyholders([]int32{7})
+
+			ctx := memberContext(test.member)
+			require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+			clock.advance(test.gap)
+			require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+			require.Equal(t, test.wantMode, s.State().Mode)
+
+			clock.advance(time.Minute)
+			require.Equal(t, test.wantMode == HeldOpen, s.State().Unlocked)
+		})
+	}
+}
+
+func TestHeldOpenSaved(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	mockStrike.On("Out", gpio.High).Return(nil)
+	mockStrike.On("Out", gpio.Low).Return(nil)
+	mockLogger.Test(t)
+	mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	path := filepath.Join(t.TempDir(), "mode.json")
+	clock := newTestClock()
+	s := New(mockStrike)
+	s.clock = clock
+	s.SetKeyholders([]int32{7})
+	require.NoError(t, s.LoadMode(path))
+
+	ctx := memberContext(7)
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, State{Mode: HeldOpen, Unlocked: true}, s.State())
+
+	// Closing the door does not relock it
+	require.NoError(t, s.Notify(ctx, admitter.Opened, ""))
+	require.NoError(t, s.Notify(ctx, admitter.Closed, ""))
+	clock.advance(time.Hour)
+	require.Equal(t, State{Mode: HeldOpen, Unlocked: true}, s.State())
+
+	restarted := New(mockStrike)
+	restarted.clock = clock
+	restarted.SetKeyholders([]int32{7})
+	require.NoError(t, restarted.LoadMode(path))
+	require.Equal(t, State{Mode: HeldOpen, Unlocked: true}, restarted.State())
+
+	clock.advance(time.Second)
+	require.NoError(t, restarted.Allow(ctx, "Welcome back Bracken"))
+	require.NoError(t, restarted.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, Momentary, restarted.State().Mode)
+	require.True(t, restarted.State().Unlocked, "the keyholder still gets through")
+	clock.advance(5 * time.Second)
+	require.Equal(t, State{Mode: Momentary}, restarted.State())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"mode": "momentary"}`, string(data))
+}
+
+func TestLoadMode(t *testing.T) {
+	s := New(&testPin{})
+	require.NoError(t, s.LoadMode(filepath.Join(t.TempDir(), "missing.json")))
+	require.Equal(t, Momentary, s.State().Mode)
+
+	path := filepath.Join(t.TempDir(), "mode.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	require.Error(t, s.LoadMode(path))
+}
+
+func TestScheduled(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	mockStrike.On("Out", gpio.High).Return(nil)
+	mockStrike.On("Out", gpio.Low).Return(nil)
+	mockLogger.Test(t)
+	mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+	clock := newTestClock()
+	clock.advance(17*time.Hour + 59*time.Minute)
+	s := New(mockStrike)
+	s.clock = clock
+	s.SetHours(func(t time.Time) bool { return t.Hour() >= 18 && t.Hour() < 22 })
+	require.Equal(t, State{Mode: Scheduled}, s.State())
+
+	clock.advance(time.Minute)
+	require.Equal(t, State{Mode: Scheduled, Unlocked: true}, s.State())
+
+	// Neither running out nor the door closing locks it during the hours
+	ctx := memberContext(8)
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.NoError(t, s.Notify(ctx, admitter.Opened, ""))
+	require.NoError(t, s.Notify(ctx, admitter.Closed, ""))
+	clock.advance(time.Minute)
+	require.Equal(t, State{Mode: Scheduled, Unlocked: true}, s.State())
+
+	clock.advance(3*time.Hour + 58*time.Minute)
+	require.True(t, s.State().Unlocked)
+	clock.advance(time.Minute)
+	require.Equal(t, State{Mode: Scheduled}, s.State())
+
+	// Outside the hours it is momentary
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, State{Mode: Scheduled, Unlocked: true, Until: clock.Now().Add(5 * time.Second)}, s.State())
+	clock.advance(5 * time.Second)
+	require.False(t, s.State().Unlocked)
+
+	s.SetHours(nil)
+	require.Equal(t, State{Mode: Momentary}, s.State())
+}
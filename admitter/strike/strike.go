@@ -7,11 +7,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/somakeit/door-controller3/admitter"
 	"periph.io/x/conn/v3/gpio"
 )
 
 const (
-	defaultOpenTimeS = 5
+	defaultOpenTimeS     = 5
+	defaultToggleWithinS = 3
 )
 
 // Pin is a GPIO pin attached to the strike
@@ -27,12 +29,16 @@ var Logger ContextLogger = logDiscarder{}
 // context filds.
 type ContextLogger interface {
 	Fatal(ctx context.Context, args ...interface{})
+	Error(ctx context.Context, args ...interface{})
+	Info(ctx context.Context, args ...interface{})
 	Debug(ctx context.Context, args ...interface{})
 }
 
 type logDiscarder struct{}
 
 func (logDiscarder) Fatal(context.Context, ...interface{}) { panic("Fatal error in strike") }
+func (logDiscarder) Error(context.Context, ...interface{}) {}
+func (logDiscarder) Info(context.Context, ...interface{})  {}
 func (logDiscarder) Debug(context.Context, ...interface{}) {}
 
 // LogicLevel is used to indicate the intent of the Pin, true is active
@@ -43,22 +49,80 @@ var (
 	ActiveLow  = LogicLevel{true: gpio.Low, false: gpio.High}
 )
 
+// Strike unlocks the door for OpenFor after each Allow. It is a state machine
+// driven by one timer, an Allow while unlocked extends the time the door is
+// unlocked for rather than locking and unlocking it again. The Mode can hold
+// the strike unlocked, see mode.go.
 type Strike struct {
 	// OpenFor is the duration to unlock the door for, default is 5 seconds.
+	// Use SetOpenFor to change it once the Strike is in use.
 	OpenFor time.Duration
+	// NoEntry, if set, relocks the door early if it was not opened within
+	// NoEntry of being allowed. It needs a door sensor notifying the Strike
+	// of the door opening. Use SetNoEntry to change it once the Strike is in
+	// use.
+	NoEntry time.Duration
+	// ToggleWithin is the time within which a keyholder must be allowed twice
+	// to toggle HeldOpen, the default is 3 seconds.
+	ToggleWithin time.Duration
 	// Logic is either ActiveHigh or ActiveLow, active being unlocked. The
 	// default is ActiveHigh.
 	Logic LogicLevel
+	// Policy is the state the strike is left in by Fail, the default is
+	// FailSecure.
+	Policy Policy
 
-	mux sync.Mutex
-	pin Pin
+	settings sync.Mutex
+	clock    clock
+
+	// pinMux is held while driving the pin, it is separate from mux so that
+	// Fail can be called while mux is held
+	pinMux sync.Mutex
+	pin    Pin
+	failed bool
+
+	mux      sync.Mutex
+	unlocked bool
+	// until is when the last Allow runs out
+	until time.Time
+	// noEntry is when to relock if the door has not been opened, zero if
+	// NoEntry is not set
+	noEntry time.Time
+	// opened is set once a door sensor reports the door opening while
+	// unlocked
+	opened bool
+	// ctx is the context of the last Allow, used for logging
+	ctx   context.Context
+	timer timer
+
+	mode       Mode
+	hours      Hours
+	modeFile   string
+	keyholders map[int32]bool
+	// lastKeyholder is the last keyholder allowed and when, for toggling
+	lastKeyholder   int32
+	lastKeyholderAt time.Time
+}
+
+// State is the observable state of a Strike
+type State struct {
+	Mode     Mode
+	Unlocked bool
+	// Until is when the strike will lock again, it is zero while locked or
+	// while held unlocked by the Mode
+	Until time.Time
 }
 
 func New(strike Pin) *Strike {
 	return &Strike{
-		OpenFor: defaultOpenTimeS * time.Second,
-		pin:     strike,
-		Logic:   ActiveHigh,
+		OpenFor:      defaultOpenTimeS * time.Second,
+		ToggleWithin: defaultToggleWithinS * time.Second,
+		pin:          strike,
+		Logic:        ActiveHigh,
+		Policy:       FailSecure,
+		clock:        realClock{},
+		ctx:          context.Background(),
+		mode:         Momentary,
 	}
 }
 
@@ -68,26 +132,191 @@ func (s *Strike) Interrogating(context.Context, string) {}
 // Deny has no effect on a strike
 func (s *Strike) Deny(context.Context, string, error) error { return nil }
 
-// Allow will open the strike for Strike.OpenTime.
+// SetOpenFor changes OpenFor for future calls to Allow, it is safe to call
+// while the Strike is in use.
+func (s *Strike) SetOpenFor(d time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.OpenFor = d
+}
+
+// SetNoEntry changes NoEntry for future calls to Allow, it is safe to call
+// while the Strike is in use.
+func (s *Strike) SetNoEntry(d time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.NoEntry = d
+}
+
+// SetToggleWithin changes ToggleWithin, it is safe to call while the Strike is
+// in use.
+func (s *Strike) SetToggleWithin(d time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.ToggleWithin = d
+}
+
+// times returns OpenFor, NoEntry and ToggleWithin
+func (s *Strike) times() (openFor, noEntry, toggleWithin time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	return s.OpenFor, s.NoEntry, s.ToggleWithin
+}
+
+// State returns the mode and whether the strike is unlocked and until when
+func (s *Strike) State() State {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	state := State{Mode: s.mode, Unlocked: s.unlocked}
+	if s.unlocked && !s.held(s.now()) {
+		state.Until = s.until
+	}
+	return state
+}
+
+// Allow will open the strike for Strike.OpenFor, or until the door has been
+// opened and closed again if the Strike is notified by a door sensor. If the
+// strike is already unlocked it stays unlocked until OpenFor from now. A
+// keyholder allowed twice within ToggleWithin toggles HeldOpen.
 func (s *Strike) Allow(ctx context.Context, msg string) error {
-	timer := time.After(s.OpenFor)
+	openFor, noEntry, toggleWithin := s.times()
+	s.mux.Lock()
+	defer s.mux.Unlock()
 
-	go func() {
-		s.mux.Lock()
-		defer s.mux.Unlock()
+	now := s.now()
+	s.ctx = ctx
+	if s.toggled(ctx, now, toggleWithin) {
+		if err := s.toggle(); err != nil {
+			Logger.Error(ctx, "Failed to save strike mode: ", err)
+		}
+	}
+	if s.unlocked {
+		Logger.Debug(ctx, "Keeping door open")
+	}
+	if until := now.Add(openFor); until.After(s.until) {
+		s.until = until
+	}
+	s.noEntry = time.Time{}
+	if noEntry > 0 && !s.opened {
+		s.noEntry = now.Add(noEntry)
+	}
+	s.update(now)
+	return nil
+}
 
-		Logger.Debug(ctx, "Opening door")
-		if err := s.pin.Out(s.Logic[true]); err != nil {
-			Logger.Fatal(ctx, "failed to unlock door: %w", err)
+// Notify lets a door sensor relock the strike, once the door has been opened
+// and closed again while unlocked the strike is locked straight away unless
+// the Mode holds it unlocked.
+func (s *Strike) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.unlocked {
+		return nil
+	}
+	switch event {
+	case admitter.Opened, admitter.ForcedOpen:
+		s.opened = true
+		s.noEntry = time.Time{}
+	case admitter.Closed:
+		if s.opened {
+			Logger.Debug(s.ctx, "Door closed after entry")
+			s.opened = false
+			s.until = time.Time{}
+			s.update(s.now())
 		}
+	}
+	return nil
+}
 
-		<-timer
+// update locks or unlocks the strike for the time now and sets the timer for
+// the next change, s.mux must be held.
+func (s *Strike) update(now time.Time) {
+	noEntry := !s.noEntry.IsZero() && !now.Before(s.noEntry)
+	if noEntry && s.unlocked && !s.held(now) {
+		Logger.Debug(s.ctx, "Door not opened")
+	}
+	if s.held(now) || (now.Before(s.until) && !noEntry) {
+		s.unlock()
+	} else {
+		s.until = time.Time{}
+		s.lock()
+	}
 
-		Logger.Debug(ctx, "Closing door")
-		if err := s.pin.Out(s.Logic[false]); err != nil {
-			Logger.Fatal(ctx, "Failed to lock door: ", err)
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	var next time.Time
+	earliest := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
 		}
+	}
+	earliest(s.until)
+	earliest(s.noEntry)
+	if s.mode == Scheduled {
+		// Schedules are to the minute
+		earliest(now.Truncate(time.Minute).Add(time.Minute))
+	}
+	if !next.IsZero() {
+		s.timer = s.clock.AfterFunc(next.Sub(now), s.tick)
+	}
+}
 
-	}()
-	return nil
+// tick updates the strike when the timer fires, timers that were stopped too
+// late find nothing to change.
+func (s *Strike) tick() {
+	defer s.FailOnPanic()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.update(s.now())
 }
+
+// unlock unlocks the strike if it is locked, s.mux must be held
+func (s *Strike) unlock() {
+	if s.unlocked {
+		return
+	}
+	s.unlocked = true
+	s.opened = false
+
+	Logger.Debug(s.ctx, "Opening door")
+	if err := s.out(true); err != nil {
+		s.fatal("Failed to unlock door: ", err)
+	}
+}
+
+// lock locks the strike if it is unlocked, s.mux must be held
+func (s *Strike) lock() {
+	s.noEntry = time.Time{}
+	if !s.unlocked {
+		return
+	}
+	s.unlocked = false
+	s.opened = false
+
+	Logger.Debug(s.ctx, "Closing door")
+	if err := s.out(false); err != nil {
+		s.fatal("Failed to lock door: ", err)
+	}
+}
+
+func (s *Strike) now() time.Time {
+	return s.clock.Now()
+}
+
+// clock is the time source of a Strike, tests replace it
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
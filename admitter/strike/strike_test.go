@@ -47,17 +47,17 @@ func TestStrikeAllow(t *testing.T) {
 			wantCloseCalls: 1,
 		},
 
-		"allowed concurrently": {
+		"allowed again while open": {
 			calls:          2,
-			wantOpenCalls:  2,
-			wantCloseCalls: 2,
+			wantOpenCalls:  1,
+			wantCloseCalls: 1,
 		},
 
 		"calls fatal if door fails to open": {
 			calls:          1,
 			openErr:        errors.New("io error"),
 			wantOpenCalls:  1,
-			wantCloseCalls: 1, // because testLogger does not panic we expect a call to close
+			wantCloseCalls: 1, // Fail locks it before Fatal
 			wantFatal:      true,
 		},
 
@@ -65,7 +65,7 @@ func TestStrikeAllow(t *testing.T) {
 			calls:          1,
 			closeErr:       errors.New("io error"),
 			wantOpenCalls:  1,
-			wantCloseCalls: 1,
+			wantCloseCalls: 2, // the second is Fail trying again
 			wantFatal:      true,
 		},
 	} {
@@ -102,13 +102,11 @@ func TestStrikeAllow(t *testing.T) {
 			mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
 			if test.wantFatal {
 				mockLogger.On("Fatal", mock.Anything, mock.Anything).Return()
+				mockLogger.On("Error", mock.Anything, mock.Anything).Return().Maybe()
 			}
 
-			s := &Strike{
-				OpenFor: 100 * time.Millisecond,
-				pin:     mockStrike,
-				Logic:   ActiveHigh,
-			}
+			s := New(mockStrike)
+			s.OpenFor = 100 * time.Millisecond
 
 			start := time.Now()
 			for i := 0; i < test.calls; i++ {
@@ -130,17 +128,212 @@ func TestStrikeAllow(t *testing.T) {
 				runtime.Gosched()
 			}
 			total := time.Since(start)
-			require.Less(t, total, 150*time.Millisecond, "Unlocks were not handled concurrently, total=%s", total)
+			require.Less(t, total, 150*time.Millisecond, "Unlocks were queued, total=%s", total)
+		})
+	}
+}
+
+func TestSetOpenFor(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	defer mockStrike.AssertExpectations(t)
+	closed := make(chan struct{})
+	mockStrike.On("Out", gpio.High).Return(nil).Once()
+	mockStrike.On("Out", gpio.Low).Return(nil).Run(func(mock.Arguments) { close(closed) }).Once()
+	mockLogger.Test(t)
+	mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+	s := New(mockStrike)
+	s.SetOpenFor(50 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, s.Allow(context.Background(), "Welcome back Bracken"))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("door was not locked")
+	}
+	require.Less(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestStrikeRelock(t *testing.T) {
+	const openFor = 5 * time.Second
+	for name, test := range map[string]struct {
+		noEntry time.Duration
+		events  []admitter.Event
+
+		wantLockedAfter time.Duration
+	}{
+		"open for the full time without a sensor": {
+			wantLockedAfter: openFor,
+		},
+		"relocked when closed after entry": {
+			events:          []admitter.Event{admitter.Opened, admitter.Closed},
+			wantLockedAfter: time.Second,
+		},
+		"forced open counts as entry": {
+			events:          []admitter.Event{admitter.ForcedOpen, admitter.Closed},
+			wantLockedAfter: time.Second,
+		},
+		"closing without entry does not relock": {
+			events:          []admitter.Event{admitter.Closed},
+			wantLockedAfter: openFor,
+		},
+		"relocked early without entry": {
+			noEntry:         2 * time.Second,
+			wantLockedAfter: 2 * time.Second,
+		},
+		"entry keeps it open": {
+			noEntry:         2 * time.Second,
+			events:          []admitter.Event{admitter.Opened},
+			wantLockedAfter: openFor,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mockStrike := &testPin{}
+			mockStrike.Test(t)
+			defer mockStrike.AssertExpectations(t)
+			mockStrike.On("Out", gpio.High).Return(nil).Once()
+			mockStrike.On("Out", gpio.Low).Return(nil).Once()
+			mockLogger.Test(t)
+			mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+			clock := newTestClock()
+			s := New(mockStrike)
+			s.clock = clock
+			s.SetOpenFor(openFor)
+			s.SetNoEntry(test.noEntry)
+			ctx := context.Background()
+			require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+
+			clock.advance(time.Second)
+			for _, event := range test.events {
+				require.NoError(t, s.Notify(ctx, event, ""))
+			}
+			for s.State().Unlocked {
+				require.Less(t, clock.since(), openFor+time.Second, "door was not locked")
+				clock.advance(100 * time.Millisecond)
+			}
+			require.Equal(t, test.wantLockedAfter, clock.since())
+
+			// Events while locked are ignored
+			require.NoError(t, s.Notify(ctx, admitter.Closed, ""))
 		})
 	}
 }
 
+func TestStrikeExtends(t *testing.T) {
+	mockStrike := &testPin{}
+	mockStrike.Test(t)
+	defer mockStrike.AssertExpectations(t)
+	mockStrike.On("Out", gpio.High).Return(nil).Once()
+	mockStrike.On("Out", gpio.Low).Return(nil).Once()
+	mockLogger.Test(t)
+	mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+	clock := newTestClock()
+	start := clock.Now()
+	s := New(mockStrike)
+	s.clock = clock
+	require.Equal(t, State{Mode: Momentary}, s.State())
+
+	ctx := context.Background()
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, State{Mode: Momentary, Unlocked: true, Until: start.Add(5 * time.Second)}, s.State())
+
+	clock.advance(3 * time.Second)
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, State{Mode: Momentary, Unlocked: true, Until: start.Add(8 * time.Second)}, s.State())
+
+	// A shorter OpenFor does not cut the time already given
+	s.SetOpenFor(time.Second)
+	clock.advance(time.Second)
+	require.NoError(t, s.Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, State{Mode: Momentary, Unlocked: true, Until: start.Add(8 * time.Second)}, s.State())
+
+	clock.advance(3999 * time.Millisecond)
+	require.True(t, s.State().Unlocked)
+	clock.advance(time.Millisecond)
+	require.Equal(t, State{Mode: Momentary}, s.State())
+}
+
 func TestLogDiscarder(t *testing.T) {
 	require.Panics(t, func() {
 		logDiscarder{}.Fatal(context.Background())
 	})
 }
 
+// testClock is a clock that only moves when advanced, timers run in advance
+type testClock struct {
+	mux    sync.Mutex
+	start  time.Time
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	clock *testClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+func newTestClock() *testClock {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &testClock{start: start, now: start}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *testClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := &testTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// since returns the time advanced since the clock was made
+func (c *testClock) since() time.Duration {
+	return c.Now().Sub(c.start)
+}
+
+// advance moves the clock on by d and runs any timers that are due
+func (c *testClock) advance(d time.Duration) {
+	c.mux.Lock()
+	c.now = c.now.Add(d)
+	c.mux.Unlock()
+	for {
+		c.mux.Lock()
+		var due *testTimer
+		for _, t := range c.timers {
+			if !t.done && !t.at.After(c.now) {
+				due = t
+				break
+			}
+		}
+		if due != nil {
+			due.done = true
+		}
+		c.mux.Unlock()
+		if due == nil {
+			return
+		}
+		due.f()
+	}
+}
+
+func (t *testTimer) Stop() bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
 type testPin struct {
 	mock.Mock
 }
@@ -157,6 +350,14 @@ func (l *testLogger) Fatal(ctx context.Context, args ...interface{}) {
 	l.Called(ctx, args)
 }
 
+func (l *testLogger) Error(ctx context.Context, args ...interface{}) {
+	l.Called(ctx, args)
+}
+
+func (l *testLogger) Info(ctx context.Context, args ...interface{}) {
+	l.Called(ctx, args)
+}
+
 func (l *testLogger) Debug(ctx context.Context, args ...interface{}) {
 	l.Called(ctx, args)
 }
@@ -1,9 +1,26 @@
 package auth
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrEnrollment is returned by a PINAuthorizer when the PIN is for
+	// enrolling a credential rather than for opening the door. It is not a
+	// failure and access should not be granted.
+	ErrEnrollment = errors.New("enrollment pin")
+)
 
 // Authorizer is an instance of the entity that says whether a given identifier
 // is to be granted access or not. Errors from Allowed are non-fatal.
 type Authorizer interface {
 	Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error)
 }
+
+// PINAuthorizer is the equivalent of Authorizer for PIN codes. Errors from
+// AllowedPIN are non-fatal, ErrEnrollment (or an error wrapping it) may be
+// returned for enrollment PINs.
+type PINAuthorizer interface {
+	AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error)
+}
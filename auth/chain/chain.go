@@ -0,0 +1,231 @@
+// chain combines several Authorizers into one, each type in this package is a
+// different policy for reaching a decision from the answers of its Members.
+// The name of the Member that decided is recorded in the auth.Details on the
+// context, nested chains record a path such as "online/hms".
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+)
+
+var (
+	// ErrNoMembers is returned by a chain with no Members
+	ErrNoMembers = errors.New("no authorizers in chain")
+)
+
+// Member is one Authorizer in a chain
+type Member struct {
+	// Name identifies the Authorizer in logs
+	Name       string
+	Authorizer auth.Authorizer
+	// Timeout limits the time given to the Authorizer, zero is no limit
+	Timeout time.Duration
+}
+
+// First asks all Members concurrently, the first to answer without error
+// decides and the others are cancelled.
+type First []Member
+
+func (f First) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := askAll(ctx, f, door, side, id)
+	var failed []result
+	for range f {
+		r := <-results
+		if r.err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		return r.decide(ctx)
+	}
+	return false, "", failure(f, failed)
+}
+
+// Fallback asks each Member in order, moving on to the next only if a Member
+// returns an error.
+type Fallback []Member
+
+func (f Fallback) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	var failed []result
+	for _, m := range f {
+		r := m.ask(ctx, door, side, id)
+		if r.err == nil {
+			return r.decide(ctx)
+		}
+		failed = append(failed, r)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return false, "", failure(f, failed)
+}
+
+// All asks all Members concurrently and only allows access if every one
+// allows it. A deny from any Member decides immediately, otherwise an error
+// from any Member is returned.
+type All []Member
+
+func (a All) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := collect(askAll(ctx, a, door, side, id), len(a), func(r result) bool {
+		return r.err == nil && !r.allowed
+	})
+	var failed []result
+	for _, r := range results {
+		if r.err == nil && !r.allowed {
+			return r.decide(ctx)
+		}
+		if r.err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > 0 || len(results) == 0 {
+		return false, "", failure(a, results)
+	}
+	return results[0].decide(ctx)
+}
+
+// Any asks all Members concurrently and allows access if any one allows it.
+// An allow from any Member decides immediately, otherwise an error from any
+// Member is returned.
+type Any []Member
+
+func (a Any) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := collect(askAll(ctx, a, door, side, id), len(a), func(r result) bool {
+		return r.err == nil && r.allowed
+	})
+	var failed []result
+	for _, r := range results {
+		if r.err == nil && r.allowed {
+			return r.decide(ctx)
+		}
+		if r.err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > 0 || len(results) == 0 {
+		return false, "", failure(a, results)
+	}
+	return results[0].decide(ctx)
+}
+
+// result is the answer from one Member
+type result struct {
+	index   int
+	member  Member
+	allowed bool
+	message string
+	err     error
+	details *auth.Details
+}
+
+// ask calls the Authorizer with its own Details and timeout
+func (m Member) ask(ctx context.Context, door int32, side, id string) result {
+	ctx, details := auth.NewDetails(ctx)
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+	allowed, message, err := m.Authorizer.Allowed(ctx, door, side, id)
+	return result{
+		member:  m,
+		allowed: allowed,
+		message: message,
+		err:     err,
+		details: details,
+	}
+}
+
+// decide copies the Member's Details to the caller's and returns its answer
+func (r result) decide(ctx context.Context) (bool, string, error) {
+	name := r.member.Name
+	if inner := r.details.Authorizer(); inner != "" {
+		name += "/" + inner
+	}
+	details := auth.DetailsFrom(ctx)
+	details.Merge(r.details)
+	details.SetAuthorizer(name)
+	return r.allowed, r.message, nil
+}
+
+// askAll asks all members concurrently, the channel receives exactly one result
+// per member.
+func askAll(ctx context.Context, members []Member, door int32, side, id string) <-chan result {
+	results := make(chan result, len(members))
+	for i, m := range members {
+		go func(i int, m Member) {
+			r := m.ask(ctx, door, side, id)
+			r.index = i
+			results <- r
+		}(i, m)
+	}
+	return results
+}
+
+// collect reads n results in Member order, stopping early at the first for
+// which decisive returns true.
+func collect(results <-chan result, n int, decisive func(result) bool) []result {
+	ordered := make([]*result, n)
+	for i := 0; i < n; i++ {
+		r := <-results
+		if decisive(r) {
+			return []result{r}
+		}
+		ordered[r.index] = &r
+	}
+	all := make([]result, 0, n)
+	for _, r := range ordered {
+		all = append(all, *r)
+	}
+	return all
+}
+
+// failure summarises the errors from the failed Members in results and the
+// answers of the others in Member order, a single failure is wrapped.
+func failure(members []Member, results []result) error {
+	if len(members) == 0 {
+		return ErrNoMembers
+	}
+	results = append([]result(nil), results...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].index < results[j].index })
+	var (
+		failed  []result
+		msgs    []string
+		answers []string
+	)
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed = append(failed, r)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", r.member.Name, r.err))
+		case r.allowed:
+			answers = append(answers, r.member.Name+" allowed")
+		default:
+			answers = append(answers, r.member.Name+" denied")
+		}
+	}
+	switch {
+	case len(failed) == 1 && len(answers) == 0:
+		return fmt.Errorf("%s: %w", failed[0].member.Name, failed[0].err)
+	case len(failed) == 1:
+		return fmt.Errorf("%s: %w, %s", failed[0].member.Name, failed[0].err, strings.Join(answers, ", "))
+	case len(failed) == len(members):
+		return fmt.Errorf("all authorizers failed: %s", strings.Join(msgs, ", "))
+	}
+	return fmt.Errorf("%d of %d authorizers failed: %s", len(failed), len(members), strings.Join(append(msgs, answers...), ", "))
+}
@@ -0,0 +1,254 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ auth.Authorizer = First{}
+	_ auth.Authorizer = Fallback{}
+	_ auth.Authorizer = All{}
+	_ auth.Authorizer = Any{}
+)
+
+// answer is what a testAuth will return
+type answer struct {
+	allowed bool
+	msg     string
+	err     error
+	delay   time.Duration
+}
+
+var (
+	allow  = answer{allowed: true, msg: "yes"}
+	deny   = answer{msg: "no"}
+	broken = answer{err: errors.New("down")}
+	slow   = answer{allowed: true, msg: "slow yes", delay: time.Second}
+)
+
+func TestChains(t *testing.T) {
+	for name, test := range map[string]struct {
+		chain   func([]Member) auth.Authorizer
+		answers []answer
+
+		want     bool
+		wantMsg  string
+		wantErr  string
+		wantName string
+	}{
+		"first: fastest answer wins": {
+			chain:   func(m []Member) auth.Authorizer { return First(m) },
+			answers: []answer{slow, deny},
+
+			wantMsg:  "no",
+			wantName: "m1",
+		},
+		"first: errors are skipped": {
+			chain:   func(m []Member) auth.Authorizer { return First(m) },
+			answers: []answer{broken, allow},
+
+			want:     true,
+			wantMsg:  "yes",
+			wantName: "m1",
+		},
+		"first: all fail": {
+			chain:   func(m []Member) auth.Authorizer { return First(m) },
+			answers: []answer{broken, broken},
+
+			wantErr: "all authorizers failed: m0: down, m1: down",
+		},
+		"first: empty": {
+			chain: func(m []Member) auth.Authorizer { return First(m) },
+
+			wantErr: "no authorizers in chain",
+		},
+
+		"fallback: first answer used": {
+			chain:   func(m []Member) auth.Authorizer { return Fallback(m) },
+			answers: []answer{deny, allow},
+
+			wantMsg:  "no",
+			wantName: "m0",
+		},
+		"fallback: falls back on error": {
+			chain:   func(m []Member) auth.Authorizer { return Fallback(m) },
+			answers: []answer{broken, broken, allow},
+
+			want:     true,
+			wantMsg:  "yes",
+			wantName: "m2",
+		},
+		"fallback: all fail": {
+			chain:   func(m []Member) auth.Authorizer { return Fallback(m) },
+			answers: []answer{broken, broken},
+
+			wantErr: "all authorizers failed: m0: down, m1: down",
+		},
+
+		"all: all allow": {
+			chain:   func(m []Member) auth.Authorizer { return All(m) },
+			answers: []answer{allow, allow},
+
+			want:     true,
+			wantMsg:  "yes",
+			wantName: "m0",
+		},
+		"all: one denies": {
+			chain:   func(m []Member) auth.Authorizer { return All(m) },
+			answers: []answer{allow, slow, deny},
+
+			wantMsg:  "no",
+			wantName: "m2",
+		},
+		"all: deny beats error": {
+			chain:   func(m []Member) auth.Authorizer { return All(m) },
+			answers: []answer{broken, deny},
+
+			wantMsg:  "no",
+			wantName: "m1",
+		},
+		"all: error without deny": {
+			chain:   func(m []Member) auth.Authorizer { return All(m) },
+			answers: []answer{allow, broken},
+
+			wantErr: "m1: down, m0 allowed",
+		},
+
+		"any: one allows": {
+			chain:   func(m []Member) auth.Authorizer { return Any(m) },
+			answers: []answer{deny, allow},
+
+			want:     true,
+			wantMsg:  "yes",
+			wantName: "m1",
+		},
+		"any: allow beats error": {
+			chain:   func(m []Member) auth.Authorizer { return Any(m) },
+			answers: []answer{broken, allow},
+
+			want:     true,
+			wantMsg:  "yes",
+			wantName: "m1",
+		},
+		"any: all deny": {
+			chain:   func(m []Member) auth.Authorizer { return Any(m) },
+			answers: []answer{deny, deny},
+
+			wantMsg:  "no",
+			wantName: "m0",
+		},
+		"any: error without allow": {
+			chain:   func(m []Member) auth.Authorizer { return Any(m) },
+			answers: []answer{deny, broken},
+
+			wantErr: "m1: down, m0 denied",
+		},
+		"any: some fail": {
+			chain:   func(m []Member) auth.Authorizer { return Any(m) },
+			answers: []answer{broken, deny, broken},
+
+			wantErr: "2 of 3 authorizers failed: m0: down, m2: down, m1 denied",
+		},
+		"all: all fail": {
+			chain:   func(m []Member) auth.Authorizer { return All(m) },
+			answers: []answer{broken, broken},
+
+			wantErr: "all authorizers failed: m0: down, m1: down",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var members []Member
+			for i, a := range test.answers {
+				authDouble := &testAuth{}
+				authDouble.Test(t)
+				call := authDouble.On("Allowed", mock.Anything, int32(1), "A", "1f680").Return(a.allowed, a.msg, a.err).Maybe()
+				if a.delay > 0 {
+					call.WaitUntil(time.After(a.delay))
+				}
+				members = append(members, Member{Name: "m" + string(rune('0'+i)), Authorizer: authDouble})
+			}
+
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := test.chain(members).Allowed(ctx, 1, "A", "1f680")
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.wantErr)
+			}
+			require.Equal(t, test.want, got)
+			require.Equal(t, test.wantMsg, msg)
+			require.Equal(t, test.wantName, details.Authorizer())
+		})
+	}
+}
+
+func TestMemberTimeout(t *testing.T) {
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(false, "", context.DeadlineExceeded)
+	backup := &testAuth{}
+	backup.Test(t)
+	backup.On("Allowed", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(true, "backup", nil)
+
+	start := time.Now()
+	allowed, _, err := Fallback{
+		{Name: "hms", Authorizer: authDouble, Timeout: 50 * time.Millisecond},
+		{Name: "snapshot", Authorizer: backup},
+	}.Allowed(context.Background(), 1, "A", "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestNestedDetails(t *testing.T) {
+	inner := &testAuth{}
+	inner.Test(t)
+	inner.On("Allowed", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		details := auth.DetailsFrom(args.Get(0).(context.Context))
+		details.SetOffline()
+		details.SetMember(7, "Bracken")
+	}).Return(true, "yes", nil)
+	loser := &testAuth{}
+	loser.Test(t)
+	loser.On("Allowed", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		auth.DetailsFrom(args.Get(0).(context.Context)).SetMember(99, "John")
+	}).Return(false, "", errors.New("down"))
+
+	ctx, details := auth.WithDetails(context.Background())
+	allowed, _, err := Fallback{
+		{Name: "outer", Authorizer: Any{{Name: "inner", Authorizer: inner}}},
+	}.Allowed(ctx, 1, "A", "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Equal(t, "outer/inner", details.Authorizer())
+	require.True(t, details.Offline())
+	id, _ := details.Member()
+	require.Equal(t, int32(7), id)
+
+	ctx, details = auth.WithDetails(context.Background())
+	_, _, err = First{
+		{Name: "loser", Authorizer: loser},
+		{Name: "winner", Authorizer: inner},
+	}.Allowed(ctx, 1, "A", "1f680")
+	require.NoError(t, err)
+	id, _ = details.Member()
+	require.Equal(t, int32(7), id, "details from a failed member must not leak")
+}
+
+type testAuth struct {
+	mock.Mock
+}
+
+func (a *testAuth) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	args := a.Called(ctx, door, side, id)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+)
+
+// Reason is a code for why a Decision was made
+type Reason string
+
+const (
+	// Granted is the Reason for any allowed Decision
+	Granted Reason = "granted"
+	// Denied is the Reason for a denial with no more specific Reason
+	Denied Reason = "denied"
+	// UnknownID is the Reason for denying an identifier that belongs to no
+	// one
+	UnknownID Reason = "unknown id"
+	// LockedOut is the Reason for denying an identifier or door side after
+	// too many failed attempts
+	LockedOut Reason = "locked out"
+	// Closed is the Reason for denying access outside of opening hours
+	Closed Reason = "closed"
+	// Enrollment is the Reason for an identifier used to enroll another
+	// credential rather than to open the door
+	Enrollment Reason = "enrollment"
+	// Failed is the Reason when no decision could be made
+	Failed Reason = "error"
+)
+
+// Decision is everything that is known about the result of an authorization
+// attempt
+type Decision struct {
+	Allowed bool
+	Reason  Reason
+	// Message is user presentable
+	Message string
+	// Member owns the identifier, Member.ID is 0 if unknown
+	Member Member
+	// NewZoneID is the zone the member enters by passing through the door, it
+	// is 0 if unknown
+	NewZoneID int32
+	// Source is the name of the Authorizer that made the decision
+	Source string
+	// Offline is true if the decision was made without the authoritative
+	// source, eg: from a local cache
+	Offline bool
+	// Cacheable is true if the decision may be reused for later attempts with
+	// the same identifier
+	Cacheable bool
+}
+
+// Member is the owner of an identifier
+type Member struct {
+	ID   int32
+	Name string
+	// LastSeen is the time since the member last used a door, it is 0 if
+	// unknown
+	LastSeen time.Duration
+}
+
+// Decider is the richer equivalent of Authorizer. Errors from Decide are
+// non-fatal, the Decision is still filled in as far as possible.
+type Decider interface {
+	Decide(ctx context.Context, door int32, side, id string) (Decision, error)
+}
+
+// Decide returns a Decider for a, if a is not already a Decider then the
+// Decision is built from the return values of Allowed and anything recorded
+// in the Details on the context.
+func Decide(a Authorizer) Decider {
+	if d, ok := a.(Decider); ok {
+		return d
+	}
+	return authorizerDecider{a}
+}
+
+type authorizerDecider struct {
+	auth Authorizer
+}
+
+func (a authorizerDecider) Decide(ctx context.Context, door int32, side, id string) (Decision, error) {
+	ctx, details := WithDetails(ctx)
+	allowed, message, err := a.auth.Allowed(ctx, door, side, id)
+
+	d := details.Decision()
+	d.Allowed = allowed && err == nil
+	d.Message = message
+	d.Cacheable = d.Cacheable && err == nil
+	if d.Reason == "" || d.Allowed {
+		d.Reason = reason(d.Allowed, err)
+	}
+	return d, err
+}
+
+// reason returns the Reason for a result with nothing more specific recorded
+func reason(allowed bool, err error) Reason {
+	switch {
+	case errors.Is(err, ErrEnrollment):
+		return Enrollment
+	case err != nil:
+		return Failed
+	case allowed:
+		return Granted
+	default:
+		return Denied
+	}
+}
+
+// DenyReason returns the Reason for a denial passed to an Admitter's Deny, a
+// Reason recorded on ctx is preferred to one from the reason error.
+func DenyReason(ctx context.Context, reason error) Reason {
+	if r := DecisionFrom(ctx).Reason; r != "" && r != Granted {
+		return r
+	}
+	switch {
+	case errors.Is(reason, ErrEnrollment):
+		return Enrollment
+	case errors.Is(reason, admitter.AccessDenied):
+		return Denied
+	}
+	return Failed
+}
+
+// DecisionFrom returns the Decision recorded in the Details carried by ctx, it
+// is incomplete until the guard has recorded the final Decision.
+func DecisionFrom(ctx context.Context) Decision {
+	return DetailsFrom(ctx).Decision()
+}
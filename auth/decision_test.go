@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDenyReason(t *testing.T) {
+	for name, test := range map[string]struct {
+		recorded Reason
+		reason   error
+
+		want Reason
+	}{
+		"denied": {
+			reason: admitter.AccessDenied,
+			want:   Denied,
+		},
+
+		"enrollment": {
+			reason: fmt.Errorf("%w: enrolled", ErrEnrollment),
+			want:   Enrollment,
+		},
+
+		"error": {
+			reason: errors.New("dial tcp: i/o timeout"),
+			want:   Failed,
+		},
+
+		"recorded reason is preferred": {
+			recorded: LockedOut,
+			reason:   errors.New("locked out, try again in 5 s"),
+			want:     LockedOut,
+		},
+
+		"granted is not a reason to deny": {
+			recorded: Granted,
+			reason:   admitter.AccessDenied,
+			want:     Denied,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, details := WithDetails(context.Background())
+			details.SetReason(test.recorded)
+			require.Equal(t, test.want, DenyReason(ctx, test.reason))
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+const detailsKey contextKey = "details"
+
+// Details are facts about an authorization attempt that do not fit in the
+// return values of Allowed. A guard attaches Details to the context before
+// calling an Authorizer, Authorizers record what they know in it and
+// Admitters may read it back from the same context as a Decision. All methods
+// are safe to call on a nil *Details.
+type Details struct {
+	mux         sync.Mutex
+	decision    Decision
+	uncacheable bool
+}
+
+// WithDetails returns a context carrying Details, if ctx already carries
+// Details then ctx and those Details are returned.
+func WithDetails(ctx context.Context) (context.Context, *Details) {
+	if d := DetailsFrom(ctx); d != nil {
+		return ctx, d
+	}
+	d := &Details{}
+	return context.WithValue(ctx, detailsKey, d), d
+}
+
+// NewDetails returns a context carrying new empty Details, replacing any
+// carried by ctx. It is used to keep Authorizers that run concurrently from
+// writing over each other, the winner can then be merged back with Merge.
+func NewDetails(ctx context.Context) (context.Context, *Details) {
+	d := &Details{}
+	return context.WithValue(ctx, detailsKey, d), d
+}
+
+// DetailsFrom returns the Details carried by ctx or nil.
+func DetailsFrom(ctx context.Context) *Details {
+	d, _ := ctx.Value(detailsKey).(*Details)
+	return d
+}
+
+// SetOffline marks the decision as having been made without the
+// authoritative source, eg: from a local cache.
+func (d *Details) SetOffline() {
+	d.update(func(dec *Decision) { dec.Offline = true })
+}
+
+// Offline reports whether the decision was made offline.
+func (d *Details) Offline() bool {
+	return d.Decision().Offline
+}
+
+// SetMember records the member that owns the identifier.
+func (d *Details) SetMember(id int32, name string) {
+	d.update(func(dec *Decision) {
+		dec.Member.ID = id
+		dec.Member.Name = name
+	})
+}
+
+// Member returns the member that owns the identifier, id is 0 if unknown.
+func (d *Details) Member() (id int32, name string) {
+	member := d.Decision().Member
+	return member.ID, member.Name
+}
+
+// SetLastSeen records the time since the member last used a door.
+func (d *Details) SetLastSeen(lastSeen time.Duration) {
+	d.update(func(dec *Decision) { dec.Member.LastSeen = lastSeen })
+}
+
+// SetNewZone records the zone the member enters by passing through the door.
+func (d *Details) SetNewZone(zoneID int32) {
+	d.update(func(dec *Decision) { dec.NewZoneID = zoneID })
+}
+
+// SetReason records a more specific Reason for a denial.
+func (d *Details) SetReason(reason Reason) {
+	d.update(func(dec *Decision) { dec.Reason = reason })
+}
+
+// SetUncacheable marks the decision as only valid for this attempt, eg:
+// because it depends on the time.
+func (d *Details) SetUncacheable() {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.uncacheable = true
+}
+
+// SetAuthorizer records the name of the Authorizer that made the decision.
+func (d *Details) SetAuthorizer(name string) {
+	d.update(func(dec *Decision) { dec.Source = name })
+}
+
+// Authorizer returns the name of the Authorizer that made the decision, it is
+// empty if no Authorizer recorded its name.
+func (d *Details) Authorizer() string {
+	return d.Decision().Source
+}
+
+// SetDecision replaces everything recorded with the final Decision.
+func (d *Details) SetDecision(dec Decision) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.decision = dec
+	d.uncacheable = !dec.Cacheable
+}
+
+// Decision returns everything recorded so far. Cacheable is true unless the
+// decision was made offline or marked uncacheable.
+func (d *Details) Decision() Decision {
+	if d == nil {
+		return Decision{}
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	dec := d.decision
+	dec.Cacheable = !dec.Offline && !d.uncacheable
+	return dec
+}
+
+// Merge copies everything recorded in other into d.
+func (d *Details) Merge(other *Details) {
+	if d == nil || other == nil || d == other {
+		return
+	}
+	other.mux.Lock()
+	o := other.decision
+	uncacheable := other.uncacheable
+	other.mux.Unlock()
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.decision.Offline = d.decision.Offline || o.Offline
+	d.uncacheable = d.uncacheable || uncacheable
+	if o.Member != (Member{}) {
+		d.decision.Member = o.Member
+	}
+	if o.NewZoneID != 0 {
+		d.decision.NewZoneID = o.NewZoneID
+	}
+	if o.Reason != "" {
+		d.decision.Reason = o.Reason
+	}
+	if o.Source != "" {
+		d.decision.Source = o.Source
+	}
+}
+
+// update calls fn with the Decision recorded so far while holding the lock
+func (d *Details) update(fn func(*Decision)) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	fn(&d.decision)
+}
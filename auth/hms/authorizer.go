@@ -3,28 +3,139 @@ package hms
 import (
 	"context"
 	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
 )
 
 const (
 	setZoneTimeoutS = 30
+	sourceName      = "hms"
 )
 
 // Allowed makes hms into an nfc.Authorizer
 func (c *Client) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
-	res, err := c.GatekeeperCheckRFID(ctx, door, side, id)
+	decision, err := c.Decide(ctx, door, side, id)
 	if err != nil {
 		return false, "", err
 	}
+	record(ctx, decision)
+	return decision.Allowed, decision.Message, nil
+}
+
+// Decide makes hms into an auth.Decider, unlike Allowed the Decision includes
+// everything HMS knows about the member.
+func (c *Client) Decide(ctx context.Context, door int32, side, id string) (auth.Decision, error) {
+	res, err := c.GatekeeperCheckRFID(ctx, door, side, id)
+	if err != nil {
+		return auth.Decision{Reason: auth.Failed, Source: sourceName}, err
+	}
+	// The member is moved to NewZoneID by Zones, once access is allowed
+	return decision(res), nil
+}
+
+// decision converts a check result to a Decision
+func decision(res GatekeeperCheckResult) auth.Decision {
+	d := auth.Decision{
+		Allowed: res.AccessGranted,
+		Reason:  auth.Denied,
+		Message: res.Message,
+		Member: auth.Member{
+			ID:       res.MemberID,
+			Name:     res.MemberName,
+			LastSeen: res.LastSeen,
+		},
+		NewZoneID: res.NewZoneID,
+		Source:    sourceName,
+		Cacheable: true,
+	}
+	switch {
+	case res.Enrollment != NotEnrollment:
+		d.Reason = auth.Enrollment
+		d.Cacheable = false
+	case res.AccessGranted:
+		d.Reason = auth.Granted
+	case res.MemberID == 0:
+		d.Reason = auth.UnknownID
+	}
+	return d
+}
+
+// record copies what HMS knows about the member to the Details on ctx, the
+// source is left to whatever wraps the Client.
+func record(ctx context.Context, decision auth.Decision) {
+	details := auth.DetailsFrom(ctx)
+	details.SetMember(decision.Member.ID, decision.Member.Name)
+	details.SetLastSeen(decision.Member.LastSeen)
+	details.SetNewZone(decision.NewZoneID)
+	if !decision.Allowed {
+		details.SetReason(decision.Reason)
+	}
+}
+
+// updateZone updates the member's zone in the background, through the Outbox
+// if there is one. ctx is only used for logging.
+func (c *Client) updateZone(ctx context.Context, memberID, newZoneID int32) {
+	if c.Outbox != nil {
+		if err := c.Outbox.Enqueue(memberID, newZoneID); err != nil {
+			Logger.Warn(ctx, "Failed to queue zone update: ", err)
+		}
+		return
+	}
+
+	go func() {
+		setCtx, cancel := context.WithTimeout(context.Background(), setZoneTimeoutS*time.Second)
+		defer cancel()
+		if err := c.GatekeeperSetZone(setCtx, memberID, newZoneID); err != nil {
+			Logger.Warn(ctx, err)
+		}
+	}()
+}
+
+// Zones returns an admitter.Notifier which moves the member to their new zone
+// once access is allowed, or when the door is opened if DeferZones is set.
+// Without it members are never moved.
+func (c *Client) Zones() *Zones {
+	return &Zones{client: c}
+}
+
+// Zones moves members to the zone recorded in the Decision on the context of
+// Allow, or of an admitter.Opened event if DeferZones is set. Nothing is moved
+// until the final decision so that a later Authorizer, such as a schedule, can
+// still deny. Offline decisions are ignored as HMS did not make them.
+type Zones struct {
+	client *Client
+}
 
-	// As there is currently no door sensor, update the member location
-	// directly after auth
-	if res.AccessGranted {
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), setZoneTimeoutS*time.Second)
-			defer cancel()
-			c.GatekeeperSetZone(ctx, res.MemberID, res.NewZoneID)
-		}()
+// Interrogating has no effect on Zones
+func (z *Zones) Interrogating(context.Context, string) {}
+
+// Deny has no effect on Zones
+func (z *Zones) Deny(context.Context, string, error) error { return nil }
+
+// Allow updates the member's zone, unless DeferZones is set as the member may
+// not go through the door
+func (z *Zones) Allow(ctx context.Context, message string) error {
+	if !z.client.DeferZones {
+		z.update(ctx)
 	}
+	return nil
+}
 
-	return res.AccessGranted, res.Message, nil
+// Notify updates the member's zone when the door was opened if DeferZones is
+// set
+func (z *Zones) Notify(ctx context.Context, event admitter.Event, message string) error {
+	if event == admitter.Opened && z.client.DeferZones {
+		z.update(ctx)
+	}
+	return nil
+}
+
+// update moves the member of the Decision on ctx to its new zone
+func (z *Zones) update(ctx context.Context) {
+	decision := auth.DecisionFrom(ctx)
+	if decision.Member.ID == 0 || decision.Offline {
+		return
+	}
+	z.client.updateZone(ctx, decision.Member.ID, decision.NewZoneID)
 }
@@ -3,15 +3,22 @@ package hms
 import (
 	"context"
 	"errors"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/somakeit/door-controller3/admitter"
 	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/guard/pin"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
-var _ auth.Authorizer = &Client{}
+var (
+	_ auth.Authorizer    = &Client{}
+	_ auth.PINAuthorizer = &Client{}
+	_ auth.Decider       = &Client{}
+)
 
 func TestAuthorized(t *testing.T) {
 	for name, test := range map[string]struct {
@@ -23,10 +30,10 @@ func TestAuthorized(t *testing.T) {
 		rows     []*sqlmock.Rows
 		queryErr error
 
-		want          bool
-		wantMsg       string
-		wantErr       bool
-		wantLocUpdate bool
+		want     bool
+		wantMsg  string
+		wantErr  bool
+		wantZone bool
 	}{
 		"allowed": {
 			door: 1,
@@ -53,9 +60,9 @@ func TestAuthorized(t *testing.T) {
 						""),
 			},
 
-			want:          true,
-			wantMsg:       "Welcome back Bracken",
-			wantLocUpdate: true,
+			want:     true,
+			wantMsg:  "Welcome back Bracken",
+			wantZone: true,
 		},
 
 		"notAllowed": {
@@ -83,8 +90,8 @@ func TestAuthorized(t *testing.T) {
 						""),
 			},
 
-			want:          false,
-			wantLocUpdate: false,
+			want:     false,
+			wantZone: false,
 		},
 
 		"failedQuery": {
@@ -94,9 +101,9 @@ func TestAuthorized(t *testing.T) {
 
 			queryErr: errors.New("var not in scope"),
 
-			want:          false,
-			wantErr:       true,
-			wantLocUpdate: false,
+			want:     false,
+			wantErr:  true,
+			wantZone: false,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -115,19 +122,161 @@ func TestAuthorized(t *testing.T) {
 				@newZoneID, @memberID, @spErr`).
 				WillReturnRows(test.rows...).
 				WillReturnError(test.queryErr)
-			if test.wantLocUpdate {
-				mock.ExpectExec("CALL sp_gatekeeper_set_zone").
-					WithArgs(test.member, 5).
-					WillReturnResult(sqlmock.NewResult(0, 0)).
-					WillReturnError(nil)
-			}
 
+			// The zone is not set until Zones is told access was allowed
 			c := &Client{db: db}
-			got, msg, err := c.Allowed(context.Background(), test.door, test.side, test.tag)
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := c.Allowed(ctx, test.door, test.side, test.tag)
 			require.Equal(t, test.wantErr, err != nil, "wantErr=%t, err=%v", test.wantErr, err)
 			require.Equal(t, test.want, got)
 			require.Equal(t, test.wantMsg, msg)
-			time.Sleep(50 * time.Millisecond)
+			if test.wantZone {
+				require.Equal(t, int32(test.member), details.Decision().Member.ID)
+				require.Equal(t, int32(5), details.Decision().NewZoneID)
+			}
 		})
 	}
 }
+
+func TestDecide(t *testing.T) {
+	columns := []string{
+		"@message",
+		"@memberName",
+		"@lastSeen",
+		"@accessGranted",
+		"@newZoneID",
+		"@memberID",
+		"@spErr"}
+	for name, test := range map[string]struct {
+		rows     *sqlmock.Rows
+		queryErr error
+
+		want    auth.Decision
+		wantErr bool
+	}{
+		"allowed": {
+			rows: sqlmock.NewRows(columns).
+				AddRow("Welcome back Bracken", "Bracken", "3h", int32(1), int32(5), int32(7), ""),
+
+			want: auth.Decision{
+				Allowed:   true,
+				Reason:    auth.Granted,
+				Message:   "Welcome back Bracken",
+				Member:    auth.Member{ID: 7, Name: "Bracken", LastSeen: 3 * time.Hour},
+				NewZoneID: 5,
+				Source:    "hms",
+				Cacheable: true,
+			},
+		},
+
+		"denied": {
+			rows: sqlmock.NewRows(columns).
+				AddRow("", "John", "3s", int32(0), int32(5), int32(99), ""),
+
+			want: auth.Decision{
+				Reason:    auth.Denied,
+				Member:    auth.Member{ID: 99, Name: "John", LastSeen: 3 * time.Second},
+				NewZoneID: 5,
+				Source:    "hms",
+				Cacheable: true,
+			},
+		},
+
+		"unknown": {
+			rows: sqlmock.NewRows(columns).
+				AddRow("", nil, nil, int32(0), nil, nil, ""),
+
+			want: auth.Decision{
+				Reason:    auth.UnknownID,
+				Source:    "hms",
+				Cacheable: true,
+			},
+		},
+
+		"failedQuery": {
+			rows:     sqlmock.NewRows(columns),
+			queryErr: errors.New("var not in scope"),
+
+			want:    auth.Decision{Reason: auth.Failed, Source: "hms"},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectExec(`CALL sp_gatekeeper_check_rfid`).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT @message`).
+				WillReturnRows(test.rows).
+				WillReturnError(test.queryErr)
+
+			c := &Client{db: db}
+			got, err := auth.Decide(c).Decide(context.Background(), 1, DoorSideA, "1f680")
+			require.Equal(t, test.wantErr, err != nil, "wantErr=%t, err=%v", test.wantErr, err)
+			require.Equal(t, test.want, got)
+			require.NoError(t, mock.ExpectationsWereMet(), "the zone is not set by Decide")
+		})
+	}
+}
+
+func TestZones(t *testing.T) {
+	allowed := auth.Decision{Allowed: true, Member: auth.Member{ID: 7}, NewZoneID: 5}
+	for name, test := range map[string]struct {
+		deferZones bool
+		decision   auth.Decision
+		do         func(ctx context.Context, z *Zones) error
+
+		wantZone bool
+	}{
+		"allowed": {
+			decision: allowed,
+			do:       func(ctx context.Context, z *Zones) error { return z.Allow(ctx, "Welcome back Bracken") },
+			wantZone: true,
+		},
+
+		"denied after hms allowed": {
+			decision: allowed,
+			do: func(ctx context.Context, z *Zones) error {
+				return z.Deny(ctx, "Door closed at this time", admitter.AccessDenied)
+			},
+		},
+
+		"offline": {
+			decision: auth.Decision{Allowed: true, Member: auth.Member{ID: 7}, NewZoneID: 5, Offline: true},
+			do:       func(ctx context.Context, z *Zones) error { return z.Allow(ctx, "Welcome back") },
+		},
+
+		"deferred until opened": {
+			deferZones: true,
+			decision:   allowed,
+			do:         func(ctx context.Context, z *Zones) error { return z.Allow(ctx, "Welcome back Bracken") },
+		},
+
+		"opened without deferring": {
+			decision: allowed,
+			do:       func(ctx context.Context, z *Zones) error { return z.Notify(ctx, admitter.Opened, "Door opened") },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := &Client{DeferZones: test.deferZones}
+			var err error
+			c.Outbox, err = NewOutbox(c, filepath.Join(t.TempDir(), "outbox.json"))
+			require.NoError(t, err)
+
+			ctx, details := auth.WithDetails(context.Background())
+			details.SetDecision(test.decision)
+			require.NoError(t, test.do(ctx, c.Zones()))
+			if !test.wantZone {
+				require.Equal(t, 0, c.Outbox.Len())
+				return
+			}
+			require.Equal(t, 1, c.Outbox.Len())
+			require.Equal(t, int32(7), c.Outbox.queue[0].MemberID)
+			require.Equal(t, int32(5), c.Outbox.queue[0].NewZoneID)
+		})
+	}
+}
+
+var _ pin.Enrollment = &EnrollmentError{}
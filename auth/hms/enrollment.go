@@ -0,0 +1,96 @@
+package hms
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/somakeit/door-controller3/auth"
+)
+
+// Enrollment is the result of using an enrollment PIN, which registers the
+// last unknown card read to the PIN's member.
+type Enrollment int
+
+const (
+	// NotEnrollment means the PIN was not an enrollment PIN
+	NotEnrollment Enrollment = iota
+	// Enrolled means the last card read was registered to the member
+	Enrolled
+	// NotEnrolled means the PIN was an enrollment PIN but the card was not
+	// registered for a reason HMS did not explain
+	NotEnrolled
+	// NoRecentCard means no unknown card had been read recently enough
+	NoRecentCard
+	// CardAlreadyRegistered means the last card read already has an owner
+	CardAlreadyRegistered
+)
+
+// enrollmentTexts maps the texts the HMS2 procedure sp_gatekeeper_check_pin
+// reports enrollment outcomes with, in either its message or its error, to the
+// outcome. Only these exact texts are matched, a PIN that finds a member
+// without unlock text is taken as Enrolled whatever the text, see
+// GatekeeperCheckPIN.
+var enrollmentTexts = map[string]Enrollment{
+	"Card registered":             Enrolled,
+	"Card not registered":         NotEnrolled,
+	"No recent unknown card read": NoRecentCard,
+	"Card already registered":     CardAlreadyRegistered,
+}
+
+func (e Enrollment) String() string {
+	switch e {
+	case NotEnrollment:
+		return "not enrollment"
+	case Enrolled:
+		return "enrolled"
+	case NotEnrolled:
+		return "not enrolled"
+	case NoRecentCard:
+		return "no recent card"
+	case CardAlreadyRegistered:
+		return "card already registered"
+	}
+	return fmt.Sprintf("Enrollment(%d)", int(e))
+}
+
+// Message returns a user presentable description of the enrollment
+func (e Enrollment) Message(memberName string) string {
+	switch e {
+	case Enrolled:
+		return fmt.Sprintf("Card registered to %s", memberName)
+	case NoRecentCard:
+		return "No card to register, read your new card then enter the PIN"
+	case CardAlreadyRegistered:
+		return "Card is already registered"
+	}
+	return "Card was not registered"
+}
+
+// enrollmentFrom classifies the texts returned by the HMS2 procedure
+func enrollmentFrom(texts ...string) Enrollment {
+	for _, t := range texts {
+		if e, ok := enrollmentTexts[strings.TrimSpace(t)]; ok {
+			return e
+		}
+	}
+	return NotEnrollment
+}
+
+// EnrollmentError is returned by AllowedPIN for enrollment PINs, it wraps
+// auth.ErrEnrollment.
+type EnrollmentError struct {
+	Result Enrollment
+}
+
+func (e *EnrollmentError) Error() string {
+	return fmt.Sprintf("%s: %s", auth.ErrEnrollment, e.Result)
+}
+
+func (e *EnrollmentError) Unwrap() error {
+	return auth.ErrEnrollment
+}
+
+// Enrolled reports whether a card was registered
+func (e *EnrollmentError) Enrolled() bool {
+	return e.Result == Enrolled
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -19,21 +18,28 @@ var Logger ContextLogger = logDiscarder{}
 // context fields.
 type ContextLogger interface {
 	Warn(ctx context.Context, args ...interface{})
-	Warnf(ctx context.Context, args ...interface{})
+	Warnf(ctx context.Context, format string, args ...interface{})
+	Infof(ctx context.Context, format string, args ...interface{})
 }
 
 type logDiscarder struct{}
 
-func (logDiscarder) Warn(context.Context, ...interface{})  {}
-func (logDiscarder) Warnf(context.Context, ...interface{}) {}
+func (logDiscarder) Warn(context.Context, ...interface{})          {}
+func (logDiscarder) Warnf(context.Context, string, ...interface{}) {}
+func (logDiscarder) Infof(context.Context, string, ...interface{}) {}
 
-// Client provides methods for interfacing with the HMS2 databse
+// Client provides methods for interfacing with the HMS2 databse, it is safe
+// for concurrent use.
 type Client struct {
+	// Outbox, if set, queues zone updates so that they are not lost when HMS
+	// is unreachable, otherwise they are sent once in the background.
+	Outbox *Outbox
+	// DeferZones stops Zones moving members to a new zone as soon as they
+	// are allowed, they are moved when the door is opened instead. Set it when
+	// there is a door sensor.
+	DeferZones bool
+
 	db *sql.DB
-	// because stored procedures are executed before their results are selected
-	// we must make sure no other procedures are called before those results
-	// are selected.
-	scope sync.Mutex
 }
 
 // NewClient returns a new HMS2 database Client, db must be an opened hms2 sql
@@ -49,37 +55,6 @@ func NewClient(db *sql.DB) (*Client, error) {
 // returns whether access was granted and an approprite unlock text in
 // GatekeeperCheckResult if it is.
 func (c *Client) GatekeeperCheckRFID(ctx context.Context, door int32, side, tag string) (GatekeeperCheckResult, error) {
-	var result *sql.Rows
-	if err := func() error {
-		c.scope.Lock()
-		defer c.scope.Unlock()
-
-		_, err := c.db.ExecContext(
-			ctx,
-			`CALL sp_gatekeeper_check_rfid(?, ?, ?, @message, @memberName, @lastSeen,
-				@accessGranted, @newZoneID, @memberID, @spErr)`,
-			tag,
-			door,
-			side,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to execute sp: %w", err)
-		}
-		result, err = c.db.QueryContext(ctx, `SELECT @message, @memberName, @lastSeen,
-			@accessGranted, @newZoneID, @memberID, @spErr`)
-		if err != nil {
-			return fmt.Errorf("failed to select sp result: %w", err)
-		}
-
-		return nil
-	}(); err != nil {
-		return GatekeeperCheckResult{}, err
-	}
-
-	if !result.Next() {
-		return GatekeeperCheckResult{}, errors.New("no sp result")
-	}
-
 	var (
 		message       sql.NullString
 		memberName    sql.NullString
@@ -89,9 +64,16 @@ func (c *Client) GatekeeperCheckRFID(ctx context.Context, door int32, side, tag
 		memberID      sql.NullInt32
 		spErr         sql.NullString
 	)
-	err := result.Scan(&message, &memberName, &lastSeen, &accessGranted, &newZoneID, &memberID, &spErr)
-	if err != nil {
-		return GatekeeperCheckResult{}, fmt.Errorf("error scanning sp result: %w", err)
+	if err := c.call(
+		ctx,
+		`CALL sp_gatekeeper_check_rfid(?, ?, ?, @message, @memberName, @lastSeen,
+			@accessGranted, @newZoneID, @memberID, @spErr)`,
+		[]interface{}{tag, door, side},
+		`SELECT @message, @memberName, @lastSeen, @accessGranted, @newZoneID,
+			@memberID, @spErr`,
+		&message, &memberName, &lastSeen, &accessGranted, &newZoneID, &memberID, &spErr,
+	); err != nil {
+		return GatekeeperCheckResult{}, err
 	}
 
 	if spErr.String != "" {
@@ -112,50 +94,19 @@ func (c *Client) GatekeeperCheckRFID(ctx context.Context, door int32, side, tag
 // GatekeeperSetZone updates the zone_occupancy table with the new zone the of
 // member, and log an entry to zone_occupancy_log to record what time the
 // previous zone was entered/left
-func (c *Client) GatekeeperSetZone(ctx context.Context, memberID, newZoneID int32) {
-	if _, err := c.db.Exec("CALL sp_gatekeeper_set_zone(?, ?)", memberID, newZoneID); err != nil {
-		Logger.Warnf(ctx, "Failed to set mebmer %d to zone %d: %s", memberID, newZoneID, err)
+func (c *Client) GatekeeperSetZone(ctx context.Context, memberID, newZoneID int32) error {
+	if _, err := c.db.ExecContext(ctx, "CALL sp_gatekeeper_set_zone(?, ?)", memberID, newZoneID); err != nil {
+		return fmt.Errorf("failed to set member %d to zone %d: %w", memberID, newZoneID, err)
 	}
+	return nil
 }
 
 // GatekeeperCheckPIN checks a pin is valid and returns an approprite unlock
 // text if it is. If the PIN is found and is set to enroll then the last card
-// read will be registered (if within timeout). If registation is successfull,
-// the pin is considered invalid. In all cases an entry is made in the access
-// log.
+// read will be registered (if within timeout) and the outcome is returned in
+// Enrollment. If registation is successfull, the pin is considered invalid. In
+// all cases an entry is made in the access log.
 func (c *Client) GatekeeperCheckPIN(ctx context.Context, door int32, side, pin string) (GatekeeperCheckResult, error) {
-	var result *sql.Rows
-	if err := func() error {
-		c.scope.Lock()
-		defer c.scope.Unlock()
-
-		_, err := c.db.ExecContext(
-			ctx,
-			`CALL sp_gatekeeper_check_pin(?, ?, ?, @memberID, @newZoneID, @message,
-				@memberName, @spErr)`,
-			pin,
-			door,
-			side,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to execute sp: %w", err)
-		}
-
-		result, err = c.db.QueryContext(ctx, `SELECT @memberID, @newZoneID, @message,
-			@memberName, @spErr`)
-		if err != nil {
-			return fmt.Errorf("failed to select sp result: %w", err)
-		}
-
-		return nil
-	}(); err != nil {
-		return GatekeeperCheckResult{}, err
-	}
-
-	if !result.Next() {
-		return GatekeeperCheckResult{}, errors.New("no sp result")
-	}
-
 	var (
 		memberID   sql.NullInt32
 		newZoneID  sql.NullInt32
@@ -163,25 +114,75 @@ func (c *Client) GatekeeperCheckPIN(ctx context.Context, door int32, side, pin s
 		memberName sql.NullString
 		spErr      sql.NullString
 	)
-	if err := result.Scan(&memberID, &newZoneID, &message, &memberName, &spErr); err != nil {
-		return GatekeeperCheckResult{}, fmt.Errorf("error scanning sp result: %w", err)
+	if err := c.call(
+		ctx,
+		`CALL sp_gatekeeper_check_pin(?, ?, ?, @memberID, @newZoneID, @message,
+			@memberName, @spErr)`,
+		[]interface{}{pin, door, side},
+		`SELECT @memberID, @newZoneID, @message, @memberName, @spErr`,
+		&memberID, &newZoneID, &message, &memberName, &spErr,
+	); err != nil {
+		return GatekeeperCheckResult{}, err
 	}
 
-	if spErr.String != "" {
+	// Enrollment outcomes may be reported as errors by the sp
+	enrollment := enrollmentFrom(message.String, spErr.String)
+	if spErr.String != "" && enrollment == NotEnrollment {
 		return GatekeeperCheckResult{}, fmt.Errorf("sp failed: %s", spErr.String)
 	}
+	// No explicit access_granted field on this sp
+	granted := message.String != "" && enrollment == NotEnrollment
+	if !granted && enrollment == NotEnrollment && memberID.Valid {
+		// A successful registration invalidates the PIN, so the member is
+		// found but there is no unlock text. This does not rely on the
+		// texts of the sp, which may change.
+		enrollment = Enrolled
+	}
 
 	return GatekeeperCheckResult{
-		// No explicit access_granted field on this sp
-		AccessGranted: message.String != "",
+		AccessGranted: granted,
 		// No last_seen field on this sp
 		Message:    message.String,
 		MemberID:   memberID.Int32,
 		MemberName: memberName.String,
 		NewZoneID:  newZoneID.Int32,
+		Enrollment: enrollment,
 	}, nil
 }
 
+// call executes a stored procedure and then selects its output variables into
+// dest. Both statements run on one connection because session variables are
+// only visible to the connection that set them, this also allows calls to run
+// concurrently.
+func (c *Client) call(ctx context.Context, call string, args []interface{}, selectVars string, dest ...interface{}) error {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, call, args...); err != nil {
+		return fmt.Errorf("failed to execute sp: %w", err)
+	}
+
+	result, err := conn.QueryContext(ctx, selectVars)
+	if err != nil {
+		return fmt.Errorf("failed to select sp result: %w", err)
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		if err := result.Err(); err != nil {
+			return fmt.Errorf("failed to select sp result: %w", err)
+		}
+		return errors.New("no sp result")
+	}
+	if err := result.Scan(dest...); err != nil {
+		return fmt.Errorf("error scanning sp result: %w", err)
+	}
+	return nil
+}
+
 const (
 	// DoorSideA is usually outide
 	DoorSideA = "A"
@@ -207,6 +208,9 @@ type GatekeeperCheckResult struct {
 	MemberName string
 	// NewZoneID is the zone the member would be moving into
 	NewZoneID int32
+	// Enrollment is the result of an enrollment PIN, it is always
+	// NotEnrollment for tags
+	Enrollment Enrollment
 }
 
 func parseDuration(ctx context.Context, t sql.NullString) time.Duration {
@@ -3,12 +3,18 @@ package hms
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
@@ -322,11 +328,66 @@ func TestGateKeeperCheckPIN(t *testing.T) {
 			},
 		},
 
+		"enrolledWithoutText": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						""),
+			},
+
+			want: &GatekeeperCheckResult{
+				AccessGranted: false,
+				Message:       "",
+				MemberID:      99,
+				MemberName:    "John",
+				NewZoneID:     5,
+				Enrollment:    Enrolled,
+			},
+		},
+
 		"notAllowed": {
 			door: 1,
 			side: DoorSideB,
 			pin:  "1234",
 
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						nil,
+						nil,
+						"",
+						nil,
+						""),
+			},
+
+			want: &GatekeeperCheckResult{},
+		},
+
+		"enrollmentReportedAsError": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
 			rows: []*sqlmock.Rows{
 				sqlmock.NewRows([]string{
 					"@memberID",
@@ -340,18 +401,135 @@ func TestGateKeeperCheckPIN(t *testing.T) {
 						int32(5),
 						"",
 						"John",
+						"No recent unknown card read"),
+			},
+
+			want: &GatekeeperCheckResult{
+				AccessGranted: false,
+				Message:       "",
+				MemberID:      99,
+				MemberName:    "John",
+				NewZoneID:     5,
+				Enrollment:    NoRecentCard,
+			},
+		},
+
+		"enrollmentReportedAsMessage": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"Card registered",
+						"John",
 						""),
 			},
 
+			want: &GatekeeperCheckResult{
+				AccessGranted: false,
+				Message:       "Card registered",
+				MemberID:      99,
+				MemberName:    "John",
+				NewZoneID:     5,
+				Enrollment:    Enrolled,
+			},
+		},
+
+		"cardNotRegistered": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						"Card not registered"),
+			},
+
 			want: &GatekeeperCheckResult{
 				AccessGranted: false,
 				Message:       "",
 				MemberID:      99,
 				MemberName:    "John",
 				NewZoneID:     5,
+				Enrollment:    NotEnrolled,
 			},
 		},
 
+		"messageMentioningRegistrationIsNotEnrollment": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "0248",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(7),
+						int32(5),
+						"Welcome back Bracken, your card is registered",
+						"Bracken",
+						""),
+			},
+
+			want: &GatekeeperCheckResult{
+				AccessGranted: true,
+				Message:       "Welcome back Bracken, your card is registered",
+				MemberID:      7,
+				MemberName:    "Bracken",
+				NewZoneID:     5,
+			},
+		},
+
+		"errorMentioningRegistrationIsNotEnrollment": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						"PIN not registered to a current member"),
+			},
+
+			wantErr: "sp failed: PIN not registered to a current member",
+		},
+
 		"unknown": {
 			door: 1,
 			side: DoorSideB,
@@ -501,9 +679,10 @@ func TestGatekeeperSetZone(t *testing.T) {
 	for name, test := range map[string]struct {
 		member, zone int32
 		err          error
+		wantErr      string
 	}{
-		"success": {1, 2, nil},
-		"failure": {3, 4, errors.New("oops")},
+		"success": {1, 2, nil, ""},
+		"failure": {3, 4, errors.New("oops"), "failed to set member 3 to zone 4: oops"},
 	} {
 		t.Run(name, func(t *testing.T) {
 			db, mock, err := sqlmock.New()
@@ -518,11 +697,103 @@ func TestGatekeeperSetZone(t *testing.T) {
 
 			c, err := NewClient(db)
 			require.NoError(t, err)
-			c.GatekeeperSetZone(context.Background(), test.member, test.zone)
+			err = c.GatekeeperSetZone(context.Background(), test.member, test.zone)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.wantErr)
+			}
 		})
 	}
 }
 
+func TestConcurrentCallsReadOwnSession(t *testing.T) {
+	db := sql.OpenDB(&sessionConnector{})
+	defer db.Close()
+	db.SetMaxOpenConns(3)
+	c, err := NewClient(db)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tag := fmt.Sprintf("tag%d", i)
+			res, err := c.GatekeeperCheckRFID(context.Background(), 1, DoorSideA, tag)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "Welcome "+tag, res.Message, "result was read from another connection's session")
+		}(i)
+	}
+	wg.Wait()
+}
+
+// sessionConnector is a database driver where each connection has its own
+// session variables, like MySQL. CALL sets @message from the first argument
+// and SELECT returns it.
+type sessionConnector struct{}
+
+func (c *sessionConnector) Connect(context.Context) (driver.Conn, error) {
+	return &sessionConn{}, nil
+}
+
+func (c *sessionConnector) Driver() driver.Driver { return nil }
+
+type sessionConn struct {
+	message string
+}
+
+func (c *sessionConn) Prepare(query string) (driver.Stmt, error) {
+	return &sessionStmt{conn: c, query: query}, nil
+}
+func (c *sessionConn) Close() error              { return nil }
+func (c *sessionConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type sessionStmt struct {
+	conn  *sessionConn
+	query string
+}
+
+func (s *sessionStmt) Close() error  { return nil }
+func (s *sessionStmt) NumInput() int { return -1 }
+
+func (s *sessionStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(s.query, "CALL") {
+		return nil, errors.New("unexpected exec")
+	}
+	// give other callers the chance to interleave
+	time.Sleep(time.Millisecond)
+	s.conn.message = fmt.Sprintf("Welcome %s", args[0])
+	return driver.ResultNoRows, nil
+}
+
+func (s *sessionStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT") {
+		return nil, errors.New("unexpected query")
+	}
+	return &sessionRows{values: []driver.Value{s.conn.message, "", "", int64(1), int64(1), int64(1), ""}}, nil
+}
+
+type sessionRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *sessionRows) Columns() []string {
+	return []string{"@message", "@memberName", "@lastSeen", "@accessGranted", "@newZoneID", "@memberID", "@spErr"}
+}
+func (r *sessionRows) Close() error { return nil }
+func (r *sessionRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
 func TestGatekeeperCheckRFIDReal(t *testing.T) {
 	if _, err := net.LookupHost("hmsdev"); err != nil {
 		t.Skip("No database found:", err)
@@ -536,7 +807,7 @@ func TestGatekeeperCheckRFIDReal(t *testing.T) {
 	res, err := c.GatekeeperCheckRFID(context.Background(), 1, DoorSideA, "9607166cf0e6342fb7f3")
 	require.NoError(t, err)
 	if res.AccessGranted {
-		c.GatekeeperSetZone(context.Background(), res.MemberID, res.NewZoneID)
+		require.NoError(t, c.GatekeeperSetZone(context.Background(), res.MemberID, res.NewZoneID))
 	}
 
 	t.Logf("%+v", res)
@@ -0,0 +1,205 @@
+package hms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+)
+
+const (
+	defaultOutboxBackoff    = time.Second
+	defaultOutboxMaxBackoff = 5 * time.Minute
+	defaultOutboxTimeout    = setZoneTimeoutS * time.Second
+	defaultOutboxAttempts   = 5
+)
+
+// ZoneUpdate is a member's move to a new zone that has not yet been sent to
+// HMS
+type ZoneUpdate struct {
+	MemberID  int32
+	NewZoneID int32
+	// Queued is the time the member moved
+	Queued time.Time
+	// Rejected is the number of times HMS has refused the update
+	Rejected int `json:",omitempty"`
+}
+
+// Outbox is a persistent queue of zone updates, it is kept in a file so that
+// updates survive restarts and HMS being unreachable. Updates are sent in the
+// order they were queued, a newer update for a member replaces any older one
+// still waiting. Updates are retried for as long as HMS cannot be reached, but
+// one that HMS refuses MaxAttempts times is dropped so that it does not hold
+// up the rest.
+type Outbox struct {
+	// Backoff is the wait after the first failure to send, it doubles with
+	// each further failure. The default is 1 second.
+	Backoff time.Duration
+	// MaxBackoff is the longest wait between retries, the default is 5
+	// minutes.
+	MaxBackoff time.Duration
+	// Timeout is the time allowed for each update, the default is 30 seconds.
+	Timeout time.Duration
+	// MaxAttempts is the number of times HMS may refuse an update before it
+	// is dropped, the default is 5.
+	MaxAttempts int
+
+	client *Client
+	path   string
+	wake   chan struct{}
+
+	mux   sync.Mutex
+	queue []ZoneUpdate
+}
+
+// NewOutbox returns an Outbox that sends updates with client and stores
+// them in the file at path, updates left in the file by a previous Outbox are
+// sent first. The file need not exist yet.
+func NewOutbox(client *Client, path string) (*Outbox, error) {
+	o := &Outbox{
+		Backoff:     defaultOutboxBackoff,
+		MaxBackoff:  defaultOutboxMaxBackoff,
+		Timeout:     defaultOutboxTimeout,
+		MaxAttempts: defaultOutboxAttempts,
+		client:      client,
+		path:        path,
+		wake:        make(chan struct{}, 1),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if err := json.Unmarshal(data, &o.queue); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox: %w", err)
+	}
+	return o, nil
+}
+
+// Enqueue queues a member's move to a new zone, an error means the update
+// could not be saved to disk but it is still queued in memory.
+func (o *Outbox) Enqueue(memberID, newZoneID int32) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	queue := o.queue[:0:0]
+	for _, update := range o.queue {
+		if update.MemberID != memberID {
+			queue = append(queue, update)
+		}
+	}
+	o.queue = append(queue, ZoneUpdate{
+		MemberID:  memberID,
+		NewZoneID: newZoneID,
+		Queued:    time.Now(),
+	})
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return o.save()
+}
+
+// Len returns the number of updates waiting to be sent
+func (o *Outbox) Len() int {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return len(o.queue)
+}
+
+// Run sends queued updates until ctx is cancelled, failed updates are retried
+// with backoff. The number waiting is logged with every failure and once they
+// have all been sent.
+func (o *Outbox) Run(ctx context.Context) {
+	backoff := o.Backoff
+	for {
+		if err := o.flush(ctx); err != nil {
+			Logger.Warnf(ctx, "Failed to send zone updates, %d waiting, retry in %s: %s", o.Len(), backoff, err)
+			timer := time.NewTimer(backoff)
+			backoff *= 2
+			if backoff > o.MaxBackoff {
+				backoff = o.MaxBackoff
+			}
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		if backoff != o.Backoff {
+			Logger.Infof(ctx, "Zone updates sent, %d waiting", o.Len())
+		}
+		backoff = o.Backoff
+
+		select {
+		case <-o.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush sends updates from the head of the queue until it is empty or one
+// fails, an update refused by HMS for the last time is dropped instead.
+func (o *Outbox) flush(ctx context.Context) error {
+	for {
+		o.mux.Lock()
+		if len(o.queue) == 0 {
+			o.mux.Unlock()
+			return nil
+		}
+		update := o.queue[0]
+		o.mux.Unlock()
+
+		sendCtx, cancel := context.WithTimeout(ctx, o.Timeout)
+		err := o.client.GatekeeperSetZone(sendCtx, update.MemberID, update.NewZoneID)
+		cancel()
+		var rejected *mysql.MySQLError
+		if err != nil && !errors.As(err, &rejected) {
+			return err
+		}
+
+		o.mux.Lock()
+		// The update may have been replaced while it was being sent
+		if len(o.queue) > 0 && o.queue[0] == update {
+			switch {
+			case err == nil:
+				o.queue = o.queue[1:]
+			case update.Rejected+1 >= o.MaxAttempts:
+				Logger.Warnf(ctx, "Dropping zone update of member %d to zone %d, refused %d times: %s", update.MemberID, update.NewZoneID, update.Rejected+1, err)
+				o.queue = o.queue[1:]
+				err = nil
+			default:
+				o.queue[0].Rejected++
+			}
+		}
+		if err := o.save(); err != nil {
+			Logger.Warn(ctx, "Failed to save zone outbox: ", err)
+		}
+		o.mux.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// save writes the queue to disk, o.mux must be held
+func (o *Outbox) save() error {
+	if err := atomicfile.WriteJSON(o.path, o.queue); err != nil {
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package hms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestOutboxEnqueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := NewOutbox(&Client{}, path)
+	require.NoError(t, err)
+	require.Equal(t, 0, o.Len())
+
+	require.NoError(t, o.Enqueue(1, 2))
+	require.NoError(t, o.Enqueue(3, 4))
+	require.NoError(t, o.Enqueue(1, 5))
+	require.Equal(t, 2, o.Len())
+
+	reopened, err := NewOutbox(&Client{}, path)
+	require.NoError(t, err)
+	require.Equal(t, 2, reopened.Len())
+	for i, want := range [][2]int32{{3, 4}, {1, 5}} {
+		require.Equal(t, want[0], reopened.queue[i].MemberID, "update %d", i)
+		require.Equal(t, want[1], reopened.queue[i].NewZoneID, "update %d", i)
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+	defer db.Close()
+
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(3, 4).
+		WillReturnError(errors.New("server has gone away"))
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(3, 4).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(1, 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	logs := &testLogger{}
+	Logger = logs
+	defer func() { Logger = logDiscarder{} }()
+
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := NewOutbox(&Client{db: db}, path)
+	require.NoError(t, err)
+	o.Backoff = time.Millisecond
+	require.NoError(t, o.Enqueue(3, 4))
+	require.NoError(t, o.Enqueue(1, 5))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		o.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return o.Len() == 0 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	require.Equal(t, []string{
+		"warn: Failed to send zone updates, 2 waiting, retry in 1ms: failed to set member 3 to zone 4: server has gone away",
+		"info: Zone updates sent, 0 waiting",
+	}, logs.lines)
+
+	reopened, err := NewOutbox(&Client{}, path)
+	require.NoError(t, err)
+	require.Equal(t, 0, reopened.Len())
+}
+
+func TestOutboxDropsRefused(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+	defer db.Close()
+
+	refused := &mysql.MySQLError{Number: 1644, Message: "no such zone"}
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(3, 99).
+		WillReturnError(refused)
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(3, 99).
+		WillReturnError(errors.New("server has gone away"))
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(3, 99).
+		WillReturnError(refused)
+	mock.ExpectExec("CALL sp_gatekeeper_set_zone").
+		WithArgs(1, 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	logs := &testLogger{}
+	Logger = logs
+	defer func() { Logger = logDiscarder{} }()
+
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := NewOutbox(&Client{db: db}, path)
+	require.NoError(t, err)
+	o.MaxAttempts = 2
+	require.NoError(t, o.Enqueue(3, 99))
+	require.NoError(t, o.Enqueue(1, 5))
+
+	ctx := context.Background()
+	require.EqualError(t, o.flush(ctx), "failed to set member 3 to zone 99: Error 1644: no such zone")
+	reopened, err := NewOutbox(&Client{}, path)
+	require.NoError(t, err)
+	require.Equal(t, 1, reopened.queue[0].Rejected, "refusals are saved")
+
+	// Failing to reach HMS is not a refusal
+	require.EqualError(t, o.flush(ctx), "failed to set member 3 to zone 99: server has gone away")
+	require.Equal(t, 1, o.queue[0].Rejected)
+
+	require.NoError(t, o.flush(ctx))
+	require.Equal(t, 0, o.Len())
+	require.Equal(t, []string{
+		"warn: Dropping zone update of member 3 to zone 99, refused 2 times: failed to set member 3 to zone 99: Error 1644: no such zone",
+	}, logs.lines)
+}
+
+// testLogger records formatted logs
+type testLogger struct {
+	mux   sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Warn(context.Context, ...interface{}) {}
+
+func (l *testLogger) Warnf(_ context.Context, format string, args ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.lines = append(l.lines, "warn: "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(_ context.Context, format string, args ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.lines = append(l.lines, "info: "+fmt.Sprintf(format, args...))
+}
+
+func TestAllowedQueuesZone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+	defer db.Close()
+
+	mock.ExpectExec("CALL sp_gatekeeper_check_rfid").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT @message").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"@message",
+			"@memberName",
+			"@lastSeen",
+			"@accessGranted",
+			"@newZoneID",
+			"@memberID",
+			"@spErr"}).
+			AddRow("Welcome back Bracken", "Bracken", "3s", int32(1), int32(5), int32(7), ""))
+
+	c := &Client{db: db}
+	c.Outbox, err = NewOutbox(c, filepath.Join(t.TempDir(), "outbox.json"))
+	require.NoError(t, err)
+
+	ctx, _ := auth.WithDetails(context.Background())
+	allowed, _, err := c.Allowed(ctx, 1, DoorSideA, "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Equal(t, 0, c.Outbox.Len(), "zone updated before access was allowed")
+	require.NoError(t, c.Zones().Allow(ctx, "Welcome back Bracken"))
+	require.Equal(t, 1, c.Outbox.Len())
+}
+
+func TestDeferZones(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+	defer db.Close()
+
+	mock.ExpectExec("CALL sp_gatekeeper_check_rfid").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT @message").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"@message",
+			"@memberName",
+			"@lastSeen",
+			"@accessGranted",
+			"@newZoneID",
+			"@memberID",
+			"@spErr"}).
+			AddRow("Welcome back Bracken", "Bracken", "3s", int32(1), int32(5), int32(7), ""))
+
+	c := &Client{db: db, DeferZones: true}
+	c.Outbox, err = NewOutbox(c, filepath.Join(t.TempDir(), "outbox.json"))
+	require.NoError(t, err)
+
+	ctx, _ := auth.WithDetails(context.Background())
+	allowed, _, err := c.Allowed(ctx, 1, DoorSideA, "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Equal(t, 0, c.Outbox.Len(), "zone updated before the door opened")
+
+	zones := c.Zones()
+	require.NoError(t, zones.Notify(ctx, admitter.ForcedOpen, "Door forced open"))
+	require.Equal(t, 0, c.Outbox.Len())
+
+	offlineCtx, offline := auth.WithDetails(context.Background())
+	offline.SetDecision(auth.Decision{Allowed: true, Member: auth.Member{ID: 8}, NewZoneID: 5, Offline: true})
+	require.NoError(t, zones.Notify(offlineCtx, admitter.Opened, "Door opened"))
+	require.Equal(t, 0, c.Outbox.Len())
+
+	require.NoError(t, zones.Notify(ctx, admitter.Opened, "Door opened"))
+	require.Equal(t, 1, c.Outbox.Len())
+	require.Equal(t, int32(7), c.Outbox.queue[0].MemberID)
+	require.Equal(t, int32(5), c.Outbox.queue[0].NewZoneID)
+}
@@ -6,14 +6,35 @@ import (
 )
 
 // CheckPIN is an adapter for the door, it wraps GateKeeperCheckPIN but returns
-// just a string.
-func (c *Client) CheckPIN(ctx context.Context, door int32, side, pin string) (string, error) {
+// just the enrollment result and a message to display.
+func (c *Client) CheckPIN(ctx context.Context, door int32, side, pin string) (Enrollment, string, error) {
 	res, err := c.GatekeeperCheckPIN(ctx, door, side, pin)
 	if err != nil {
-		return "", err
+		return NotEnrollment, "", err
+	}
+	if res.Enrollment != NotEnrollment {
+		return res.Enrollment, res.Enrollment.Message(res.MemberName), nil
+	}
+	if !res.AccessGranted {
+		return NotEnrollment, "Invalid pin", nil
+	}
+	return NotEnrollment, fmt.Sprintf("Valid pin for %s (id=%d): %s", res.MemberName, res.MemberID, res.Message), nil
+}
+
+// AllowedPIN makes hms into an auth.PINAuthorizer. For enrollment PINs an
+// *EnrollmentError is returned with a message describing the result.
+func (c *Client) AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error) {
+	res, err := c.GatekeeperCheckPIN(ctx, door, side, pin)
+	if err != nil {
+		return false, "", err
+	}
+	record(ctx, decision(res))
+	if res.Enrollment != NotEnrollment {
+		return false, res.Enrollment.Message(res.MemberName), &EnrollmentError{Result: res.Enrollment}
 	}
 	if !res.AccessGranted {
-		return "Invalid pin", nil
+		return false, "Invalid pin", nil
 	}
-	return fmt.Sprintf("Valid pin for %s (id=%d): %s", res.MemberName, res.MemberID, res.Message), nil
+	// The member is moved to NewZoneID by Zones, once access is allowed
+	return true, res.Message, nil
 }
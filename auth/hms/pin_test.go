@@ -5,6 +5,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/somakeit/door-controller3/auth"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
@@ -18,8 +19,9 @@ func TestCheckPIN(t *testing.T) {
 		rows              []*sqlmock.Rows
 		execErr, queryErr error
 
-		want    string
-		wantErr string
+		want           string
+		wantEnrollment Enrollment
+		wantErr        string
 	}{
 		"allowed": {
 			door: 1,
@@ -45,7 +47,32 @@ func TestCheckPIN(t *testing.T) {
 			want: "Valid pin for Bracken (id=7): Welcome back Bracken",
 		},
 
-		"notAllowed": {
+		"enrolled": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"Card registered",
+						"John",
+						""),
+			},
+
+			want:           "Card registered to John",
+			wantEnrollment: Enrolled,
+		},
+
+		"enrolledWithoutText": {
 			door: 1,
 			side: DoorSideB,
 			pin:  "1234",
@@ -66,9 +93,84 @@ func TestCheckPIN(t *testing.T) {
 						""),
 			},
 
+			want:           "Card registered to John",
+			wantEnrollment: Enrolled,
+		},
+
+		"unknown": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "5678",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						nil,
+						int32(5),
+						"",
+						nil,
+						""),
+			},
+
 			want: "Invalid pin",
 		},
 
+		"noRecentCard": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						"No recent unknown card read"),
+			},
+
+			want:           "No card to register, read your new card then enter the PIN",
+			wantEnrollment: NoRecentCard,
+		},
+
+		"alreadyRegistered": {
+			door: 1,
+			side: DoorSideB,
+			pin:  "1234",
+
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						"Card already registered"),
+			},
+
+			want:           "Card is already registered",
+			wantEnrollment: CardAlreadyRegistered,
+		},
+
 		"failedQuery": {
 			door: 1,
 			side: DoorSideB,
@@ -99,7 +201,7 @@ func TestCheckPIN(t *testing.T) {
 			}
 
 			c := &Client{db: db}
-			got, err := c.CheckPIN(context.Background(), test.door,
+			enrollment, got, err := c.CheckPIN(context.Background(), test.door,
 				test.side, test.pin)
 			if test.wantErr == "" {
 				require.NoError(t, err)
@@ -108,6 +210,140 @@ func TestCheckPIN(t *testing.T) {
 				require.Contains(t, err.Error(), test.wantErr)
 			}
 			require.Equal(t, test.want, got)
+			require.Equal(t, test.wantEnrollment, enrollment)
+		})
+	}
+}
+
+func TestAllowedPIN(t *testing.T) {
+	for name, test := range map[string]struct {
+		rows     []*sqlmock.Rows
+		queryErr error
+
+		want           bool
+		wantMsg        string
+		wantErr        bool
+		wantEnrollment bool
+		wantZone       bool
+	}{
+		"allowed": {
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(7),
+						int32(5),
+						"Welcome back Bracken",
+						"Bracken",
+						""),
+			},
+
+			want:     true,
+			wantMsg:  "Welcome back Bracken",
+			wantZone: true,
+		},
+
+		"enrollment": {
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"Card registered",
+						"John",
+						""),
+			},
+
+			wantMsg:        "Card registered to John",
+			wantEnrollment: true,
+		},
+
+		"enrollmentWithoutText": {
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						int32(99),
+						int32(5),
+						"",
+						"John",
+						""),
+			},
+
+			wantMsg:        "Card registered to John",
+			wantEnrollment: true,
+		},
+
+		"unknown": {
+			rows: []*sqlmock.Rows{
+				sqlmock.NewRows([]string{
+					"@memberID",
+					"@newZoneID",
+					"@message",
+					"@memberName",
+					"@spErr",
+				}).
+					AddRow(
+						nil,
+						int32(5),
+						"",
+						nil,
+						""),
+			},
+
+			wantMsg: "Invalid pin",
+		},
+
+		"failedQuery": {
+			queryErr: errors.New("var not in scope"),
+
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+			defer db.Close()
+
+			mock.ExpectExec(`CALL sp_gatekeeper_check_pin`).
+				WithArgs("0248", int32(1), DoorSideA).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT @memberID`).
+				WillReturnRows(test.rows...).
+				WillReturnError(test.queryErr)
+
+			// The zone is not set until Zones is told access was allowed
+			c := &Client{db: db}
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := c.AllowedPIN(ctx, 1, DoorSideA, "0248")
+			if test.wantZone {
+				require.Equal(t, int32(7), details.Decision().Member.ID)
+				require.Equal(t, int32(5), details.Decision().NewZoneID)
+			}
+			if test.wantEnrollment {
+				require.True(t, errors.Is(err, auth.ErrEnrollment), "want enrollment, err=%v", err)
+			} else {
+				require.Equal(t, test.wantErr, err != nil, "wantErr=%t, err=%v", test.wantErr, err)
+			}
+			require.Equal(t, test.want, got)
+			require.Equal(t, test.wantMsg, msg)
 		})
 	}
 }
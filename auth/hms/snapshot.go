@@ -0,0 +1,309 @@
+package hms
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+)
+
+const (
+	defaultSyncIntervalM  = 15
+	defaultSnapshotMaxAge = 7 * 24 * time.Hour
+
+	// rfidActive is the state of a usable tag in the rfid_tags table
+	rfidActive = 10
+	// currentMemberRole is the role held by members in good standing
+	currentMemberRole = "member.current"
+)
+
+// Snapshot is a copy of every active tag and door in HMS taken at a point in
+// time
+type Snapshot struct {
+	// Taken is the time the snapshot was read from HMS
+	Taken time.Time
+	// Tags maps an rfid serial to its owner
+	Tags map[string]SnapshotTag
+	// Doors maps a door ID to the permissions needed to go through it
+	Doors map[int32]SnapshotDoor
+}
+
+// SnapshotTag is the owner of a tag in a Snapshot
+type SnapshotTag struct {
+	MemberID   int32
+	MemberName string
+	// Current is true if the member is currently a member
+	Current bool
+	// Permissions are the names of every permission the member holds
+	Permissions []string
+}
+
+// SnapshotDoor is the permission needed to go through a door from each side
+// into the zone on the other, empty if the zone needs none
+type SnapshotDoor struct {
+	SideA string
+	SideB string
+}
+
+// permission returns the permission needed to go through the door from side
+func (d SnapshotDoor) permission(side string) string {
+	if side == DoorSideB {
+		return d.SideB
+	}
+	return d.SideA
+}
+
+// has reports whether the member holds permission
+func (t SnapshotTag) has(permission string) bool {
+	for _, p := range t.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Syncer periodically copies the HMS tag list to a local snapshot file
+type Syncer struct {
+	// Interval is the time between syncs, the default is 15 minutes.
+	Interval time.Duration
+
+	db   *sql.DB
+	path string
+}
+
+// NewSyncer returns a Syncer that stores snapshots of db at path
+func NewSyncer(db *sql.DB, path string) *Syncer {
+	return &Syncer{
+		Interval: defaultSyncIntervalM * time.Minute,
+		db:       db,
+		path:     path,
+	}
+}
+
+// Run syncs every Interval until ctx is cancelled, failures are logged and
+// the previous snapshot is kept.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sync(ctx); err != nil {
+			Logger.Warn(ctx, "Failed to sync HMS snapshot: ", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync takes one snapshot of HMS and replaces the snapshot file with it
+func (s *Syncer) Sync(ctx context.Context) error {
+	snap := Snapshot{Taken: time.Now()}
+	var err error
+	if snap.Tags, err = s.tags(ctx); err != nil {
+		return err
+	}
+	if snap.Doors, err = s.doors(ctx); err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteJSON(s.path, snap); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return nil
+}
+
+// tags reads every active tag and the permissions of its owner
+func (s *Syncer) tags(ctx context.Context) (map[string]SnapshotTag, error) {
+	permissions, err := s.permissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT rfid_tags.rfid_serial, users.id,
+		users.username, EXISTS(SELECT 1 FROM role_user
+			JOIN roles ON roles.id = role_user.role_id
+			WHERE role_user.user_id = users.id AND roles.name = ?)
+		FROM rfid_tags JOIN users ON users.id = rfid_tags.user_id
+		WHERE rfid_tags.state = ?`, currentMemberRole, rfidActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := make(map[string]SnapshotTag)
+	for rows.Next() {
+		var (
+			serial  string
+			tag     SnapshotTag
+			name    sql.NullString
+			current bool
+		)
+		if err := rows.Scan(&serial, &tag.MemberID, &name, &current); err != nil {
+			return nil, fmt.Errorf("error scanning tag: %w", err)
+		}
+		tag.MemberName = name.String
+		tag.Current = current
+		tag.Permissions = permissions[tag.MemberID]
+		tags[serial] = tag
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tags: %w", err)
+	}
+	return tags, nil
+}
+
+// permissions reads the names of the permissions each member holds through
+// their roles
+func (s *Syncer) permissions(ctx context.Context) (map[int32][]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT role_user.user_id,
+		permissions.name FROM role_user
+		JOIN permission_role ON permission_role.role_id = role_user.role_id
+		JOIN permissions ON permissions.id = permission_role.permission_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := make(map[int32][]string)
+	for rows.Next() {
+		var (
+			member int32
+			name   string
+		)
+		if err := rows.Scan(&member, &name); err != nil {
+			return nil, fmt.Errorf("error scanning permission: %w", err)
+		}
+		permissions[member] = append(permissions[member], name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read permissions: %w", err)
+	}
+	return permissions, nil
+}
+
+// doors reads the permission needed to go through each door from either side,
+// which is the permission of the zone on the other side
+func (s *Syncer) doors(ctx context.Context) (map[int32]SnapshotDoor, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT doors.id,
+		side_b.permission_code, side_a.permission_code FROM doors
+		JOIN zones side_a ON side_a.id = doors.side_a_zone_id
+		JOIN zones side_b ON side_b.id = doors.side_b_zone_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query doors: %w", err)
+	}
+	defer rows.Close()
+
+	doors := make(map[int32]SnapshotDoor)
+	for rows.Next() {
+		var (
+			id           int32
+			sideA, sideB sql.NullString
+		)
+		if err := rows.Scan(&id, &sideA, &sideB); err != nil {
+			return nil, fmt.Errorf("error scanning door: %w", err)
+		}
+		doors[id] = SnapshotDoor{SideA: sideA.String, SideB: sideB.String}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read doors: %w", err)
+	}
+	return doors, nil
+}
+
+// SnapshotAuthorizer is an Authorizer that answers from the snapshot file
+// written by a Syncer, it does not need a connection to HMS. The file is
+// re-read whenever it changes.
+type SnapshotAuthorizer struct {
+	// MaxAge is the age after which a snapshot is considered too stale to
+	// use, the default is 7 days.
+	MaxAge time.Duration
+
+	path string
+
+	mux      sync.Mutex
+	snap     Snapshot
+	modified time.Time
+}
+
+// NewSnapshotAuthorizer returns a SnapshotAuthorizer using the snapshot at
+// path, the file need not exist yet.
+func NewSnapshotAuthorizer(path string) *SnapshotAuthorizer {
+	return &SnapshotAuthorizer{
+		MaxAge: defaultSnapshotMaxAge,
+		path:   path,
+	}
+}
+
+// Allowed grants access to active tags owned by current members who hold the
+// permission needed to go through the door from side, the decision is always
+// marked as offline. Doors missing from the snapshot are an error.
+func (a *SnapshotAuthorizer) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
+	snap, err := a.load()
+	if err != nil {
+		return false, "", err
+	}
+	if time.Since(snap.Taken) > a.MaxAge {
+		return false, "", fmt.Errorf("snapshot is stale, taken %s", snap.Taken)
+	}
+
+	doorPerm, ok := snap.Doors[door]
+	if !ok {
+		return false, "", fmt.Errorf("door %d is not in the snapshot", door)
+	}
+
+	details := auth.DetailsFrom(ctx)
+	details.SetOffline()
+	tag, ok := snap.Tags[id]
+	if !ok {
+		details.SetReason(auth.UnknownID)
+		return false, "", nil
+	}
+	details.SetMember(tag.MemberID, tag.MemberName)
+	if !tag.Current {
+		return false, "", nil
+	}
+	if p := doorPerm.permission(side); p != "" && !tag.has(p) {
+		return false, "", nil
+	}
+	return true, fmt.Sprintf("Welcome %s", tag.MemberName), nil
+}
+
+// load returns the latest snapshot, re-reading the file if it has changed
+func (a *SnapshotAuthorizer) load() (Snapshot, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	info, err := os.Stat(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, errors.New("no snapshot")
+	}
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to stat snapshot: %w", err)
+	}
+	if info.ModTime().Equal(a.modified) {
+		return a.snap, nil
+	}
+
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	a.snap = snap
+	a.modified = info.ModTime()
+	return snap, nil
+}
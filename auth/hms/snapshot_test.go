@@ -0,0 +1,161 @@
+package hms
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var _ auth.Authorizer = &SnapshotAuthorizer{}
+
+func TestSyncAndAuthorize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mock.ExpectationsWereMet()) }()
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT DISTINCT role_user.user_id, permissions.name`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "name"}).
+			AddRow(int32(7), "gatekeeper.zone.entry.hackspace").
+			AddRow(int32(42), "gatekeeper.zone.entry.hackspace").
+			AddRow(int32(42), "gatekeeper.zone.entry.workshop"))
+	mock.ExpectQuery(`SELECT rfid_tags.rfid_serial, users.id, users.username`).
+		WithArgs(currentMemberRole, rfidActive).
+		WillReturnRows(sqlmock.NewRows([]string{"rfid_serial", "id", "username", "current"}).
+			AddRow("1f680", int32(7), "Bracken", true).
+			AddRow("1f4a9", int32(99), "John", false).
+			AddRow("1f527", int32(42), "Alex", true))
+	mock.ExpectQuery(`SELECT doors.id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "side_b", "side_a"}).
+			AddRow(int32(1), "gatekeeper.zone.entry.hackspace", nil).
+			AddRow(int32(2), "gatekeeper.zone.entry.workshop", "gatekeeper.zone.entry.hackspace"))
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, NewSyncer(db, path).Sync(context.Background()))
+
+	a := NewSnapshotAuthorizer(path)
+	for name, test := range map[string]struct {
+		door       int32
+		side       string
+		tag        string
+		want       bool
+		wantMsg    string
+		wantMember int32
+	}{
+		"current member": {
+			door:       1,
+			side:       DoorSideA,
+			tag:        "1f680",
+			want:       true,
+			wantMsg:    "Welcome Bracken",
+			wantMember: 7,
+		},
+
+		"leaving needs no permission": {
+			door:       1,
+			side:       DoorSideB,
+			tag:        "1f680",
+			want:       true,
+			wantMsg:    "Welcome Bracken",
+			wantMember: 7,
+		},
+
+		"member without the door's permission": {
+			door:       2,
+			side:       DoorSideA,
+			tag:        "1f680",
+			wantMember: 7,
+		},
+
+		"member with the door's permission": {
+			door:       2,
+			side:       DoorSideA,
+			tag:        "1f527",
+			want:       true,
+			wantMsg:    "Welcome Alex",
+			wantMember: 42,
+		},
+
+		"lapsed member": {
+			door:       1,
+			side:       DoorSideA,
+			tag:        "1f4a9",
+			wantMember: 99,
+		},
+
+		"unknown tag": {
+			door: 1,
+			side: DoorSideA,
+			tag:  "8008135",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := a.Allowed(ctx, test.door, test.side, test.tag)
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+			require.Equal(t, test.wantMsg, msg)
+			require.True(t, details.Offline())
+			member, _ := details.Member()
+			require.Equal(t, test.wantMember, member)
+		})
+	}
+}
+
+func TestSyncFailureKeepsSnapshot(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, atomicfile.WriteJSON(path, Snapshot{
+		Taken: time.Now(),
+		Tags:  map[string]SnapshotTag{"1f680": {MemberID: 7, MemberName: "Bracken", Current: true}},
+		Doors: map[int32]SnapshotDoor{1: {}},
+	}))
+
+	mock.ExpectQuery(`SELECT`).WillReturnError(errors.New("gone away"))
+	require.Error(t, NewSyncer(db, path).Sync(context.Background()))
+
+	allowed, _, err := NewSnapshotAuthorizer(path).Allowed(context.Background(), 1, DoorSideA, "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+}
+
+func TestSnapshotAuthorizerErrors(t *testing.T) {
+	t.Run("no snapshot", func(t *testing.T) {
+		a := NewSnapshotAuthorizer(filepath.Join(t.TempDir(), "snapshot.json"))
+		_, _, err := a.Allowed(context.Background(), 1, DoorSideA, "1f680")
+		require.Error(t, err)
+	})
+
+	t.Run("stale snapshot", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		require.NoError(t, atomicfile.WriteJSON(path, Snapshot{
+			Taken: time.Now().Add(-time.Hour),
+			Tags:  map[string]SnapshotTag{"1f680": {MemberID: 7, MemberName: "Bracken", Current: true}},
+		}))
+		a := NewSnapshotAuthorizer(path)
+		a.MaxAge = time.Minute
+		_, _, err := a.Allowed(context.Background(), 1, DoorSideA, "1f680")
+		require.Error(t, err)
+	})
+
+	t.Run("door not in snapshot", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		require.NoError(t, atomicfile.WriteJSON(path, Snapshot{
+			Taken: time.Now(),
+			Tags:  map[string]SnapshotTag{"1f680": {MemberID: 7, MemberName: "Bracken", Current: true}},
+			Doors: map[int32]SnapshotDoor{1: {}},
+		}))
+		_, _, err := NewSnapshotAuthorizer(path).Allowed(context.Background(), 3, DoorSideA, "1f680")
+		require.EqualError(t, err, "door 3 is not in the snapshot")
+	})
+}
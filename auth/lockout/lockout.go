@@ -0,0 +1,260 @@
+// lockout is middleware for Authorizers that slows down guessing by locking
+// out identifiers, and whole door sides, after repeated denials.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+)
+
+const (
+	defaultThreshold     = 3
+	defaultSideThreshold = 10
+	defaultBackoffS      = 5
+	defaultMaxBackoffM   = 10
+	defaultForgetM       = 60
+)
+
+var (
+	// ErrLockedOut is the reason returned while an identifier or door side is
+	// locked out. Errors returned by this package satisfy errors.Is with it.
+	ErrLockedOut = errors.New("locked out")
+)
+
+// LockedOutError is returned instead of asking the wrapped Authorizer while
+// locked out.
+type LockedOutError struct {
+	// RetryIn is the time remaining until the lockout ends
+	RetryIn time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("locked out, try again in %d s", int(math.Ceil(e.RetryIn.Seconds())))
+}
+
+// Is makes LockedOutError match ErrLockedOut
+func (e *LockedOutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// Logger can be used to interface any logger to this package, by default
+// it discards all logs
+var Logger ContextLogger = logDiscarder{}
+
+// ContextLogger is an interface which allows you to use any logger and include
+// context fields.
+type ContextLogger interface {
+	Warnf(ctx context.Context, format string, args ...interface{})
+}
+
+type logDiscarder struct{}
+
+func (logDiscarder) Warnf(context.Context, string, ...interface{}) {}
+
+// Lockout counts denials per identifier and per door side. Once Threshold
+// denials (or SideThreshold for a side) have been made a lockout of Backoff
+// begins, each further denial doubles the lockout up to MaxBackoff. Access
+// being allowed clears the counts for that identifier and door side. Errors
+// from the wrapped Authorizer are not counted. Attempts still being checked
+// are counted as denials until they are answered, so that attempts made
+// together cannot slip past a lockout one of them is about to cause.
+type Lockout struct {
+	// Threshold is the number of denials of one identifier before it is
+	// locked out, the default is 3.
+	Threshold int
+	// SideThreshold is the number of denials of any identifiers on one door
+	// side before the side is locked out, the default is 10.
+	SideThreshold int
+	// Backoff is the length of the first lockout, the default is 5 seconds.
+	Backoff time.Duration
+	// MaxBackoff is the longest lockout, the default is 10 minutes.
+	MaxBackoff time.Duration
+	// Forget is the time after the last denial when the count is reset, the
+	// default is 1 hour.
+	Forget time.Duration
+
+	mux     sync.Mutex
+	records map[string]*record
+	now     func() time.Time
+}
+
+type record struct {
+	denials int
+	// pending is the number of attempts being checked
+	pending int
+	last    time.Time
+	until   time.Time
+}
+
+// New returns a Lockout with the default settings
+func New() *Lockout {
+	return &Lockout{
+		Threshold:     defaultThreshold,
+		SideThreshold: defaultSideThreshold,
+		Backoff:       defaultBackoffS * time.Second,
+		MaxBackoff:    defaultMaxBackoffM * time.Minute,
+		Forget:        defaultForgetM * time.Minute,
+		records:       make(map[string]*record),
+		now:           time.Now,
+	}
+}
+
+// Tags returns an Authorizer that applies the lockout to a
+func (l *Lockout) Tags(a auth.Authorizer) *Tags {
+	return &Tags{lockout: l, auth: a}
+}
+
+// PINs returns a PINAuthorizer that applies the lockout to p
+func (l *Lockout) PINs(p auth.PINAuthorizer) *PINs {
+	return &PINs{lockout: l, auth: p}
+}
+
+// Tags is an Authorizer with a lockout
+type Tags struct {
+	lockout *Lockout
+	auth    auth.Authorizer
+}
+
+func (t *Tags) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
+	return t.lockout.attempt(ctx, door, side, "tag:"+id, func() (bool, string, error) {
+		return t.auth.Allowed(ctx, door, side, id)
+	})
+}
+
+// PINs is a PINAuthorizer with a lockout
+type PINs struct {
+	lockout *Lockout
+	auth    auth.PINAuthorizer
+}
+
+func (p *PINs) AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error) {
+	return p.lockout.attempt(ctx, door, side, "pin:"+pin, func() (bool, string, error) {
+		return p.auth.AllowedPIN(ctx, door, side, pin)
+	})
+}
+
+// attempt refuses to call check while locked out, otherwise it calls check
+// and counts the result. mux is only held to read and count, not during check.
+func (l *Lockout) attempt(ctx context.Context, door int32, side, id string, check func() (bool, string, error)) (bool, string, error) {
+	if err := ctx.Err(); err != nil {
+		return false, "", err
+	}
+	sideKey := fmt.Sprintf("side:%d/%s", door, side)
+	idKey := fmt.Sprintf("%d/%s/%s", door, side, id)
+
+	if wait := l.begin(sideKey, idKey); wait > 0 {
+		err := &LockedOutError{RetryIn: wait}
+		details := auth.DetailsFrom(ctx)
+		details.SetReason(auth.LockedOut)
+		details.SetUncacheable()
+		return false, fmt.Sprintf("Locked out, try again in %d s", int(math.Ceil(wait.Seconds()))), err
+	}
+
+	allowed, msg, err := check()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.records[sideKey].pending--
+	l.records[idKey].pending--
+	switch {
+	case err != nil:
+	case allowed:
+		l.reset(idKey)
+		l.reset(sideKey)
+	default:
+		if r := l.deny(idKey, l.Threshold); r != nil {
+			Logger.Warnf(ctx, "Identifier locked out for %s after %d denials", r.until.Sub(r.last), r.denials)
+		}
+		if r := l.deny(sideKey, l.SideThreshold); r != nil {
+			Logger.Warnf(ctx, "Door %d side %s locked out for %s after %d denials", door, side, r.until.Sub(r.last), r.denials)
+		}
+	}
+	return allowed, msg, err
+}
+
+// begin returns how long the side and identifier are locked out for, if they
+// are not the attempt is counted as pending against both. An attempt that
+// would reach a threshold if the pending attempts were denied waits for
+// Backoff.
+func (l *Lockout) begin(sideKey, idKey string) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.prune()
+	var wait time.Duration
+	now := l.now()
+	for key, threshold := range map[string]int{sideKey: l.SideThreshold, idKey: l.Threshold} {
+		r, ok := l.records[key]
+		if !ok {
+			continue
+		}
+		if w := r.until.Sub(now); w > wait {
+			wait = w
+		}
+		if r.pending > 0 && r.denials+r.pending >= threshold && l.Backoff > wait {
+			wait = l.Backoff
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, key := range []string{sideKey, idKey} {
+		r, ok := l.records[key]
+		if !ok {
+			r = &record{}
+			l.records[key] = r
+		}
+		r.pending++
+	}
+	return 0
+}
+
+// reset clears the denials counted against key. Must be called with mux held.
+func (l *Lockout) reset(key string) {
+	r := l.records[key]
+	r.denials = 0
+	r.until = time.Time{}
+}
+
+// deny counts a denial against key and returns its record if it caused a
+// lockout. Must be called with mux held.
+func (l *Lockout) deny(key string, threshold int) *record {
+	r, ok := l.records[key]
+	if !ok {
+		r = &record{}
+		l.records[key] = r
+	}
+	now := l.now()
+	r.denials++
+	r.last = now
+	if r.denials < threshold {
+		return nil
+	}
+
+	backoff := l.Backoff
+	for i := threshold; i < r.denials && backoff < l.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > l.MaxBackoff {
+		backoff = l.MaxBackoff
+	}
+	r.until = now.Add(backoff)
+	return r
+}
+
+// prune forgets records that have not been denied for Forget, are not locked
+// out and have no pending attempts, so cycling through identifiers cannot grow
+// records forever. Must be called with mux held.
+func (l *Lockout) prune() {
+	now := l.now()
+	for k, r := range l.records {
+		if r.pending == 0 && (r.denials == 0 || now.Sub(r.last) > l.Forget) && now.After(r.until) {
+			delete(l.records, k)
+		}
+	}
+}
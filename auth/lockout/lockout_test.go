@@ -0,0 +1,287 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ auth.Authorizer    = &Tags{}
+	_ auth.PINAuthorizer = &PINs{}
+)
+
+type step struct {
+	after time.Duration // since the previous step
+	tag   string
+	side  string
+	allow bool
+	err   error
+
+	wantCall    bool
+	wantLockout time.Duration
+}
+
+func TestLockout(t *testing.T) {
+	for name, test := range map[string]struct {
+		steps []step
+	}{
+		"locks out after threshold": {
+			steps: []step{
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantLockout: 5 * time.Second},
+				{after: time.Second, tag: "bad", wantLockout: 4 * time.Second},
+				{tag: "good", allow: true, wantCall: true},
+			},
+		},
+
+		"backs off exponentially": {
+			steps: []step{
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{after: 5 * time.Second, tag: "bad", wantCall: true},
+				{tag: "bad", wantLockout: 10 * time.Second},
+				{after: 10 * time.Second, tag: "bad", wantCall: true},
+				{tag: "bad", wantLockout: 20 * time.Second},
+			},
+		},
+
+		"backoff is capped": {
+			steps: []step{
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{after: time.Minute, tag: "bad", wantCall: true},
+				{after: time.Minute, tag: "bad", wantCall: true},
+				{after: time.Minute, tag: "bad", wantCall: true},
+				{after: time.Minute, tag: "bad", wantCall: true},
+				{tag: "bad", wantLockout: time.Minute},
+			},
+		},
+
+		"allow resets count": {
+			steps: []step{
+				{tag: "forgetful", wantCall: true},
+				{tag: "forgetful", wantCall: true},
+				{tag: "forgetful", allow: true, wantCall: true},
+				{tag: "forgetful", wantCall: true},
+				{tag: "forgetful", wantCall: true},
+			},
+		},
+
+		"errors are not counted": {
+			steps: []step{
+				{tag: "bad", err: errors.New("down"), wantCall: true},
+				{tag: "bad", err: errors.New("down"), wantCall: true},
+				{tag: "bad", err: errors.New("down"), wantCall: true},
+				{tag: "bad", wantCall: true},
+			},
+		},
+
+		"denials are forgotten": {
+			steps: []step{
+				{tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+				{after: 2 * time.Hour, tag: "bad", wantCall: true},
+				{tag: "bad", wantCall: true},
+			},
+		},
+
+		"cycling tags locks out the side": {
+			steps: []step{
+				{tag: "1", wantCall: true},
+				{tag: "2", wantCall: true},
+				{tag: "3", wantCall: true},
+				{tag: "4", wantCall: true},
+				{tag: "5", wantCall: true},
+				{tag: "6", wantLockout: 5 * time.Second},
+				{tag: "6", side: "B", wantCall: true},
+			},
+		},
+
+		"allow resets the side": {
+			steps: []step{
+				{tag: "1", wantCall: true},
+				{tag: "2", wantCall: true},
+				{tag: "3", wantCall: true},
+				{tag: "4", wantCall: true},
+				{tag: "good", allow: true, wantCall: true},
+				{tag: "5", wantCall: true},
+				{tag: "6", wantCall: true},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			l := New()
+			l.SideThreshold = 5
+			l.MaxBackoff = time.Minute
+			l.now = func() time.Time { return now }
+
+			for i, s := range test.steps {
+				now = now.Add(s.after)
+				side := s.side
+				if side == "" {
+					side = "A"
+				}
+
+				authDouble := &testAuth{}
+				authDouble.Test(t)
+				if s.wantCall {
+					authDouble.On("Allowed", mock.Anything, int32(1), side, s.tag).Return(s.allow, "msg", s.err).Once()
+				}
+
+				allowed, msg, err := l.Tags(authDouble).Allowed(context.Background(), 1, side, s.tag)
+				authDouble.AssertExpectations(t)
+				if s.wantLockout > 0 {
+					var lockErr *LockedOutError
+					require.True(t, errors.As(err, &lockErr), "step %d: want lockout, got err=%v", i, err)
+					require.True(t, errors.Is(err, ErrLockedOut))
+					require.Equal(t, s.wantLockout, lockErr.RetryIn, "step %d", i)
+					require.False(t, allowed)
+					require.Contains(t, msg, "Locked out")
+					continue
+				}
+				require.Equal(t, s.err, err, "step %d", i)
+				require.Equal(t, s.allow, allowed, "step %d", i)
+			}
+		})
+	}
+}
+
+func TestPINsShareSides(t *testing.T) {
+	now := time.Now()
+	l := New()
+	l.SideThreshold = 2
+	l.now = func() time.Time { return now }
+
+	pinDouble := &testPIN{}
+	pinDouble.Test(t)
+	pinDouble.On("AllowedPIN", mock.Anything, int32(1), "A", "1234").Return(false, "Invalid pin", nil).Once()
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "1234").Return(false, "", nil).Once()
+
+	_, msg, err := l.PINs(pinDouble).AllowedPIN(context.Background(), 1, "A", "1234")
+	require.NoError(t, err)
+	require.Equal(t, "Invalid pin", msg)
+	_, _, err = l.Tags(authDouble).Allowed(context.Background(), 1, "A", "1234")
+	require.NoError(t, err, "a tag and a PIN with the same value are different identifiers")
+	ctx, details := auth.WithDetails(context.Background())
+	_, _, err = l.PINs(pinDouble).AllowedPIN(ctx, 1, "A", "5678")
+	require.True(t, errors.Is(err, ErrLockedOut))
+	require.Equal(t, auth.LockedOut, details.Decision().Reason)
+	require.False(t, details.Decision().Cacheable)
+	pinDouble.AssertExpectations(t)
+	authDouble.AssertExpectations(t)
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	l := New()
+	l.Threshold = 1
+
+	// Only the first of the attempts made together reaches the Authorizer
+	release := make(chan struct{})
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "bad").Return(false, "", nil).
+		Run(func(mock.Arguments) { <-release }).Once()
+
+	var wg sync.WaitGroup
+	first := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(first)
+		_, _, _ = l.Tags(authDouble).Allowed(context.Background(), 1, "A", "bad")
+	}()
+	<-first
+	require.Eventually(t, func() bool {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		r, ok := l.records["1/A/tag:bad"]
+		return ok && r.pending == 1
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		_, _, err := l.Tags(authDouble).Allowed(context.Background(), 1, "A", "bad")
+		require.Equal(t, &LockedOutError{RetryIn: 5 * time.Second}, err)
+	}
+	close(release)
+	wg.Wait()
+	authDouble.AssertExpectations(t)
+}
+
+func TestSlowCheck(t *testing.T) {
+	l := New()
+
+	// A check that does not return does not hold up others on the side
+	release := make(chan struct{})
+	defer close(release)
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "slow").Return(false, "", nil).
+		Run(func(mock.Arguments) { <-release }).Once()
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "good").Return(true, "msg", nil).Once()
+
+	go func() {
+		_, _, _ = l.Tags(authDouble).Allowed(context.Background(), 1, "A", "slow")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		allowed, _, err := l.Tags(authDouble).Allowed(context.Background(), 1, "A", "good")
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("attempt held up by a slow check")
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	l := New()
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	allowed, _, err := l.Tags(authDouble).Allowed(ctx, 1, "A", "tag")
+	require.Equal(t, context.Canceled, err)
+	require.False(t, allowed)
+	authDouble.AssertExpectations(t)
+}
+
+func TestLockedOutError(t *testing.T) {
+	require.Equal(t, "locked out, try again in 3 s", (&LockedOutError{RetryIn: 2500 * time.Millisecond}).Error())
+}
+
+type testAuth struct {
+	mock.Mock
+}
+
+func (a *testAuth) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	args := a.Called(ctx, door, side, id)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
+
+type testPIN struct {
+	mock.Mock
+}
+
+func (p *testPIN) AllowedPIN(ctx context.Context, door int32, side, pin string) (bool, string, error) {
+	args := p.Called(ctx, door, side, pin)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
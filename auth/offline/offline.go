@@ -0,0 +1,208 @@
+// offline is an Authorizer that remembers the grants made by another
+// Authorizer so the door can keep working when that Authorizer is unreachable.
+package offline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+)
+
+const (
+	defaultMaxAge   = 7 * 24 * time.Hour
+	defaultTimeoutS = 5
+)
+
+// Logger can be used to interface any logger to this package, by default
+// it discards all logs
+var Logger ContextLogger = logDiscarder{}
+
+// ContextLogger is an interface which allows you to use any logger and include
+// context fields.
+type ContextLogger interface {
+	Warn(ctx context.Context, args ...interface{})
+}
+
+type logDiscarder struct{}
+
+func (logDiscarder) Warn(context.Context, ...interface{}) {}
+
+// Grant is a successful authorization remembered by the Cache
+type Grant struct {
+	Tag        string
+	Door       int32
+	Side       string
+	MemberID   int32
+	MemberName string
+	Message    string
+	// Expires is the time after which the Grant will not be used
+	Expires time.Time
+}
+
+// Cache is an Authorizer which records the grants of the Authorizer it wraps
+// in a file and answers from them when the wrapped Authorizer fails.
+type Cache struct {
+	// MaxAge is how long a grant can be used offline after the wrapped
+	// Authorizer last confirmed it. The default is 7 days. Use SetMaxAge to
+	// change it once the Cache is in use.
+	MaxAge time.Duration
+	// Timeout is the time given to the wrapped Authorizer before the cache is
+	// used instead. The default is 5 seconds.
+	Timeout time.Duration
+
+	auth auth.Authorizer
+	path string
+
+	settings sync.Mutex
+
+	mux    sync.Mutex
+	grants map[string]Grant
+}
+
+// New returns a Cache wrapping authority and storing grants at path, any
+// grants already stored at path are loaded.
+func New(authority auth.Authorizer, path string) (*Cache, error) {
+	c := &Cache{
+		MaxAge:  defaultMaxAge,
+		Timeout: defaultTimeoutS * time.Second,
+		auth:    authority,
+		path:    path,
+		grants:  make(map[string]Grant),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	var grants []Grant
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, fmt.Errorf("failed to parse cache: %w", err)
+	}
+	for _, g := range grants {
+		c.grants[key(g.Door, g.Side, g.Tag)] = g
+	}
+	return c, nil
+}
+
+// Allowed asks the wrapped Authorizer, if it fails or times out then any
+// unexpired grant for id is used and the decision is marked as offline.
+func (c *Cache) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
+	ctx, details := auth.WithDetails(ctx)
+
+	authCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	allowed, message, err = c.auth.Allowed(authCtx, door, side, id)
+	if err == nil {
+		if allowed && details.Decision().Cacheable {
+			memberID, memberName := details.Member()
+			c.store(ctx, Grant{
+				Tag:        id,
+				Door:       door,
+				Side:       side,
+				MemberID:   memberID,
+				MemberName: memberName,
+				Message:    message,
+				Expires:    time.Now().Add(c.maxAge()),
+			})
+		} else if !allowed {
+			c.forget(ctx, door, side, id)
+		}
+		return allowed, message, nil
+	}
+
+	// The attempt was abandoned rather than the Authorizer failing
+	if ctx.Err() != nil {
+		return false, "", err
+	}
+
+	grant, ok := c.lookup(door, side, id)
+	if !ok {
+		return false, "", err
+	}
+	Logger.Warn(ctx, "Authorizer failed, using offline cache: ", err)
+	details.SetOffline()
+	details.SetMember(grant.MemberID, grant.MemberName)
+	return true, grant.Message, nil
+}
+
+// SetMaxAge changes MaxAge for grants stored from now on, it is safe to call
+// while the Cache is in use.
+func (c *Cache) SetMaxAge(d time.Duration) {
+	c.settings.Lock()
+	defer c.settings.Unlock()
+	c.MaxAge = d
+}
+
+// maxAge returns MaxAge
+func (c *Cache) maxAge() time.Duration {
+	c.settings.Lock()
+	defer c.settings.Unlock()
+	return c.MaxAge
+}
+
+// Len returns the number of grants in the cache
+func (c *Cache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.grants)
+}
+
+func (c *Cache) lookup(door int32, side, id string) (Grant, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	g, ok := c.grants[key(door, side, id)]
+	if !ok || time.Now().After(g.Expires) {
+		return Grant{}, false
+	}
+	return g, true
+}
+
+func (c *Cache) store(ctx context.Context, g Grant) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.grants[key(g.Door, g.Side, g.Tag)] = g
+	c.save(ctx)
+}
+
+func (c *Cache) forget(ctx context.Context, door int32, side, id string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	k := key(door, side, id)
+	if _, ok := c.grants[k]; !ok {
+		return
+	}
+	delete(c.grants, k)
+	c.save(ctx)
+}
+
+// save writes the grants to disk, expired grants are dropped. The file is
+// replaced atomically so a power cut cannot leave it half written. Must be
+// called with mux held.
+func (c *Cache) save(ctx context.Context) {
+	grants := make([]Grant, 0, len(c.grants))
+	for k, g := range c.grants {
+		if time.Now().After(g.Expires) {
+			delete(c.grants, k)
+			continue
+		}
+		grants = append(grants, g)
+	}
+	if err := atomicfile.WriteJSON(c.path, grants); err != nil {
+		Logger.Warn(ctx, "Failed to save offline cache: ", err)
+	}
+}
+
+func key(door int32, side, id string) string {
+	return fmt.Sprintf("%d/%s/%s", door, side, id)
+}
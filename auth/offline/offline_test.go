@@ -0,0 +1,178 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/internal/atomicfile"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var _ auth.Authorizer = &Cache{}
+
+func TestCache(t *testing.T) {
+	for name, test := range map[string]struct {
+		grants []Grant
+
+		allow    bool
+		allowMsg string
+		allowErr error
+
+		want        bool
+		wantMsg     string
+		wantErr     bool
+		wantOffline bool
+		wantGrants  int
+	}{
+		"online grant is recorded": {
+			allow:    true,
+			allowMsg: "Welcome back Bracken",
+
+			want:       true,
+			wantMsg:    "Welcome back Bracken",
+			wantGrants: 1,
+		},
+
+		"online deny removes grant": {
+			grants: []Grant{{Tag: "1f680", Door: 1, Side: "A", Message: "Welcome back Bracken", Expires: time.Now().Add(time.Hour)}},
+
+			allowMsg: "Membership expired",
+
+			wantMsg:    "Membership expired",
+			wantGrants: 0,
+		},
+
+		"offline grant from cache": {
+			grants: []Grant{{Tag: "1f680", Door: 1, Side: "A", MemberID: 7, Message: "Welcome back Bracken", Expires: time.Now().Add(time.Hour)}},
+
+			allowErr: errors.New("no route to host"),
+
+			want:        true,
+			wantMsg:     "Welcome back Bracken",
+			wantOffline: true,
+			wantGrants:  1,
+		},
+
+		"offline without grant": {
+			allowErr: errors.New("no route to host"),
+
+			wantErr: true,
+		},
+
+		"offline with expired grant": {
+			grants: []Grant{{Tag: "1f680", Door: 1, Side: "A", Message: "Welcome back Bracken", Expires: time.Now().Add(-time.Hour)}},
+
+			allowErr: errors.New("no route to host"),
+
+			wantErr:    true,
+			wantGrants: 1,
+		},
+
+		"grants are per door side": {
+			grants: []Grant{{Tag: "1f680", Door: 1, Side: "B", Message: "Welcome back Bracken", Expires: time.Now().Add(time.Hour)}},
+
+			allowErr: errors.New("no route to host"),
+
+			wantErr:    true,
+			wantGrants: 1,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			require.NoError(t, atomicfile.WriteJSON(path, test.grants))
+
+			authDouble := &testAuth{}
+			authDouble.Test(t)
+			defer authDouble.AssertExpectations(t)
+			authDouble.On("Allowed", mock.Anything, int32(1), "A", "1f680").Return(test.allow, test.allowMsg, test.allowErr).Once()
+
+			c, err := New(authDouble, path)
+			require.NoError(t, err)
+
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := c.Allowed(ctx, 1, "A", "1f680")
+			require.Equal(t, test.wantErr, err != nil, "wantErr=%t, err=%v", test.wantErr, err)
+			require.Equal(t, test.want, got)
+			require.Equal(t, test.wantMsg, msg)
+			require.Equal(t, test.wantOffline, details.Offline())
+
+			// The cache on disk must match the cache in memory
+			reloaded, err := New(authDouble, path)
+			require.NoError(t, err)
+			require.Equal(t, test.wantGrants, c.Len())
+			require.Equal(t, test.wantGrants, reloaded.Len())
+		})
+	}
+}
+
+func TestCacheRecordsMember(t *testing.T) {
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "1f680").Run(func(args mock.Arguments) {
+		auth.DetailsFrom(args.Get(0).(context.Context)).SetMember(7, "Bracken")
+	}).Return(true, "Welcome back Bracken", nil).Once()
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "1f680").Return(false, "", errors.New("timeout")).Once()
+
+	c, err := New(authDouble, filepath.Join(t.TempDir(), "cache.json"))
+	require.NoError(t, err)
+
+	_, _, err = c.Allowed(context.Background(), 1, "A", "1f680")
+	require.NoError(t, err)
+
+	ctx, details := auth.WithDetails(context.Background())
+	allowed, _, err := c.Allowed(ctx, 1, "A", "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+	id, name := details.Member()
+	require.Equal(t, int32(7), id)
+	require.Equal(t, "Bracken", name)
+}
+
+func TestCacheTimeout(t *testing.T) {
+	authDouble := &testAuth{}
+	authDouble.Test(t)
+	authDouble.On("Allowed", mock.Anything, int32(1), "A", "1f680").Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(false, "", context.DeadlineExceeded)
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, atomicfile.WriteJSON(path, []Grant{{Tag: "1f680", Door: 1, Side: "A", Message: "Hi", Expires: time.Now().Add(time.Hour)}}))
+	c, err := New(authDouble, path)
+	require.NoError(t, err)
+	c.Timeout = 50 * time.Millisecond
+
+	t.Run("wrapped authorizer times out", func(t *testing.T) {
+		allowed, _, err := c.Allowed(context.Background(), 1, "A", "1f680")
+		require.NoError(t, err)
+		require.True(t, allowed)
+	})
+
+	t.Run("attempt cancelled by guard", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		allowed, _, err := c.Allowed(ctx, 1, "A", "1f680")
+		require.Error(t, err)
+		require.False(t, allowed)
+	})
+}
+
+func TestNewBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, atomicfile.WriteJSON(path, "not grants"))
+	_, err := New(&testAuth{}, path)
+	require.Error(t, err)
+}
+
+type testAuth struct {
+	mock.Mock
+}
+
+func (a *testAuth) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	args := a.Called(ctx, door, side, id)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
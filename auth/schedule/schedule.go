@@ -0,0 +1,347 @@
+// schedule is an Authorizer wrapper that restricts doors to weekly opening
+// hours, with exceptions for particular dates such as holidays.
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+)
+
+const (
+	// CheckBefore checks the schedule before asking the wrapped Authorizer,
+	// attempts outside the schedule never reach it.
+	CheckBefore = "before"
+	// CheckAfter asks the wrapped Authorizer first, so every attempt is
+	// recorded by it, and then applies the schedule to any grant.
+	CheckAfter = "after"
+
+	dateLayout = "2006-01-02"
+	minsPerDay = 24 * 60
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// File is the format of a schedule file, eg:
+//
+//	{
+//	  "timezone": "Europe/London",
+//	  "doors": [{
+//	    "door": 2,
+//	    "windows": [{"days": ["mon", "tue", "wed", "thu"], "from": "18:00", "to": "22:00"}],
+//	    "exceptions": [{"date": "2026-12-25"}]
+//	  }]
+//	}
+type File struct {
+	// Timezone is the IANA name of the time zone the schedule is written in,
+	// the default is the local time zone.
+	Timezone string    `json:"timezone"`
+	Doors    []DoorDef `json:"doors"`
+}
+
+// DoorDef is the schedule of one door
+type DoorDef struct {
+	Door int32 `json:"door"`
+	// Side is the side this schedule applies to, empty for both sides
+	Side string `json:"side"`
+	// Check is CheckBefore or CheckAfter, the default is CheckBefore
+	Check      string      `json:"check"`
+	Windows    []WindowDef `json:"windows"`
+	Exceptions []Exception `json:"exceptions"`
+}
+
+// WindowDef is a period when a door is open. If To is before From the window
+// ends on the following day. "24:00" may be used for the end of the day.
+type WindowDef struct {
+	// Days are lower case three letter day names, eg "mon", it is ignored in
+	// an Exception.
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+// Exception replaces the weekly windows of a door on one date, the door is
+// closed all day if it has no windows.
+type Exception struct {
+	// Date is in the form "2006-01-02"
+	Date    string      `json:"date"`
+	Windows []WindowDef `json:"windows"`
+}
+
+// Schedule is a parsed schedule file
+type Schedule struct {
+	// Location is the time zone the schedule is evaluated in
+	Location *time.Location
+
+	doors []door
+}
+
+type door struct {
+	id         int32
+	side       string
+	check      string
+	windows    []window
+	exceptions map[string][]window
+}
+
+type window struct {
+	days     [7]bool
+	from, to int // minutes since midnight
+}
+
+// Load reads and parses a schedule file
+func Load(path string) (*Schedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule: %w", err)
+	}
+	return Parse(f)
+}
+
+// Parse validates a File and returns its Schedule
+func Parse(f File) (*Schedule, error) {
+	s := &Schedule{Location: time.Local}
+	if f.Timezone != "" {
+		loc, err := time.LoadLocation(f.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+		s.Location = loc
+	}
+
+	for i, def := range f.Doors {
+		d := door{
+			id:         def.Door,
+			side:       def.Side,
+			check:      def.Check,
+			exceptions: make(map[string][]window),
+		}
+		if d.check == "" {
+			d.check = CheckBefore
+		}
+		if d.check != CheckBefore && d.check != CheckAfter {
+			return nil, fmt.Errorf("door %d (entry %d): check must be %q or %q", def.Door, i, CheckBefore, CheckAfter)
+		}
+		for _, w := range def.Windows {
+			pw, err := parseWindow(w, true)
+			if err != nil {
+				return nil, fmt.Errorf("door %d (entry %d): %w", def.Door, i, err)
+			}
+			d.windows = append(d.windows, pw)
+		}
+		for _, e := range def.Exceptions {
+			date, err := time.Parse(dateLayout, e.Date)
+			if err != nil {
+				return nil, fmt.Errorf("door %d (entry %d): invalid exception date: %w", def.Door, i, err)
+			}
+			windows := []window{}
+			for _, w := range e.Windows {
+				pw, err := parseWindow(w, false)
+				if err != nil {
+					return nil, fmt.Errorf("door %d (entry %d) exception %s: %w", def.Door, i, e.Date, err)
+				}
+				pw.days[date.Weekday()] = true
+				windows = append(windows, pw)
+			}
+			d.exceptions[e.Date] = windows
+		}
+		s.doors = append(s.doors, d)
+	}
+	return s, nil
+}
+
+func parseWindow(w WindowDef, needDays bool) (window, error) {
+	var pw window
+	if needDays && len(w.Days) == 0 {
+		return pw, fmt.Errorf("window %s-%s has no days", w.From, w.To)
+	}
+	for _, name := range w.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return pw, fmt.Errorf("invalid day %q", name)
+		}
+		pw.days[day] = true
+	}
+	var err error
+	if pw.from, err = parseTime(w.From); err != nil {
+		return pw, err
+	}
+	if pw.to, err = parseTime(w.To); err != nil {
+		return pw, err
+	}
+	if pw.from == pw.to {
+		return pw, fmt.Errorf("window %s-%s is empty", w.From, w.To)
+	}
+	return pw, nil
+}
+
+func parseTime(s string) (int, error) {
+	if s == "24:00" {
+		return minsPerDay, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Open reports whether door side is open at t, doors without a schedule are
+// always open.
+func (s *Schedule) Open(doorID int32, side string, t time.Time) bool {
+	d, ok := s.door(doorID, side)
+	if !ok {
+		return true
+	}
+	return d.open(t.In(s.Location))
+}
+
+// Within reports whether door side has a schedule that is open at t, unlike
+// Open doors without a schedule are never within it. It is for schedules of
+// when a door is held unlocked.
+func (s *Schedule) Within(doorID int32, side string, t time.Time) bool {
+	d, ok := s.door(doorID, side)
+	return ok && d.open(t.In(s.Location))
+}
+
+// door returns the schedule for a door side, a schedule for the side is
+// preferred to one for both sides.
+func (s *Schedule) door(id int32, side string) (door, bool) {
+	var found door
+	ok := false
+	for _, d := range s.doors {
+		if d.id != id {
+			continue
+		}
+		if d.side == side {
+			return d, true
+		}
+		if d.side == "" {
+			found, ok = d, true
+		}
+	}
+	return found, ok
+}
+
+// open checks t against today's windows and any of yesterday's windows that
+// run past midnight, t must be in the schedule's location.
+func (d door) open(t time.Time) bool {
+	mins := t.Hour()*60 + t.Minute()
+	for _, w := range d.on(t) {
+		if !w.days[t.Weekday()] {
+			continue
+		}
+		if w.from < w.to && mins >= w.from && mins < w.to {
+			return true
+		}
+		if w.from > w.to && mins >= w.from {
+			return true
+		}
+	}
+	yesterday := t.AddDate(0, 0, -1)
+	for _, w := range d.on(yesterday) {
+		if w.days[yesterday.Weekday()] && w.from > w.to && mins < w.to {
+			return true
+		}
+	}
+	return false
+}
+
+// on returns the windows that apply on the date of t
+func (d door) on(t time.Time) []window {
+	if windows, ok := d.exceptions[t.Format(dateLayout)]; ok {
+		return windows
+	}
+	return d.windows
+}
+
+// Authorizer denies access to doors outside their schedule
+type Authorizer struct {
+	auth     auth.Authorizer
+	schedule *Schedule
+	now      func() time.Time
+}
+
+// New returns an Authorizer applying s to a
+func New(a auth.Authorizer, s *Schedule) *Authorizer {
+	return &Authorizer{
+		auth:     a,
+		schedule: s,
+		now:      time.Now,
+	}
+}
+
+func (a *Authorizer) Allowed(ctx context.Context, doorID int32, side, id string) (allowed bool, message string, err error) {
+	return a.schedule.check(ctx, a.now, doorID, side, func() (bool, string, error) {
+		return a.auth.Allowed(ctx, doorID, side, id)
+	})
+}
+
+// PINAuthorizer denies PINs at doors outside their schedule, the same as
+// Authorizer does for tags
+type PINAuthorizer struct {
+	auth     auth.PINAuthorizer
+	schedule *Schedule
+	now      func() time.Time
+}
+
+// NewPINs returns a PINAuthorizer applying s to p
+func NewPINs(p auth.PINAuthorizer, s *Schedule) *PINAuthorizer {
+	return &PINAuthorizer{
+		auth:     p,
+		schedule: s,
+		now:      time.Now,
+	}
+}
+
+func (p *PINAuthorizer) AllowedPIN(ctx context.Context, doorID int32, side, pin string) (allowed bool, message string, err error) {
+	return p.schedule.check(ctx, p.now, doorID, side, func() (bool, string, error) {
+		return p.auth.AllowedPIN(ctx, doorID, side, pin)
+	})
+}
+
+// check applies the schedule of door side to the decision of ask
+func (s *Schedule) check(ctx context.Context, now func() time.Time, doorID int32, side string, ask func() (bool, string, error)) (bool, string, error) {
+	d, ok := s.door(doorID, side)
+	if !ok {
+		return ask()
+	}
+
+	if d.check == CheckBefore && !d.open(now().In(s.Location)) {
+		return closed(ctx)
+	}
+	allowed, message, err := ask()
+	if err != nil || !allowed {
+		return allowed, message, err
+	}
+	// The time is taken again as the wrapped Authorizer may be slow
+	if !d.open(now().In(s.Location)) {
+		return closed(ctx)
+	}
+	return true, message, nil
+}
+
+// closed denies access outside of opening hours
+func closed(ctx context.Context) (bool, string, error) {
+	details := auth.DetailsFrom(ctx)
+	details.SetReason(auth.Closed)
+	details.SetUncacheable()
+	return false, "Door closed at this time", nil
+}
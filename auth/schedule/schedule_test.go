@@ -0,0 +1,233 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ auth.Authorizer    = &Authorizer{}
+	_ auth.PINAuthorizer = &PINAuthorizer{}
+)
+
+var testFile = File{
+	Timezone: "Europe/London",
+	Doors: []DoorDef{
+		{
+			Door: 2,
+			Windows: []WindowDef{
+				{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:30"},
+				{Days: []string{"sat"}, From: "22:00", To: "02:00"},
+			},
+			Exceptions: []Exception{
+				{Date: "2026-12-25"},
+				{Date: "2026-12-24", Windows: []WindowDef{{From: "09:00", To: "12:00"}}},
+			},
+		},
+		{
+			Door:    2,
+			Side:    "B",
+			Check:   CheckAfter,
+			Windows: []WindowDef{{Days: []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}, From: "00:00", To: "24:00"}},
+		},
+	},
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Parse(testFile)
+	require.NoError(t, err)
+
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		door int32
+		side string
+		at   time.Time
+		want bool
+	}{
+		"unscheduled door": {door: 1, side: "A", at: time.Date(2026, 10, 17, 3, 0, 0, 0, london), want: true},
+		"weekday open":     {door: 2, side: "A", at: time.Date(2026, 10, 16, 9, 0, 0, 0, london), want: true},
+		"weekday closed":   {door: 2, side: "A", at: time.Date(2026, 10, 16, 17, 30, 0, 0, london)},
+		"weekend closed":   {door: 2, side: "A", at: time.Date(2026, 10, 18, 12, 0, 0, 0, london)},
+		"overnight start":  {door: 2, side: "A", at: time.Date(2026, 10, 17, 23, 0, 0, 0, london), want: true},
+		"overnight end":    {door: 2, side: "A", at: time.Date(2026, 10, 18, 1, 59, 0, 0, london), want: true},
+		"after overnight":  {door: 2, side: "A", at: time.Date(2026, 10, 18, 2, 0, 0, 0, london)},
+		"holiday":          {door: 2, side: "A", at: time.Date(2026, 12, 25, 10, 0, 0, 0, london)},
+		"short day open":   {door: 2, side: "A", at: time.Date(2026, 12, 24, 11, 0, 0, 0, london), want: true},
+		"short day closed": {door: 2, side: "A", at: time.Date(2026, 12, 24, 13, 0, 0, 0, london)},
+		"side schedule":    {door: 2, side: "B", at: time.Date(2026, 12, 25, 10, 0, 0, 0, london), want: true},
+		"time zone":        {door: 2, side: "A", at: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC), want: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, s.Open(test.door, test.side, test.at))
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	s, err := Parse(testFile)
+	require.NoError(t, err)
+
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+	require.False(t, s.Within(1, "", time.Date(2026, 10, 17, 3, 0, 0, 0, london)), "unscheduled door")
+	require.True(t, s.Within(2, "", time.Date(2026, 10, 16, 9, 0, 0, 0, london)))
+	require.False(t, s.Within(2, "", time.Date(2026, 10, 16, 17, 30, 0, 0, london)))
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, f := range map[string]File{
+		"bad timezone": {Timezone: "Mars/Olympus_Mons"},
+		"bad check":    {Doors: []DoorDef{{Door: 1, Check: "during"}}},
+		"bad day":      {Doors: []DoorDef{{Door: 1, Windows: []WindowDef{{Days: []string{"someday"}, From: "09:00", To: "10:00"}}}}},
+		"no days":      {Doors: []DoorDef{{Door: 1, Windows: []WindowDef{{From: "09:00", To: "10:00"}}}}},
+		"bad time":     {Doors: []DoorDef{{Door: 1, Windows: []WindowDef{{Days: []string{"mon"}, From: "9am", To: "10:00"}}}}},
+		"empty window": {Doors: []DoorDef{{Door: 1, Windows: []WindowDef{{Days: []string{"mon"}, From: "10:00", To: "10:00"}}}}},
+		"bad date":     {Doors: []DoorDef{{Door: 1, Exceptions: []Exception{{Date: "25/12/2026"}}}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(f)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	data, err := json.Marshal(testFile)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	s, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, "Europe/London", s.Location.String())
+	require.Len(t, s.doors, 2)
+}
+
+func TestAuthorizer(t *testing.T) {
+	s, err := Parse(testFile)
+	require.NoError(t, err)
+	open := time.Date(2026, 10, 16, 10, 0, 0, 0, s.Location)
+	closed := time.Date(2026, 12, 25, 10, 0, 0, 0, s.Location)
+
+	for name, test := range map[string]struct {
+		side     string
+		at       time.Time
+		allow    bool
+		wantCall bool
+		want     bool
+	}{
+		"open":                  {side: "A", at: open, allow: true, wantCall: true, want: true},
+		"open but denied":       {side: "A", at: open, wantCall: true},
+		"closed checked before": {side: "A", at: closed, allow: true},
+		"side checked after":    {side: "B", at: time.Date(2026, 10, 16, 10, 0, 0, 0, s.Location), allow: true, wantCall: true, want: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authDouble := &testAuth{}
+			authDouble.Test(t)
+			defer authDouble.AssertExpectations(t)
+			if test.wantCall {
+				authDouble.On("Allowed", mock.Anything, int32(2), test.side, "1f680").Return(test.allow, "hi", nil).Once()
+			}
+
+			a := New(authDouble, s)
+			a.now = func() time.Time { return test.at }
+			got, _, err := a.Allowed(context.Background(), 2, test.side, "1f680")
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+
+	t.Run("closed checked after still asks", func(t *testing.T) {
+		s, err := Parse(File{Doors: []DoorDef{{Door: 3, Check: CheckAfter, Exceptions: []Exception{{Date: "2026-12-25"}}}}})
+		require.NoError(t, err)
+		authDouble := &testAuth{}
+		authDouble.Test(t)
+		defer authDouble.AssertExpectations(t)
+		authDouble.On("Allowed", mock.Anything, int32(3), "A", "1f680").Return(true, "hi", nil).Once()
+
+		a := New(authDouble, s)
+		a.now = func() time.Time { return time.Date(2026, 12, 25, 10, 0, 0, 0, time.Local) }
+		ctx, details := auth.WithDetails(context.Background())
+		got, msg, err := a.Allowed(ctx, 3, "A", "1f680")
+		require.NoError(t, err)
+		require.False(t, got)
+		require.Equal(t, "Door closed at this time", msg)
+		require.Equal(t, auth.Closed, details.Decision().Reason)
+	})
+}
+
+func TestPINAuthorizer(t *testing.T) {
+	s, err := Parse(testFile)
+	require.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		door     int32
+		at       time.Time
+		wantCall bool
+		want     bool
+	}{
+		"open":                  {door: 2, at: time.Date(2026, 10, 16, 10, 0, 0, 0, s.Location), wantCall: true, want: true},
+		"closed checked before": {door: 2, at: time.Date(2026, 12, 25, 10, 0, 0, 0, s.Location)},
+		"unscheduled door":      {door: 1, at: time.Date(2026, 12, 25, 10, 0, 0, 0, s.Location), wantCall: true, want: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			authDouble := &testAuth{}
+			authDouble.Test(t)
+			defer authDouble.AssertExpectations(t)
+			if test.wantCall {
+				authDouble.On("AllowedPIN", mock.Anything, test.door, "A", "1234").Return(true, "hi", nil).Once()
+			}
+
+			p := NewPINs(authDouble, s)
+			p.now = func() time.Time { return test.at }
+			ctx, details := auth.WithDetails(context.Background())
+			got, msg, err := p.AllowedPIN(ctx, test.door, "A", "1234")
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+			if !test.want {
+				require.Equal(t, "Door closed at this time", msg)
+				require.Equal(t, auth.Closed, details.Decision().Reason)
+			}
+		})
+	}
+
+	t.Run("closed checked after still asks", func(t *testing.T) {
+		s, err := Parse(File{Doors: []DoorDef{{Door: 3, Check: CheckAfter, Exceptions: []Exception{{Date: "2026-12-25"}}}}})
+		require.NoError(t, err)
+		authDouble := &testAuth{}
+		authDouble.Test(t)
+		defer authDouble.AssertExpectations(t)
+		authDouble.On("AllowedPIN", mock.Anything, int32(3), "A", "1234").Return(true, "hi", nil).Once()
+
+		p := NewPINs(authDouble, s)
+		p.now = func() time.Time { return time.Date(2026, 12, 25, 10, 0, 0, 0, time.Local) }
+		got, msg, err := p.AllowedPIN(context.Background(), 3, "A", "1234")
+		require.NoError(t, err)
+		require.False(t, got)
+		require.Equal(t, "Door closed at this time", msg)
+	})
+}
+
+type testAuth struct {
+	mock.Mock
+}
+
+func (a *testAuth) Allowed(ctx context.Context, door int32, side, id string) (bool, string, error) {
+	args := a.Called(ctx, door, side, id)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
+
+func (a *testAuth) AllowedPIN(ctx context.Context, door int32, side, pin string) (bool, string, error) {
+	args := a.Called(ctx, door, side, pin)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
@@ -25,16 +25,16 @@ func (s *Static) Allowed(ctx context.Context, door int32, side, id string) (allo
 	return false, "Be gone, stranger.", nil
 }
 
-func (s *Static) CheckPIN(ctx context.Context, door int32, side, pin string) (string, error) {
+func (s *Static) AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error) {
 	select {
 	case <-time.After(s.Delay):
 	case <-ctx.Done():
-		return "", ctx.Err()
+		return false, "", ctx.Err()
 	}
 	for _, a := range s.Allow {
 		if a == pin {
-			return "Pin was good", nil
+			return true, "Pin was good", nil
 		}
 	}
-	return "Pin was bad", nil
+	return false, "Pin was bad", nil
 }
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"sync"
+)
+
+// Swap is an Authorizer that passes every attempt to another Authorizer, which
+// can be replaced while Swap is in use. Attempts already in progress finish
+// with the Authorizer they started with.
+type Swap struct {
+	mux  sync.RWMutex
+	auth Authorizer
+}
+
+// NewSwap returns a Swap that starts by passing attempts to a
+func NewSwap(a Authorizer) *Swap {
+	return &Swap{auth: a}
+}
+
+// Set replaces the Authorizer used for new attempts
+func (s *Swap) Set(a Authorizer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.auth = a
+}
+
+// Allowed asks the current Authorizer
+func (s *Swap) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
+	s.mux.RLock()
+	a := s.auth
+	s.mux.RUnlock()
+	return a.Allowed(ctx, door, side, id)
+}
+
+// PINSwap is the equivalent of Swap for PINAuthorizers
+type PINSwap struct {
+	mux  sync.RWMutex
+	auth PINAuthorizer
+}
+
+// NewPINSwap returns a PINSwap that starts by passing attempts to p
+func NewPINSwap(p PINAuthorizer) *PINSwap {
+	return &PINSwap{auth: p}
+}
+
+// Set replaces the PINAuthorizer used for new attempts
+func (s *PINSwap) Set(p PINAuthorizer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.auth = p
+}
+
+// AllowedPIN asks the current PINAuthorizer
+func (s *PINSwap) AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error) {
+	s.mux.RLock()
+	p := s.auth
+	s.mux.RUnlock()
+	return p.AllowedPIN(ctx, door, side, pin)
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type staticAuthorizer bool
+
+func (s staticAuthorizer) Allowed(context.Context, int32, string, string) (bool, string, error) {
+	return bool(s), "", nil
+}
+
+func TestSwap(t *testing.T) {
+	s := NewSwap(staticAuthorizer(false))
+	allowed, _, err := s.Allowed(context.Background(), 1, "A", "1f680")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = s.Allowed(context.Background(), 1, "A", "1f680")
+		}()
+	}
+	s.Set(staticAuthorizer(true))
+	wg.Wait()
+
+	allowed, _, err = s.Allowed(context.Background(), 1, "A", "1f680")
+	require.NoError(t, err)
+	require.True(t, allowed)
+}
+
+func (s staticAuthorizer) AllowedPIN(context.Context, int32, string, string) (bool, string, error) {
+	return bool(s), "", nil
+}
+
+func TestPINSwap(t *testing.T) {
+	s := NewPINSwap(staticAuthorizer(false))
+	allowed, _, err := s.AllowedPIN(context.Background(), 1, "A", "1234")
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	s.Set(staticAuthorizer(true))
+	allowed, _, err = s.AllowedPIN(context.Background(), 1, "A", "1234")
+	require.NoError(t, err)
+	require.True(t, allowed)
+}
@@ -1,27 +1,45 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
 	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/admitter/buzzer"
+	"github.com/somakeit/door-controller3/admitter/console"
 	"github.com/somakeit/door-controller3/admitter/led"
+	"github.com/somakeit/door-controller3/admitter/rgb"
+	"github.com/somakeit/door-controller3/admitter/sensor"
 	"github.com/somakeit/door-controller3/admitter/strike"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/auth/chain"
 	"github.com/somakeit/door-controller3/auth/hms"
+	"github.com/somakeit/door-controller3/auth/lockout"
+	"github.com/somakeit/door-controller3/auth/offline"
+	"github.com/somakeit/door-controller3/auth/schedule"
+	"github.com/somakeit/door-controller3/config"
 	"github.com/somakeit/door-controller3/contextlogger"
 	"github.com/somakeit/door-controller3/guard"
+	"github.com/somakeit/door-controller3/guard/button"
 	"github.com/somakeit/door-controller3/guard/nfc"
 	"github.com/somakeit/door-controller3/guard/pin"
+	"github.com/somakeit/door-controller3/guard/twofactor"
 	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
 	"periph.io/x/conn/v3/spi/spireg"
 	"periph.io/x/devices/v3/mfrc522"
 	"periph.io/x/host/v3"
-	"periph.io/x/host/v3/rpi"
 )
 
 func main() {
@@ -30,7 +48,7 @@ func main() {
 		fmt.Println("doord is an NFC door controller for So Make It.")
 		flag.PrintDefaults()
 		fmt.Print(`
-Required raspberry pi pins:
+Default raspberry pi pins:
   1  - MFRC522_3V3
   6  - MFRC522_Ground
   15 - Door strike/latch
@@ -43,44 +61,23 @@ Required raspberry pi pins:
   24 - MFRC522_SDA
 `)
 	}
-	door := flag.Int("door", 0, "Numeric door ID, eg: 1")
-	side := flag.String("side", "", "Door side, 'A' or 'B'")
-	dsn := flag.String("hms", "", "The DSN for the HMS mysql database as per the Go database/sql package, eg: 'username:password@(host)/database'")
-	openTime := flag.Int("opentime", 5, "Number of seconds to open the door for")
-	activeLow := flag.Bool("activelow", false, "Strike/latch logic level")
-	logFile := flag.String("logfile", "/var/log/doord/access.log", "Log file to use or - for STDOUT")
-	level := flag.String("loglevel", "info", "log level")
-	gain := flag.Int("gain", 5, "Antenna gain 0 to 7")
+	configFile := flag.String("config", "/etc/doord/doord.yaml", "Config file, see dist/etc/doord/doord.yaml for an example")
 	flag.Parse()
-	logLevel, err := logrus.ParseLevel(*level)
+	cfg, err := config.Load(*configFile)
 	if err != nil {
-		fmt.Println("Invalid log level: ", err)
-		flag.Usage()
-		os.Exit(2)
-	}
-	if *door <= 0 {
-		fmt.Println("Invalid door ID, a door ID greater than 0 must be provided")
-		flag.Usage()
-		os.Exit(2)
-	}
-	if *side != "A" && *side != "B" {
-		fmt.Println("Invalid side, a side of either 'A' or 'B' must be provided")
-		flag.Usage()
-		os.Exit(2)
-	}
-	if *gain < 0 || *gain > 7 {
-		fmt.Println("Invalid antenna gain, must be 0 to 7")
+		fmt.Println(err)
 		flag.Usage()
 		os.Exit(2)
 	}
 
 	log := logrus.StandardLogger()
-	log.Level = logLevel
+	// The level was validated with the config
+	log.Level, _ = logrus.ParseLevel(cfg.Log.Level)
 	log.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
-	if *logFile != "-" {
-		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if cfg.Log.File != "-" {
+		file, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			log.Fatal("Cannot open log file: ", err)
 		}
@@ -93,69 +90,666 @@ Required raspberry pi pins:
 		log.Fatal("Failed to init host: ", err)
 	}
 
-	spi, err := spireg.Open("")
+	strikePin, err := pinByName("strike.pin", cfg.Strike.Pin)
 	if err != nil {
-		log.Fatal("Failed to open SPI: ", err)
-	}
-
-	reader, err := mfrc522.NewSPI(spi, rpi.P1_22, rpi.P1_16)
-	if err != nil {
-		log.Fatal("Failed to init reader: ", err)
-	}
-	if err := reader.SetAntennaGain(*gain); err != nil {
-		log.Fatal("Failed to set antenna gain: ", err)
+		log.Fatal(err)
 	}
 
 	if err := mysql.SetLogger(log); err != nil {
 		log.Fatal("Failed to set mysql logger: ", err)
 	}
-	db, err := sql.Open("mysql", *dsn)
+	db, err := sql.Open("mysql", cfg.Authorizers.HMS)
 	if err != nil {
 		log.Fatal("Failed to open database: ", err)
 	}
 
 	ctxLog := &contextlogger.ContextLogger{Logger: log}
 	hms.Logger = ctxLog
+	offline.Logger = ctxLog
+	lockout.Logger = ctxLog
 	strike.Logger = ctxLog
+	admitter.Logger = ctxLog
 
-	auth, err := hms.NewClient(db)
+	client, err := hms.NewClient(db)
 	if err != nil {
 		log.Fatal("Failed to init hms:, ", err)
 	}
+	if cfg.Authorizers.ZoneOutbox != "" {
+		client.Outbox, err = hms.NewOutbox(client, cfg.Authorizers.ZoneOutbox)
+		if err != nil {
+			log.Fatal("Failed to init zone outbox: ", err)
+		}
+	}
+	var (
+		syncer   *hms.Syncer
+		snapshot auth.Authorizer
+	)
+	if cfg.Authorizers.Snapshot != "" {
+		syncer = hms.NewSyncer(db, cfg.Authorizers.Snapshot)
+		syncer.Interval = cfg.Authorizers.SyncInterval
+		snapshot = hms.NewSnapshotAuthorizer(cfg.Authorizers.Snapshot)
+	}
+
+	// The cache is kept across reloads so that only one Cache writes its file
+	var cache *offline.Cache
+	if cfg.Authorizers.Cache != "" {
+		cache, err = offline.New(client, cfg.Authorizers.Cache)
+		if err != nil {
+			log.Fatal("Failed to init offline cache: ", err)
+		}
+		cache.MaxAge = cfg.Authorizers.CacheMaxAge
+	}
+	// The lockout is kept across reloads so that reloading does not forgive
+	// anyone
+	locks := lockout.New()
+	authority, err := authorizers(cfg, client, cache, snapshot, locks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tags := auth.NewSwap(authority)
+	pinAuthority, err := pinAuthorizers(cfg, client, locks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pinAuth := auth.NewPINSwap(pinAuthority)
 
 	locked := gpio.Low
-	if *activeLow {
+	if cfg.Strike.ActiveLow {
 		locked = gpio.High
 	}
-	if err := rpi.P1_15.Out(locked); err != nil {
+	if err := strikePin.Out(locked); err != nil {
 		log.Fatal("Failed to pre-lock door: ", err)
 	}
 
-	doorStrike := strike.New(rpi.P1_15)
-	doorStrike.OpenFor = time.Duration(*openTime) * time.Second
-	if *activeLow {
+	doorStrike := strike.New(strikePin)
+	doorStrike.OpenFor = cfg.Strike.OpenTime
+	doorStrike.NoEntry = cfg.Strike.NoEntry
+	doorStrike.ToggleWithin = cfg.Strike.ToggleWithin
+	if cfg.Strike.ActiveLow {
 		doorStrike.Logic = strike.ActiveLow
 	}
+	doorStrike.Policy = strike.Policy(cfg.Strike.Policy)
+	// However doord stops the door is left as the policy says, fatal errors
+	// run the exit handler and panicking guards are returned as errors
+	logrus.RegisterExitHandler(func() {
+		if err := doorStrike.Fail(); err != nil {
+			log.Error(err)
+		}
+	})
+	// Every goroutine started from here on fails the door if it panics
+	defer doorStrike.FailOnPanic()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer doorStrike.FailOnPanic()
+		sig, err := doorStrike.FailOnSignal(stop)
+		if err != nil {
+			log.Error(err)
+		}
+		log.Infof("Stopping on %s, door left fail %s", sig, doorStrike.Policy)
+		os.Exit(0)
+	}()
+	if client.Outbox != nil {
+		go func() {
+			defer doorStrike.FailOnPanic()
+			client.Outbox.Run(context.Background())
+		}()
+	}
+	if syncer != nil {
+		go func() {
+			defer doorStrike.FailOnPanic()
+			syncer.Run(context.Background())
+		}()
+	}
+	doorStrike.SetKeyholders(cfg.Strike.Keyholders)
+	hours, err := strikeHours(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	doorStrike.SetHours(hours)
+	if cfg.Strike.ModeFile != "" {
+		if err := doorStrike.LoadMode(cfg.Strike.ModeFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	admitters := admitter.Mux{
-		doorStrike,
-		led.New(rpi.P1_18),
-		ctxLog,
+	var doorBuzzer *buzzer.Buzzer
+	if cfg.Buzzer.Pin != "" {
+		buzzerPin, err := pinByName("buzzer.pin", cfg.Buzzer.Pin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		doorBuzzer = buzzer.New(buzzerPin)
+		doorBuzzer.Passive = cfg.Buzzer.Passive
+		doorBuzzer.ActiveLow = cfg.Buzzer.ActiveLow
+		if err := doorBuzzer.SetTunes(cfg.Buzzer.Tunes); err != nil {
+			log.Fatal("buzzer.tunes: ", err)
+		}
+		quiet, err := buzzerQuiet(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		doorBuzzer.SetQuiet(quiet)
+		go func() {
+			defer doorStrike.FailOnPanic()
+			log.Error("Buzzer stopped: ", doorBuzzer.Run())
+		}()
 	}
 
-	strikeGuard, err := nfc.New(int32(*door), *side, reader, auth, admitters)
-	if err != nil {
-		log.Fatal("Failed to init guard: ", err)
+	var screen *console.Console
+	if cfg.Console.Enabled {
+		restore, err := console.Cbreak(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logrus.RegisterExitHandler(func() {
+			_ = restore()
+		})
+		screen = console.New(os.Stdout, os.Stdin)
+		screen.Title = cfg.Console.Title
+		screen.Width = cfg.Console.Width
+		screen.SetMessageTime(cfg.Console.MessageTime)
+		screen.Door = func() string { return describeStrike(doorStrike.State()) }
+		screen.Ping = db.PingContext
+		screen.PingInterval = cfg.Console.PingInterval
+	}
+	// pins is where PINs are typed, the console hides them as they are typed
+	pins := func() io.Reader {
+		if screen != nil {
+			return screen.PINs()
+		}
+		return os.Stdin
+	}
+
+	var (
+		guards     guard.Mux
+		doorSensor *sensor.Sensor
+		// zones moves members to their new zone once they are allowed, or
+		// when the door opens if there is a sensor
+		zones = client.Zones()
+	)
+	if cfg.Sensor.Pin != "" {
+		sensorPin, err := pinByName("sensor.pin", cfg.Sensor.Pin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Members are moved to their new zone when the door opens
+		client.DeferZones = true
+		events := admitter.Parallel{
+			{Name: "strike", Admitter: doorStrike, Critical: true},
+			{Name: "zones", Admitter: zones, Timeout: cfg.Guard.AdmitterTimeout},
+		}
+		if doorBuzzer != nil {
+			events = append(events, admitter.Member{Name: "buzzer", Admitter: doorBuzzer, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		if screen != nil {
+			events = append(events, admitter.Member{Name: "console", Admitter: screen, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		events = append(events, admitter.Member{Name: "log", Admitter: ctxLog, Timeout: cfg.Guard.AdmitterTimeout})
+		doorSensor, err = sensor.New(cfg.Door, sensorPin, cfg.Sensor.ActiveLow, events)
+		if err != nil {
+			log.Fatal("Failed to init door sensor: ", err)
+		}
+		doorSensor.Debounce = cfg.Sensor.Debounce
+		doorSensor.Unlocked = func() bool { return doorStrike.State().Unlocked }
+		doorSensor.SetTimes(cfg.Strike.OpenTime, cfg.Sensor.HeldOpen)
+		guards = append(guards, doorSensor)
 	}
 
 	pin.Logger = ctxLog
-	pinGuard := pin.New(os.Stdin, auth, int32(*door), *side)
+	limits, err := twoFactorLimits(cfg, locks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var (
+		sides       []*side
+		setTimeouts []func(config.Guard)
+		setLimits   []func(twofactor.Limits)
+	)
+	for i, sideCfg := range cfg.Sides {
+		field := fmt.Sprintf("sides[%d]", i)
+		s, err := newSide(field, sideCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sides = append(sides, s)
+		if s.led != nil {
+			go func(l *led.LED) {
+				defer doorStrike.FailOnPanic()
+				l.Run()
+			}(s.led)
+		}
+		if s.rgb != nil {
+			go func(field string, r *rgb.RGB) {
+				defer doorStrike.FailOnPanic()
+				log.Errorf("%s.rgb stopped: %v", field, r.Run())
+			}(field, s.rgb)
+		}
+
+		// The strike and sensor are critical so that nothing else can stop
+		// the door opening
+		admitters := admitter.Parallel{{Name: "strike", Admitter: doorStrike, Critical: true}}
+		if doorSensor != nil {
+			admitters = append(admitters, admitter.Member{Name: "sensor", Admitter: doorSensor, Critical: true})
+		}
+		admitters = append(admitters, admitter.Member{Name: "zones", Admitter: zones, Timeout: cfg.Guard.AdmitterTimeout})
+		if s.led != nil {
+			admitters = append(admitters, admitter.Member{Name: "led", Admitter: s.led, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		if s.rgb != nil {
+			admitters = append(admitters, admitter.Member{Name: "rgb", Admitter: s.rgb, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		if doorBuzzer != nil {
+			admitters = append(admitters, admitter.Member{Name: "buzzer", Admitter: doorBuzzer, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		if screen != nil {
+			admitters = append(admitters, admitter.Member{Name: "console", Admitter: screen, Timeout: cfg.Guard.AdmitterTimeout})
+		}
+		admitters = append(admitters, admitter.Member{Name: "log", Admitter: ctxLog, Timeout: cfg.Guard.AdmitterTimeout})
+
+		if sideCfg.Button.Pin != "" {
+			buttonPin, err := pinByName(field+".button.pin", sideCfg.Button.Pin)
+			if err != nil {
+				log.Fatal(err)
+			}
+			exitButton, err := button.New(cfg.Door, sideCfg.Side, buttonPin, sideCfg.Button.ActiveLow, admitters)
+			if err != nil {
+				log.Fatalf("Failed to init %s exit button: %v", field, err)
+			}
+			exitButton.Debounce = sideCfg.Button.Debounce
+			guards = append(guards, exitButton)
+		}
+
+		if cfg.TwoFactor && sideCfg.PINPad {
+			// The tag and PIN are checked directly with HMS so that the
+			// members can be compared, offline fallbacks do not apply but the
+			// lockout and schedule do.
+			if screen != nil {
+				screen.Prompt = "Present your tag, then enter your PIN"
+			}
+			twoFactorGuard, err := twofactor.New(cfg.Door, sideCfg.Side, s.reader, pins(), client, admitters)
+			if err != nil {
+				log.Fatalf("Failed to init %s guard: %v", field, err)
+			}
+			setTimeouts = append(setTimeouts, func(t config.Guard) {
+				twoFactorGuard.SetTimeouts(t.ReadTimeout, t.AuthTimeout, t.PINTimeout)
+			})
+			twoFactorGuard.SetLimits(limits)
+			setLimits = append(setLimits, twoFactorGuard.SetLimits)
+			guards = append(guards, twoFactorGuard)
+			continue
+		}
+
+		strikeGuard, err := nfc.New(cfg.Door, sideCfg.Side, s.reader, auth.Decide(tags), admitters)
+		if err != nil {
+			log.Fatalf("Failed to init %s guard: %v", field, err)
+		}
+		setTimeouts = append(setTimeouts, func(t config.Guard) {
+			strikeGuard.SetTimeouts(t.ReadTimeout, t.AuthTimeout, t.CancelTimeout)
+		})
+		guards = append(guards, strikeGuard)
 
-	g := guard.Mux{
-		strikeGuard,
-		pinGuard,
+		if sideCfg.PINPad {
+			pinGuard := pin.New(pins(), pinAuth, cfg.Door, sideCfg.Side, admitters)
+			if screen != nil {
+				// The console shows the results
+				pinGuard.Out = ioutil.Discard
+				screen.Prompt = "Present your tag or enter your PIN"
+			}
+			guards = append(guards, pinGuard)
+		}
+	}
+	for _, set := range setTimeouts {
+		set(cfg.Guard)
+	}
+	if screen != nil {
+		go func() {
+			defer doorStrike.FailOnPanic()
+			log.Error("Console stopped: ", screen.Run())
+		}()
 	}
 
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	reload := func(next *config.Config) error {
+		for _, field := range cfg.RestartNeeded(next) {
+			log.Warnf("Config %s changed, restart doord to apply it", field)
+		}
+		// Everything that can fail is done before anything is changed
+		authority, err := authorizers(next, client, cache, snapshot, locks)
+		if err != nil {
+			return err
+		}
+		pinAuthority, err := pinAuthorizers(next, client, locks)
+		if err != nil {
+			return err
+		}
+		limits, err := twoFactorLimits(next, locks)
+		if err != nil {
+			return err
+		}
+		hours, err := strikeHours(next)
+		if err != nil {
+			return err
+		}
+		quiet, err := buzzerQuiet(next)
+		if err != nil {
+			return err
+		}
+		if err := buzzer.CheckTunes(next.Buzzer.Tunes); err != nil {
+			return fmt.Errorf("buzzer.tunes: %w", err)
+		}
+		if len(next.Sides) != len(sides) {
+			return fmt.Errorf("the number of sides changed from %d to %d", len(sides), len(next.Sides))
+		}
+		for i := range sides {
+			if err := checkLED(next.Sides[i].LED); err != nil {
+				return fmt.Errorf("sides[%d].led.%w", i, err)
+			}
+			if err := rgb.CheckColours(next.Sides[i].RGB.Colours); err != nil {
+				return fmt.Errorf("sides[%d].rgb.colours: %w", i, err)
+			}
+		}
+		tags.Set(authority)
+		pinAuth.Set(pinAuthority)
+		if cache != nil {
+			cache.SetMaxAge(next.Authorizers.CacheMaxAge)
+		}
+		for i, s := range sides {
+			// The LED and RGB config was checked above
+			if s.led != nil {
+				_ = setLED(s.led, next.Sides[i].LED)
+			}
+			if s.rgb != nil {
+				_ = s.rgb.SetColours(next.Sides[i].RGB.Colours)
+			}
+		}
+		doorStrike.SetOpenFor(next.Strike.OpenTime)
+		doorStrike.SetNoEntry(next.Strike.NoEntry)
+		doorStrike.SetToggleWithin(next.Strike.ToggleWithin)
+		doorStrike.SetKeyholders(next.Strike.Keyholders)
+		doorStrike.SetHours(hours)
+		if screen != nil {
+			screen.SetMessageTime(next.Console.MessageTime)
+		}
+		if doorBuzzer != nil {
+			// The tunes were checked above
+			_ = doorBuzzer.SetTunes(next.Buzzer.Tunes)
+			doorBuzzer.SetQuiet(quiet)
+		}
+		if doorSensor != nil {
+			doorSensor.SetTimes(next.Strike.OpenTime, next.Sensor.HeldOpen)
+		}
+		for _, set := range setTimeouts {
+			set(next.Guard)
+		}
+		for _, set := range setLimits {
+			set(limits)
+		}
+		level, _ := logrus.ParseLevel(next.Log.Level)
+		log.SetLevel(level)
+		// Later reloads are compared with what is running now
+		cfg = next
+		return nil
+	}
+	go func() {
+		defer doorStrike.FailOnPanic()
+		reloadOnHangup(hangup, *configFile, log, reload)
+	}()
+
 	log.Info("Ready")
-	log.Fatal(g.Guard())
+	log.Fatal(guards.Guard())
+}
+
+// side is the hardware on one side of the door, either status light may be
+// nil
+type side struct {
+	reader *mfrc522.Dev
+	led    *led.LED
+	rgb    *rgb.RGB
+}
+
+// newSide opens the reader and status lights of cfg, field is the config field
+// it came from. The RGB is not yet running.
+func newSide(field string, cfg config.Side) (*side, error) {
+	resetPin, err := pinByName(field+".reader.reset", cfg.Reader.Reset)
+	if err != nil {
+		return nil, err
+	}
+	irqPin, err := pinByName(field+".reader.irq", cfg.Reader.IRQ)
+	if err != nil {
+		return nil, err
+	}
+	spi, err := spireg.Open(cfg.Reader.SPI)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to open SPI: %w", field, err)
+	}
+	reader, err := mfrc522.NewSPI(spi, resetPin, irqPin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to init reader: %w", field, err)
+	}
+	if err := reader.SetAntennaGain(cfg.Reader.Gain); err != nil {
+		return nil, fmt.Errorf("%s: failed to set antenna gain: %w", field, err)
+	}
+
+	s := &side{reader: reader}
+	if cfg.LED.Pin != "" {
+		ledPin, err := pinByName(field+".led.pin", cfg.LED.Pin)
+		if err != nil {
+			return nil, err
+		}
+		s.led = led.New(ledPin)
+		if err := setLED(s.led, cfg.LED); err != nil {
+			return nil, fmt.Errorf("%s: failed to set LED %w", field, err)
+		}
+	}
+	if cfg.RGB.Red != "" {
+		if s.rgb, err = newRGB(field+".rgb", cfg.RGB); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newRGB returns the RGB described by cfg, field is the config field it came
+// from
+func newRGB(field string, cfg config.RGB) (*rgb.RGB, error) {
+	red, err := pinByName(field+".red", cfg.Red)
+	if err != nil {
+		return nil, err
+	}
+	green, err := pinByName(field+".green", cfg.Green)
+	if err != nil {
+		return nil, err
+	}
+	blue, err := pinByName(field+".blue", cfg.Blue)
+	if err != nil {
+		return nil, err
+	}
+
+	r := rgb.New(red, green, blue)
+	r.Frequency = physic.Frequency(cfg.Frequency) * physic.Hertz
+	r.Fade = cfg.Fade
+	r.ActiveLow = cfg.ActiveLow
+	if err := r.SetColours(cfg.Colours); err != nil {
+		return nil, fmt.Errorf("%s.colours: %w", field, err)
+	}
+	return r, nil
+}
+
+// checkLED returns an error naming the field if cfg cannot be used with
+// setLED
+func checkLED(cfg config.LED) error {
+	if err := led.CheckRates(cfg.Rates); err != nil {
+		return fmt.Errorf("rates: %w", err)
+	}
+	if err := led.CheckPatterns(cfg.Patterns); err != nil {
+		return fmt.Errorf("patterns: %w", err)
+	}
+	if err := led.CheckReasons(cfg.Reasons); err != nil {
+		return fmt.Errorf("reasons: %w", err)
+	}
+	return nil
+}
+
+// setLED applies the blink patterns and deny reasons of cfg to l, patterns
+// take precedence over rates. Nothing is changed if cfg is invalid.
+func setLED(l *led.LED, cfg config.LED) error {
+	if err := checkLED(cfg); err != nil {
+		return err
+	}
+	// Checked above
+	_ = l.SetRates(cfg.Rates)
+	_ = l.SetPatterns(cfg.Patterns)
+	_ = l.SetReasons(cfg.Reasons)
+	return nil
+}
+
+// authorizers returns the tag Authorizer described by cfg, cache and snapshot
+// are nil if there are none.
+func authorizers(cfg *config.Config, client *hms.Client, cache *offline.Cache, snapshot auth.Authorizer, locks *lockout.Lockout) (auth.Authorizer, error) {
+	var authority auth.Authorizer = client
+	if cache != nil {
+		authority = cache
+	}
+	if snapshot != nil {
+		authority = chain.Fallback{
+			{Name: "hms", Authorizer: authority},
+			{Name: "snapshot", Authorizer: snapshot},
+		}
+	}
+
+	authority = locks.Tags(authority)
+	// Outside the lockout so that trying a closed door is not a failure
+	hours, err := openingHours(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if hours != nil {
+		authority = schedule.New(authority, hours)
+	}
+	return authority, nil
+}
+
+// twoFactorLimits returns the lockout and schedule of cfg for two factor
+// guards, wrapped around each factor as authorizers does for other guards.
+func twoFactorLimits(cfg *config.Config, locks *lockout.Lockout) (twofactor.Limits, error) {
+	hours, err := openingHours(cfg)
+	if err != nil {
+		return twofactor.Limits{}, err
+	}
+	return twofactor.Limits{
+		Tags: func(a auth.Authorizer) auth.Authorizer {
+			a = locks.Tags(a)
+			if hours != nil {
+				a = schedule.New(a, hours)
+			}
+			return a
+		},
+		PINs: func(p auth.PINAuthorizer) auth.PINAuthorizer {
+			p = locks.PINs(p)
+			if hours != nil {
+				p = schedule.NewPINs(p, hours)
+			}
+			return p
+		},
+	}, nil
+}
+
+// pinAuthorizers returns the PINAuthorizer of cfg for PIN guards, with the
+// lockout and schedule as for tags
+func pinAuthorizers(cfg *config.Config, client *hms.Client, locks *lockout.Lockout) (auth.PINAuthorizer, error) {
+	var authority auth.PINAuthorizer = locks.PINs(client)
+	// Outside the lockout so that trying a closed door is not a failure
+	hours, err := openingHours(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if hours != nil {
+		authority = schedule.NewPINs(authority, hours)
+	}
+	return authority, nil
+}
+
+// openingHours returns the schedule of doors in cfg, nil if there is none
+func openingHours(cfg *config.Config) (*schedule.Schedule, error) {
+	if cfg.Authorizers.Schedule == "" {
+		return nil, nil
+	}
+	hours, err := schedule.Load(cfg.Authorizers.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schedule: %w", err)
+	}
+	return hours, nil
+}
+
+// strikeHours returns the hours the strike is held unlocked for in cfg, nil if
+// there are none.
+func strikeHours(cfg *config.Config) (strike.Hours, error) {
+	if cfg.Strike.Hours == "" {
+		return nil, nil
+	}
+	hours, err := schedule.Load(cfg.Strike.Hours)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load strike hours: %w", err)
+	}
+	door := cfg.Door
+	return func(t time.Time) bool { return hours.Within(door, "", t) }, nil
+}
+
+// describeStrike describes state for the console
+func describeStrike(state strike.State) string {
+	switch {
+	case !state.Unlocked:
+		return "locked"
+	case state.Until.IsZero():
+		return fmt.Sprintf("unlocked (%s)", state.Mode)
+	}
+	left := time.Until(state.Until).Round(time.Second)
+	if left <= 0 {
+		return "unlocked"
+	}
+	return fmt.Sprintf("unlocked for %s", left)
+}
+
+// buzzerQuiet returns the quiet hours of the buzzer in cfg, nil if there are
+// none.
+func buzzerQuiet(cfg *config.Config) (buzzer.Hours, error) {
+	if cfg.Buzzer.Quiet == "" {
+		return nil, nil
+	}
+	hours, err := schedule.Load(cfg.Buzzer.Quiet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load buzzer quiet hours: %w", err)
+	}
+	door := cfg.Door
+	return func(t time.Time) bool { return hours.Within(door, "", t) }, nil
+}
+
+// reloadOnHangup calls reload with the config file at path every time a signal
+// is received on hangup. The running config is kept if the file or reload
+// fail.
+func reloadOnHangup(hangup <-chan os.Signal, path string, log *logrus.Logger, reload func(*config.Config) error) {
+	for range hangup {
+		log.Info("Reloading config")
+		next, err := config.Load(path)
+		if err == nil {
+			err = reload(next)
+		}
+		if err != nil {
+			log.Error("Failed to reload config, keeping the running config: ", err)
+			continue
+		}
+		log.Info("Reloaded config")
+	}
+}
+
+// pinByName returns the GPIO pin called name, eg: "P1_15" or "GPIO22", field
+// is the config field it came from.
+func pinByName(field, name string) (gpio.PinIO, error) {
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		return nil, fmt.Errorf("%s: there is no pin called %q", field, name)
+	}
+	return pin, nil
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/somakeit/door-controller3/admitter"
 	"github.com/somakeit/door-controller3/admitter/led"
 	"github.com/somakeit/door-controller3/admitter/strike"
+	"github.com/somakeit/door-controller3/auth"
 	"github.com/somakeit/door-controller3/auth/staticauth"
 	"github.com/somakeit/door-controller3/contextlogger"
 	"github.com/somakeit/door-controller3/guard"
@@ -61,7 +62,7 @@ func main() {
 		log.Fatal("Failed to set antenna gain: ", err)
 	}
 
-	auth := &staticauth.Static{
+	authority := &staticauth.Static{
 		Delay: *delay,
 		Allow: strings.Split(*tags, ","),
 	}
@@ -75,13 +76,13 @@ func main() {
 		ctxLog,
 	}
 
-	strikeGuard, err := nfc.New(1, "A", reader, auth, admitters)
+	strikeGuard, err := nfc.New(1, "A", reader, auth.Decide(authority), admitters)
 	if err != nil {
 		log.Fatal("Failed to init guard: ", err)
 	}
 
 	pin.Logger = ctxLog
-	pinGuard := pin.New(os.Stdin, auth, 1, "A")
+	pinGuard := pin.New(os.Stdin, authority, 1, "A", admitters)
 
 	log.Fatal(guard.Mux{
 		strikeGuard,
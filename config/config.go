@@ -0,0 +1,528 @@
+// Package config is the configuration file for doord, it describes the door
+// hardware, the authorizers and logging.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/somakeit/door-controller3/admitter/buzzer"
+	"github.com/somakeit/door-controller3/admitter/led"
+	"github.com/somakeit/door-controller3/admitter/rgb"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultGain         = 5
+	defaultOpenTime     = 5 * time.Second
+	defaultCacheMaxAge  = 7 * 24 * time.Hour
+	defaultSyncInterval = 15 * time.Minute
+	defaultLogFile      = "/var/log/doord/access.log"
+	defaultDebounce     = 50 * time.Millisecond
+	defaultHeldOpen     = 30 * time.Second
+	defaultToggleWithin = 3 * time.Second
+	defaultPolicy       = "secure"
+	defaultTitle        = "So Make It"
+	defaultWidth        = 80
+	defaultMessageTime  = 5 * time.Second
+	defaultPingInterval = 30 * time.Second
+	maxGain             = 7
+
+	defaultReadTimeout   = 100 * time.Millisecond
+	defaultAuthTimeout   = 30 * time.Second
+	defaultCancelTimeout = 5 * time.Second
+	defaultPINTimeout    = 30 * time.Second
+	defaultAdmitTimeout  = 2 * time.Second
+)
+
+// Config is the whole configuration of doord
+type Config struct {
+	// Door is the numeric door ID in HMS
+	Door int32 `yaml:"door"`
+	// Strike is shared by every side of the door
+	Strike Strike `yaml:"strike"`
+	Sensor Sensor `yaml:"sensor"`
+	Buzzer Buzzer `yaml:"buzzer"`
+	// Sides are the readers on each side of the door, at least one
+	Sides []Side `yaml:"sides"`
+	// TwoFactor requires a tag followed by the PIN of the same member on the
+	// side with the PIN pad
+	TwoFactor   bool        `yaml:"twofactor"`
+	Guard       Guard       `yaml:"guard"`
+	Console     Console     `yaml:"console"`
+	Authorizers Authorizers `yaml:"authorizers"`
+	Log         Log         `yaml:"log"`
+}
+
+// Sensor is the door position sensor, such as a reed switch
+type Sensor struct {
+	// Pin is the name of the pin wired to the sensor, disabled if empty.
+	// Without a sensor members are moved to their new zone as soon as they
+	// are allowed.
+	Pin string `yaml:"pin"`
+	// ActiveLow is set if the pin is low while the door is open
+	ActiveLow bool `yaml:"activelow"`
+	// Debounce is how long the sensor must settle for before a change is
+	// believed
+	Debounce time.Duration `yaml:"debounce"`
+	// HeldOpen is how long the door can be open before it is reported as
+	// held open
+	HeldOpen time.Duration `yaml:"heldopen"`
+}
+
+// Buzzer is a buzzer or piezo shared by every side of the door
+type Buzzer struct {
+	// Pin is the name of the pin driving the buzzer, disabled if empty
+	Pin string `yaml:"pin"`
+	// Passive is set for a piezo without its own oscillator, it is driven
+	// with PWM at the pitch of each tone
+	Passive bool `yaml:"passive"`
+	// ActiveLow is set if the buzzer sounds when the pin is low
+	ActiveLow bool `yaml:"activelow"`
+	// Quiet is a schedule file, in the format of the schedule authorizer, of
+	// when the buzzer is silent. Never if empty.
+	Quiet string `yaml:"quiet"`
+	// Tunes overrides the tunes played for each sound, see
+	// buzzer.CheckTunes
+	Tunes map[string]buzzer.Tune `yaml:"tunes"`
+}
+
+// Side is one side of the door with its own reader and LED
+type Side struct {
+	// Side is the side of the door, "A" or "B"
+	Side   string `yaml:"side"`
+	Reader Reader `yaml:"reader"`
+	// LED is the single status LED, it is optional if there is an RGB
+	LED LED `yaml:"led"`
+	// RGB is a red, green and blue status indicator, optional
+	RGB RGB `yaml:"rgb"`
+	// Button is the exit button on this side, optional
+	Button Button `yaml:"button"`
+	// PINPad is set on the side PINs are entered on, they are read from
+	// STDIN so only one side can have it
+	PINPad bool `yaml:"pinpad"`
+}
+
+// RGB is a status indicator of red, green and blue LEDs which shows each state
+// as a colour
+type RGB struct {
+	// Red, Green and Blue are the names of the pins driving each LED, the RGB
+	// is disabled if they are empty
+	Red   string `yaml:"red"`
+	Green string `yaml:"green"`
+	Blue  string `yaml:"blue"`
+	// ActiveLow is set if the LEDs are on when their pins are low, as with a
+	// common anode LED
+	ActiveLow bool `yaml:"activelow"`
+	// Frequency is the PWM frequency in Hz, the LEDs are only turned on or off
+	// if it is 0
+	Frequency int `yaml:"frequency"`
+	// Fade is the time taken to change colour, it needs a Frequency
+	Fade time.Duration `yaml:"fade"`
+	// Colours overrides the colour of states, see rgb.CheckColours
+	Colours map[string]string `yaml:"colours"`
+}
+
+// Button is a request-to-exit push button, pressing it opens the door without
+// a tag
+type Button struct {
+	// Pin is the name of the pin wired to the button, disabled if empty
+	Pin string `yaml:"pin"`
+	// ActiveLow is set if pressing the button pulls the pin low
+	ActiveLow bool `yaml:"activelow"`
+	// Debounce is how long the button must stay pressed to count as a press
+	Debounce time.Duration `yaml:"debounce"`
+}
+
+// defaultSide is used for anything not set on a side, it matches the original
+// door-controller2 wiring so further sides must set their own pins.
+func defaultSide() Side {
+	return Side{
+		Reader: Reader{
+			Reset: "P1_22",
+			IRQ:   "P1_16",
+			Gain:  defaultGain,
+		},
+		LED: LED{
+			Pin: "P1_18",
+		},
+		Button: Button{
+			Debounce: defaultDebounce,
+		},
+	}
+}
+
+// UnmarshalYAML fills in anything not set on a side from defaultSide, yaml
+// does not do this for list items. The side is decoded again on its own so
+// that unknown keys are still an error.
+func (s *Side) UnmarshalYAML(value *yaml.Node) error {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	type plain Side
+	side := plain(defaultSide())
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&side); err != nil {
+		return fmt.Errorf("side at line %d: %w", value.Line, err)
+	}
+	*s = Side(side)
+	return nil
+}
+
+// Reader is an MFRC522 NFC reader
+type Reader struct {
+	// SPI is the name of the SPI port, eg: "SPI0.1", empty for the first
+	// port
+	SPI string `yaml:"spi"`
+	// Reset is the name of the pin wired to the reader's RST
+	Reset string `yaml:"reset"`
+	// IRQ is the name of the pin wired to the reader's IRQ
+	IRQ string `yaml:"irq"`
+	// Gain is the antenna gain, 0 to 7
+	Gain int `yaml:"gain"`
+}
+
+// Strike is the door strike or latch
+type Strike struct {
+	// Pin is the name of the pin driving the strike
+	Pin string `yaml:"pin"`
+	// ActiveLow is the strike logic level
+	ActiveLow bool `yaml:"activelow"`
+	// OpenTime is how long the door is opened for, with a sensor it is
+	// locked again as soon as the door closes
+	OpenTime time.Duration `yaml:"opentime"`
+	// NoEntry, if set, locks the door early if it is not opened within
+	// NoEntry, it needs a sensor
+	NoEntry time.Duration `yaml:"noentry"`
+	// Hours is a schedule file, in the format of the schedule authorizer, of
+	// when the door is held unlocked. Never if empty.
+	Hours string `yaml:"hours"`
+	// Keyholders are the HMS member IDs of the members who can hold the
+	// door open, and let it lock again, by being allowed twice within
+	// ToggleWithin
+	Keyholders   []int32       `yaml:"keyholders"`
+	ToggleWithin time.Duration `yaml:"togglewithin"`
+	// ModeFile is the file to save whether the door is held open in, so that
+	// it stays held open after a restart. Not saved if empty.
+	ModeFile string `yaml:"modefile"`
+	// Policy is what the door is left as when doord stops or fails, secure
+	// (locked) or safe (unlocked)
+	Policy string `yaml:"policy"`
+}
+
+// LED is the status LED
+type LED struct {
+	// Pin is the name of the pin driving the LED
+	Pin string `yaml:"pin"`
+	// Rates overrides the blink pattern of LED states, see led.CheckRates
+	Rates map[string]led.Rate `yaml:"rates"`
+	// Patterns overrides the blink pattern of LED states with on and off
+	// sequences, it takes precedence over Rates. See led.CheckPatterns.
+	Patterns map[string]led.Pattern `yaml:"patterns"`
+	// Reasons maps the reasons for a denial to the LED state shown, see
+	// led.CheckReasons
+	Reasons map[string]string `yaml:"reasons"`
+}
+
+// Guard is the time given to each step of an access attempt
+type Guard struct {
+	// ReadTimeout is the time given to read a tag from the reader
+	ReadTimeout time.Duration `yaml:"readtimeout"`
+	// AuthTimeout is the time given to authorize a tag
+	AuthTimeout time.Duration `yaml:"authtimeout"`
+	// CancelTimeout is the time a tag must be gone from the reader before
+	// its attempt is cancelled
+	CancelTimeout time.Duration `yaml:"canceltimeout"`
+	// PINTimeout is the time given to enter a PIN after a tag when TwoFactor
+	// is set
+	PINTimeout time.Duration `yaml:"pintimeout"`
+	// AdmitterTimeout is the time waited for each status light, buzzer,
+	// console and log to show an attempt, those that are slower or fail are
+	// logged. The strike and sensor are always waited for.
+	AdmitterTimeout time.Duration `yaml:"admittertimeout"`
+}
+
+// Authorizers decide who is allowed through the door, HMS is always used and
+// the rest are optional.
+type Authorizers struct {
+	// HMS is the DSN for the HMS mysql database as per the Go database/sql
+	// package, eg: 'username:password@(host)/database'
+	HMS string `yaml:"hms"`
+	// ZoneOutbox is the file to queue member zone updates in until HMS
+	// accepts them, updates are sent once and may be lost if empty
+	ZoneOutbox string `yaml:"zoneoutbox"`
+	// Cache is the file to cache granted tags in for use when HMS is
+	// unreachable, disabled if empty
+	Cache string `yaml:"cache"`
+	// CacheMaxAge is how long a cached tag can be used for after HMS last
+	// granted it
+	CacheMaxAge time.Duration `yaml:"cachemaxage"`
+	// Snapshot is the file to keep a full copy of the HMS tag list and door
+	// permissions in for use when HMS is unreachable, disabled if empty
+	Snapshot string `yaml:"snapshot"`
+	// SyncInterval is the time between copies of the HMS tag list
+	SyncInterval time.Duration `yaml:"syncinterval"`
+	// Schedule is the file of opening hours for doors, doors are always open
+	// if empty
+	Schedule string `yaml:"schedule"`
+}
+
+// Console is the status screen drawn on the terminal doord is started on
+type Console struct {
+	// Enabled draws the status screen on STDOUT, PINs are typed on STDIN
+	// without being shown. The log must not go to STDOUT.
+	Enabled bool `yaml:"enabled"`
+	// Title is shown at the top of the screen
+	Title string `yaml:"title"`
+	// Width is the width of the terminal in characters
+	Width int `yaml:"width"`
+	// MessageTime is how long welcome and deny messages are shown for
+	MessageTime time.Duration `yaml:"messagetime"`
+	// PingInterval is how often HMS is checked to show whether it can be
+	// reached
+	PingInterval time.Duration `yaml:"pinginterval"`
+}
+
+// Log is where and what to log
+type Log struct {
+	// File is the log file to use or - for STDOUT
+	File string `yaml:"file"`
+	// Level is a logrus level name, eg: "info"
+	Level string `yaml:"level"`
+}
+
+// Default returns the configuration used for anything not set in a file, it
+// matches the original door-controller2 wiring. There are no default sides.
+func Default() *Config {
+	return &Config{
+		Strike: Strike{
+			Pin:          "P1_15",
+			OpenTime:     defaultOpenTime,
+			ToggleWithin: defaultToggleWithin,
+			Policy:       defaultPolicy,
+		},
+		Sensor: Sensor{
+			Debounce: defaultDebounce,
+			HeldOpen: defaultHeldOpen,
+		},
+		Guard: Guard{
+			ReadTimeout:     defaultReadTimeout,
+			AuthTimeout:     defaultAuthTimeout,
+			CancelTimeout:   defaultCancelTimeout,
+			PINTimeout:      defaultPINTimeout,
+			AdmitterTimeout: defaultAdmitTimeout,
+		},
+		Console: Console{
+			Title:        defaultTitle,
+			Width:        defaultWidth,
+			MessageTime:  defaultMessageTime,
+			PingInterval: defaultPingInterval,
+		},
+		Authorizers: Authorizers{
+			CacheMaxAge:  defaultCacheMaxAge,
+			SyncInterval: defaultSyncInterval,
+		},
+		Log: Log{
+			File:  defaultLogFile,
+			Level: "info",
+		},
+	}
+}
+
+// Load reads and validates the config file at path
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses and validates a YAML config, anything not set takes its value
+// from Default. Unknown keys are an error.
+func Parse(data []byte) (*Config, error) {
+	c := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the config for mistakes, all of them are listed in the
+// error.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Door > 0, "door must be greater than 0")
+	check(c.Strike.Pin != "", "strike.pin is required")
+	check(c.Strike.OpenTime > 0, "strike.opentime must be greater than 0")
+	check(c.Strike.NoEntry >= 0 && c.Strike.NoEntry < c.Strike.OpenTime, "strike.noentry must be 0 or less than strike.opentime")
+	check(c.Strike.NoEntry == 0 || c.Sensor.Pin != "", "strike.noentry needs a sensor.pin")
+	check(c.Strike.Policy == "secure" || c.Strike.Policy == "safe", "strike.policy must be secure or safe, not %q", c.Strike.Policy)
+	check(c.Strike.ToggleWithin > 0, "strike.togglewithin must be greater than 0")
+	for _, id := range c.Strike.Keyholders {
+		check(id > 0, "strike.keyholders must be member IDs greater than 0, not %d", id)
+	}
+	check(c.Sensor.Debounce > 0, "sensor.debounce must be greater than 0")
+	check(c.Sensor.HeldOpen > 0, "sensor.heldopen must be greater than 0")
+	err := buzzer.CheckTunes(c.Buzzer.Tunes)
+	check(err == nil, "buzzer.tunes: %v", err)
+	check(len(c.Sides) > 0, "at least one side is required")
+	sides := make(map[string]bool)
+	ports := make(map[string]string)
+	pinPads := 0
+	for i, s := range c.Sides {
+		field := fmt.Sprintf("sides[%d]", i)
+		check(s.Side == "A" || s.Side == "B", "%s.side must be 'A' or 'B', not %q", field, s.Side)
+		check(!sides[s.Side], "%s.side %s is already used", field, s.Side)
+		sides[s.Side] = true
+		other, ok := ports[s.Reader.SPI]
+		check(!ok, "%s.reader.spi %q is already used by %s", field, s.Reader.SPI, other)
+		ports[s.Reader.SPI] = field + ".reader.spi"
+		check(s.Reader.Reset != "", "%s.reader.reset pin is required", field)
+		check(s.Reader.IRQ != "", "%s.reader.irq pin is required", field)
+		check(s.Reader.Gain >= 0 && s.Reader.Gain <= maxGain, "%s.reader.gain must be 0 to %d", field, maxGain)
+		rgbPins := 0
+		for _, pin := range []string{s.RGB.Red, s.RGB.Green, s.RGB.Blue} {
+			if pin != "" {
+				rgbPins++
+			}
+		}
+		check(s.LED.Pin != "" || rgbPins > 0, "%s.led.pin or %s.rgb is required", field, field)
+		check(rgbPins == 0 || rgbPins == 3, "%s.rgb needs red, green and blue pins", field)
+		check(s.RGB.Frequency >= 0, "%s.rgb.frequency must not be negative", field)
+		check(s.RGB.Fade >= 0, "%s.rgb.fade must not be negative", field)
+		err = rgb.CheckColours(s.RGB.Colours)
+		check(err == nil, "%s.rgb.colours: %v", field, err)
+		err = led.CheckRates(s.LED.Rates)
+		check(err == nil, "%s.led.rates: %v", field, err)
+		err = led.CheckPatterns(s.LED.Patterns)
+		check(err == nil, "%s.led.patterns: %v", field, err)
+		err = led.CheckReasons(s.LED.Reasons)
+		check(err == nil, "%s.led.reasons: %v", field, err)
+		check(s.Button.Debounce > 0, "%s.button.debounce must be greater than 0", field)
+		if s.PINPad {
+			pinPads++
+		}
+	}
+	check(pinPads <= 1, "only one side can have a pinpad")
+	check(!c.TwoFactor || pinPads == 1, "twofactor needs a side with a pinpad")
+	check(c.Guard.ReadTimeout > 0, "guard.readtimeout must be greater than 0")
+	check(c.Guard.AuthTimeout > 0, "guard.authtimeout must be greater than 0")
+	check(c.Guard.CancelTimeout > 0, "guard.canceltimeout must be greater than 0")
+	check(c.Guard.PINTimeout > 0, "guard.pintimeout must be greater than 0")
+	check(c.Guard.AdmitterTimeout > 0, "guard.admittertimeout must be greater than 0")
+	check(c.Console.Width > 0, "console.width must be greater than 0")
+	check(c.Console.MessageTime > 0, "console.messagetime must be greater than 0")
+	check(c.Console.PingInterval > 0, "console.pinginterval must be greater than 0")
+	check(!c.Console.Enabled || c.Log.File != "-", "console needs log.file to be a file, not -")
+	check(c.Authorizers.HMS != "", "authorizers.hms DSN is required")
+	check(c.Authorizers.CacheMaxAge > 0, "authorizers.cachemaxage must be greater than 0")
+	check(c.Authorizers.SyncInterval > 0, "authorizers.syncinterval must be greater than 0")
+	check(c.Log.File != "", "log.file is required, use - for STDOUT")
+	_, err = logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level %q is not a level", c.Log.Level)
+
+	type pinUse struct{ field, name string }
+	pins := []pinUse{{"strike.pin", c.Strike.Pin}, {"sensor.pin", c.Sensor.Pin}, {"buzzer.pin", c.Buzzer.Pin}}
+	for i, s := range c.Sides {
+		field := fmt.Sprintf("sides[%d]", i)
+		pins = append(pins,
+			pinUse{field + ".reader.reset", s.Reader.Reset},
+			pinUse{field + ".reader.irq", s.Reader.IRQ},
+			pinUse{field + ".led.pin", s.LED.Pin},
+			pinUse{field + ".rgb.red", s.RGB.Red},
+			pinUse{field + ".rgb.green", s.RGB.Green},
+			pinUse{field + ".rgb.blue", s.RGB.Blue},
+			pinUse{field + ".button.pin", s.Button.Pin},
+		)
+	}
+	used := make(map[string]string)
+	for _, pin := range pins {
+		if pin.name == "" {
+			continue
+		}
+		other, ok := used[pin.name]
+		check(!ok, "%s %s is already used by %s", pin.field, pin.name, other)
+		used[pin.name] = pin.field
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// RestartNeeded lists the fields that differ in next which can only be
+// changed by restarting doord, everything else can be reloaded.
+func (c *Config) RestartNeeded(next *Config) []string {
+	var fields []string
+	changed := func(field string, differ bool) {
+		if differ {
+			fields = append(fields, field)
+		}
+	}
+
+	changed("door", c.Door != next.Door)
+	changed("strike.pin", c.Strike.Pin != next.Strike.Pin)
+	changed("strike.activelow", c.Strike.ActiveLow != next.Strike.ActiveLow)
+	changed("strike.policy", c.Strike.Policy != next.Strike.Policy)
+	changed("strike.modefile", c.Strike.ModeFile != next.Strike.ModeFile)
+	changed("sensor.pin", c.Sensor.Pin != next.Sensor.Pin)
+	changed("sensor.activelow", c.Sensor.ActiveLow != next.Sensor.ActiveLow)
+	changed("sensor.debounce", c.Sensor.Debounce != next.Sensor.Debounce)
+	changed("buzzer.pin", c.Buzzer.Pin != next.Buzzer.Pin)
+	changed("buzzer.passive", c.Buzzer.Passive != next.Buzzer.Passive)
+	changed("buzzer.activelow", c.Buzzer.ActiveLow != next.Buzzer.ActiveLow)
+	if len(c.Sides) != len(next.Sides) {
+		changed("sides", true)
+	} else {
+		for i, s := range c.Sides {
+			n := next.Sides[i]
+			changed(fmt.Sprintf("sides[%d]", i),
+				s.Side != n.Side || s.Reader != n.Reader || s.LED.Pin != n.LED.Pin || !sameRGB(s.RGB, n.RGB) || s.Button != n.Button || s.PINPad != n.PINPad)
+		}
+	}
+	changed("twofactor", c.TwoFactor != next.TwoFactor)
+	changed("guard.admittertimeout", c.Guard.AdmitterTimeout != next.Guard.AdmitterTimeout)
+	changed("console.enabled", c.Console.Enabled != next.Console.Enabled)
+	changed("console.title", c.Console.Title != next.Console.Title)
+	changed("console.width", c.Console.Width != next.Console.Width)
+	changed("console.pinginterval", c.Console.PingInterval != next.Console.PingInterval)
+	changed("authorizers.hms", c.Authorizers.HMS != next.Authorizers.HMS)
+	changed("authorizers.cache", c.Authorizers.Cache != next.Authorizers.Cache)
+	changed("authorizers.zoneoutbox", c.Authorizers.ZoneOutbox != next.Authorizers.ZoneOutbox)
+	changed("authorizers.snapshot", c.Authorizers.Snapshot != next.Authorizers.Snapshot)
+	changed("authorizers.syncinterval", c.Authorizers.SyncInterval != next.Authorizers.SyncInterval)
+	changed("log.file", c.Log.File != next.Log.File)
+	return fields
+}
+
+// sameRGB reports whether a and b are the same but for their colours, which
+// can be reloaded
+func sameRGB(a, b RGB) bool {
+	a.Colours, b.Colours = nil, nil
+	return reflect.DeepEqual(a, b)
+}
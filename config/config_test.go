@@ -0,0 +1,563 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter/buzzer"
+	"github.com/somakeit/door-controller3/admitter/led"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for name, test := range map[string]struct {
+		yaml string
+
+		want    func(*Config)
+		wantErr string
+	}{
+		"minimal": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			want: func(c *Config) {
+				c.Door = 1
+				side := defaultSide()
+				side.Side = "A"
+				c.Sides = []Side{side}
+				c.Authorizers.HMS = "user:pass@(host)/db"
+			},
+		},
+
+		"two sides": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    pinpad: true
+  - side: B
+    reader:
+      spi: SPI0.1
+      reset: GPIO5
+      irq: GPIO6
+    led:
+      pin: GPIO19
+    button:
+      pin: GPIO26
+      activelow: true
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			want: func(c *Config) {
+				c.Door = 1
+				a := defaultSide()
+				a.Side = "A"
+				a.PINPad = true
+				c.Sides = []Side{a, {
+					Side:   "B",
+					Reader: Reader{SPI: "SPI0.1", Reset: "GPIO5", IRQ: "GPIO6", Gain: defaultGain},
+					LED:    LED{Pin: "GPIO19"},
+					Button: Button{Pin: "GPIO26", ActiveLow: true, Debounce: defaultDebounce},
+				}}
+				c.Authorizers.HMS = "user:pass@(host)/db"
+			},
+		},
+
+		"everything": {
+			yaml: `
+door: 2
+strike:
+  pin: GPIO13
+  activelow: true
+  opentime: 1500ms
+  noentry: 500ms
+  hours: /etc/doord/unlocked.json
+  keyholders: [7, 12]
+  togglewithin: 2s
+  modefile: /var/lib/doord/mode.json
+  policy: safe
+sensor:
+  pin: GPIO21
+  activelow: true
+  debounce: 10ms
+  heldopen: 1m
+buzzer:
+  pin: GPIO18
+  passive: true
+  activelow: true
+  quiet: /etc/doord/quiet.json
+  tunes:
+    allowed:
+      - hz: 2000
+        duration: 50ms
+      - duration: 50ms
+    held open: []
+sides:
+  - side: B
+    reader:
+      spi: SPI0.1
+      reset: GPIO5
+      irq: GPIO6
+      gain: 7
+    led:
+      pin: GPIO19
+      rates:
+        heartbeat:
+          on: 100ms
+          off: 2s
+      patterns:
+        denied: [100ms, 100ms, 100ms, 700ms]
+      reasons:
+        closed: lockout
+    rgb:
+      red: GPIO17
+      green: GPIO27
+      blue: GPIO22
+      activelow: true
+      frequency: 1000
+      fade: 200ms
+      colours:
+        idle: "#000000"
+    button:
+      pin: GPIO26
+      debounce: 20ms
+    pinpad: true
+twofactor: true
+guard:
+  readtimeout: 50ms
+  authtimeout: 10s
+  canceltimeout: 2s
+  pintimeout: 20s
+  admittertimeout: 1s
+console:
+  title: Front door
+  width: 100
+  messagetime: 3s
+  pinginterval: 1m
+authorizers:
+  hms: user:pass@(host)/db
+  zoneoutbox: /var/lib/doord/zones.json
+  cache: /var/lib/doord/cache.json
+  cachemaxage: 24h
+  snapshot: /var/lib/doord/snapshot.json
+  syncinterval: 1m
+  schedule: /etc/doord/schedule.json
+log:
+  file: "-"
+  level: debug
+`,
+			want: func(c *Config) {
+				*c = Config{
+					Door: 2,
+					Strike: Strike{
+						Pin:          "GPIO13",
+						ActiveLow:    true,
+						OpenTime:     1500 * time.Millisecond,
+						NoEntry:      500 * time.Millisecond,
+						Hours:        "/etc/doord/unlocked.json",
+						Keyholders:   []int32{7, 12},
+						ToggleWithin: 2 * time.Second,
+						ModeFile:     "/var/lib/doord/mode.json",
+						Policy:       "safe",
+					},
+					Sensor: Sensor{Pin: "GPIO21", ActiveLow: true, Debounce: 10 * time.Millisecond, HeldOpen: time.Minute},
+					Buzzer: Buzzer{
+						Pin:       "GPIO18",
+						Passive:   true,
+						ActiveLow: true,
+						Quiet:     "/etc/doord/quiet.json",
+						Tunes: map[string]buzzer.Tune{
+							"allowed":   {{Hz: 2000, Duration: 50 * time.Millisecond}, {Duration: 50 * time.Millisecond}},
+							"held open": {},
+						},
+					},
+					Sides: []Side{{
+						Side:   "B",
+						Reader: Reader{SPI: "SPI0.1", Reset: "GPIO5", IRQ: "GPIO6", Gain: 7},
+						LED: LED{
+							Pin:   "GPIO19",
+							Rates: map[string]led.Rate{"heartbeat": {On: 100 * time.Millisecond, Off: 2 * time.Second}},
+							Patterns: map[string]led.Pattern{
+								"denied": {100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 700 * time.Millisecond},
+							},
+							Reasons: map[string]string{"closed": "lockout"},
+						},
+						RGB: RGB{
+							Red:       "GPIO17",
+							Green:     "GPIO27",
+							Blue:      "GPIO22",
+							ActiveLow: true,
+							Frequency: 1000,
+							Fade:      200 * time.Millisecond,
+							Colours:   map[string]string{"idle": "#000000"},
+						},
+						Button: Button{Pin: "GPIO26", Debounce: 20 * time.Millisecond},
+						PINPad: true,
+					}},
+					TwoFactor: true,
+					Guard: Guard{
+						ReadTimeout:     50 * time.Millisecond,
+						AuthTimeout:     10 * time.Second,
+						CancelTimeout:   2 * time.Second,
+						PINTimeout:      20 * time.Second,
+						AdmitterTimeout: time.Second,
+					},
+					Console: Console{
+						Title:        "Front door",
+						Width:        100,
+						MessageTime:  3 * time.Second,
+						PingInterval: time.Minute,
+					},
+					Authorizers: Authorizers{
+						HMS:          "user:pass@(host)/db",
+						ZoneOutbox:   "/var/lib/doord/zones.json",
+						Cache:        "/var/lib/doord/cache.json",
+						CacheMaxAge:  24 * time.Hour,
+						Snapshot:     "/var/lib/doord/snapshot.json",
+						SyncInterval: time.Minute,
+						Schedule:     "/etc/doord/schedule.json",
+					},
+					Log: Log{File: "-", Level: "debug"},
+				}
+			},
+		},
+
+		"unknown key": {
+			yaml: `
+door: 1
+stirke:
+  pin: P1_15
+`,
+			wantErr: "field stirke not found",
+		},
+
+		"unknown side key": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    raeder:
+      gain: 7
+`,
+			wantErr: "field raeder not found",
+		},
+
+		"bad duration": {
+			yaml: `
+door: 1
+strike:
+  opentime: five
+`,
+			wantErr: "failed to parse config",
+		},
+
+		"every problem listed": {
+			yaml: `
+sides:
+  - side: C
+    reader:
+      gain: 8
+twofactor: true
+log:
+  level: loud
+`,
+			wantErr: `invalid config: door must be greater than 0, sides[0].side must be 'A' or 'B', not "C", sides[0].reader.gain must be 0 to 7, twofactor needs a side with a pinpad, authorizers.hms DSN is required, log.level "loud" is not a level`,
+		},
+
+		"no entry without sensor": {
+			yaml: `
+door: 1
+strike:
+  opentime: 2s
+  noentry: 3s
+sides:
+  - side: A
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: "invalid config: strike.noentry must be 0 or less than strike.opentime, strike.noentry needs a sensor.pin",
+		},
+
+		"bad keyholder": {
+			yaml: `
+door: 1
+strike:
+  keyholders: [7, -1]
+sides:
+  - side: A
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: "invalid config: strike.keyholders must be member IDs greater than 0, not -1",
+		},
+
+		"bad policy": {
+			yaml: `
+door: 1
+strike:
+  policy: open
+sides:
+  - side: A
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: strike.policy must be secure or safe, not "open"`,
+		},
+
+		"no sides": {
+			yaml: `
+door: 1
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: "invalid config: at least one side is required",
+		},
+
+		"sides clash": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    pinpad: true
+  - side: A
+    reader:
+      reset: GPIO5
+      irq: GPIO6
+    led:
+      pin: GPIO19
+    pinpad: true
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: sides[1].side A is already used, sides[1].reader.spi "" is already used by sides[0].reader.spi, only one side can have a pinpad`,
+		},
+
+		"pins clash between sides": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+  - side: B
+    reader:
+      spi: SPI0.1
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: "invalid config: sides[1].reader.reset P1_22 is already used by sides[0].reader.reset, sides[1].reader.irq P1_16 is already used by sides[0].reader.irq, sides[1].led.pin P1_18 is already used by sides[0].led.pin",
+		},
+
+		"bad led rate": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      rates:
+        disco:
+          on: 1s
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: sides[0].led.rates: unknown LED state "disco"`,
+		},
+
+		"bad console": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+console:
+  enabled: true
+  width: 0
+  messagetime: 0s
+  pinginterval: -1s
+authorizers:
+  hms: user:pass@(host)/db
+log:
+  file: "-"
+`,
+			wantErr: `invalid config: console.width must be greater than 0, console.messagetime must be greater than 0, console.pinginterval must be greater than 0, console needs log.file to be a file, not -`,
+		},
+
+		"bad buzzer": {
+			yaml: `
+door: 1
+strike:
+  pin: GPIO13
+buzzer:
+  pin: GPIO13
+  tunes:
+    denied:
+      - hz: 400
+sides:
+  - side: A
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: buzzer.tunes: buzzer sound "denied" has a tone without a duration, buzzer.pin GPIO13 is already used by strike.pin`,
+		},
+
+		"rgb instead of led": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      pin: ""
+    rgb:
+      red: GPIO17
+      green: GPIO27
+      blue: GPIO22
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			want: func(c *Config) {
+				c.Door = 1
+				side := defaultSide()
+				side.Side = "A"
+				side.LED.Pin = ""
+				side.RGB = RGB{Red: "GPIO17", Green: "GPIO27", Blue: "GPIO22"}
+				c.Sides = []Side{side}
+				c.Authorizers.HMS = "user:pass@(host)/db"
+			},
+		},
+
+		"bad rgb": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      pin: ""
+    rgb:
+      red: GPIO17
+      green: GPIO17
+      frequency: -1
+      colours:
+        idle: blue
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: sides[0].rgb needs red, green and blue pins, sides[0].rgb.frequency must not be negative, sides[0].rgb.colours: RGB state "idle": colour "blue" is not in the form #rrggbb, sides[0].rgb.green GPIO17 is already used by sides[0].rgb.red`,
+		},
+
+		"no status light": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      pin: ""
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: sides[0].led.pin or sides[0].rgb is required`,
+		},
+
+		"bad led pattern and reason": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      patterns:
+        denied: [0s]
+      reasons:
+        bored: denied
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: `invalid config: sides[0].led.patterns: LED state "denied" must have an on or off time, sides[0].led.reasons: unknown deny reason "bored"`,
+		},
+
+		"pin used twice": {
+			yaml: `
+door: 1
+sides:
+  - side: A
+    led:
+      pin: P1_15
+    button:
+      pin: P1_22
+authorizers:
+  hms: user:pass@(host)/db
+`,
+			wantErr: "invalid config: sides[0].led.pin P1_15 is already used by strike.pin, sides[0].button.pin P1_22 is already used by sides[0].reader.reset",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := Parse([]byte(test.yaml))
+			if test.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			want := Default()
+			test.want(want)
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestLoadExample(t *testing.T) {
+	c, err := Load("../dist/etc/doord/doord.yaml")
+	require.NoError(t, err)
+	require.Empty(t, c.Strike.Keyholders)
+	c.Strike.Keyholders = nil
+	require.Equal(t, Default().Strike, c.Strike)
+	require.Equal(t, Default().Sensor, c.Sensor)
+	require.Len(t, c.Sides, 1)
+	require.Equal(t, defaultSide().Reader, c.Sides[0].Reader)
+	require.Equal(t, defaultSide().LED.Pin, c.Sides[0].LED.Pin)
+	require.Equal(t, Default().Guard, c.Guard)
+	require.Equal(t, Default().Console, c.Console)
+	require.Equal(t, Default().Log, c.Log)
+}
+
+func TestLoadMissing(t *testing.T) {
+	_, err := Load("does-not-exist.yaml")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read config")
+}
+
+func TestRestartNeeded(t *testing.T) {
+	running := Default()
+	running.Door = 1
+	side := defaultSide()
+	side.Side = "A"
+	running.Sides = []Side{side}
+
+	next := *running
+	next.Strike.OpenTime = time.Second
+	next.Sensor.HeldOpen = time.Minute
+	next.Strike.Hours = "/etc/doord/unlocked.json"
+	next.Strike.Keyholders = []int32{7}
+	side.LED.Rates = map[string]led.Rate{"heartbeat": {On: time.Second, Off: time.Second}}
+	side.RGB.Colours = map[string]string{"idle": "#000000"}
+	next.Buzzer.Quiet = "/etc/doord/quiet.json"
+	next.Buzzer.Tunes = map[string]buzzer.Tune{"allowed": {}}
+	next.Console.MessageTime = time.Second
+	next.Sides = []Side{side}
+	next.Authorizers.Schedule = "/etc/doord/schedule.json"
+	next.Authorizers.CacheMaxAge = time.Hour
+	next.Log.Level = "debug"
+	require.Empty(t, running.RestartNeeded(&next))
+
+	side.Reader.Gain = 7
+	next.Sides = []Side{side}
+	next.Sensor.Pin = "GPIO21"
+	next.Authorizers.HMS = "user:pass@(otherhost)/db"
+	next.Strike.Policy = "safe"
+	next.Buzzer.Pin = "GPIO18"
+	next.Console.Enabled = true
+	next.Authorizers.Cache = "/var/lib/doord/cache.json"
+	require.Equal(t, []string{"strike.policy", "sensor.pin", "buzzer.pin", "sides[0]", "console.enabled", "authorizers.hms", "authorizers.cache"}, running.RestartNeeded(&next))
+
+	next.Sides = append(next.Sides, side)
+	require.Equal(t, []string{"strike.policy", "sensor.pin", "buzzer.pin", "sides", "console.enabled", "authorizers.hms", "authorizers.cache"}, running.RestartNeeded(&next))
+}
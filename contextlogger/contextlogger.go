@@ -5,6 +5,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
 )
 
 // ContextLogger is an adapter to logrus for the log calls in this module. It
@@ -26,11 +27,16 @@ func (c *ContextLogger) Fatal(ctx context.Context, args ...interface{}) {
 }
 
 func (c *ContextLogger) Warn(ctx context.Context, args ...interface{}) {
-	c.Logger.WithFields(c.fields(ctx)).Debug(args...)
+	c.Logger.WithFields(c.fields(ctx)).Warn(args...)
 }
 
-func (c *ContextLogger) Warnf(ctx context.Context, args ...interface{}) {
-	c.Logger.WithFields(c.fields(ctx)).Debug(args...)
+// Warnf logs a formatted message at warning level, like Warn
+func (c *ContextLogger) Warnf(ctx context.Context, format string, args ...interface{}) {
+	c.Logger.WithFields(c.fields(ctx)).Warnf(format, args...)
+}
+
+func (c *ContextLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	c.Logger.WithFields(c.fields(ctx)).Infof(format, args...)
 }
 
 func (c *ContextLogger) Debug(ctx context.Context, args ...interface{}) {
@@ -51,11 +57,29 @@ func (c *ContextLogger) Allow(ctx context.Context, msg string) error {
 	return nil
 }
 
+// Notify logs events with an event field so they can be found separately from
+// admission attempts.
+func (c *ContextLogger) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	c.Logger.WithFields(c.fields(ctx)).WithField("event", string(event)).Info("Event: ", msg)
+	return nil
+}
+
 func (c *ContextLogger) fields(ctx context.Context) logrus.Fields {
-	return logrus.Fields{
+	decision := auth.DecisionFrom(ctx)
+	fields := logrus.Fields{
 		string(admitter.Door): ctx.Value(admitter.Door),
 		string(admitter.Side): ctx.Value(admitter.Side),
 		string(admitter.Type): ctx.Value(admitter.Type),
 		string(admitter.ID):   ctx.Value(admitter.ID),
+		"offline":             decision.Offline,
+		"authorizer":          decision.Source,
+	}
+	if decision.Reason != "" {
+		fields["reason"] = string(decision.Reason)
+	}
+	if decision.Member.ID != 0 {
+		fields["member_id"] = decision.Member.ID
+		fields["member"] = decision.Member.Name
 	}
+	return fields
 }
@@ -1,11 +1,28 @@
 package contextlogger
 
 import (
+	"context"
 	"testing"
 
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/somakeit/door-controller3/admitter"
+	"github.com/stretchr/testify/require"
 )
 
 func TestContextLogger(t *testing.T) {
 	var _ admitter.Admitter = &ContextLogger{}
+	var _ admitter.Notifier = &ContextLogger{}
+}
+
+func TestWarn(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	c := &ContextLogger{Logger: logger}
+	c.Warnf(context.Background(), "%d zone updates waiting", 3)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	require.Equal(t, "3 zone updates waiting", hook.LastEntry().Message)
+
+	c.Warn(context.Background(), "Failed to save zone outbox: ", "disk full")
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	require.Equal(t, "Failed to save zone outbox: disk full", hook.LastEntry().Message)
 }
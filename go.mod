@@ -7,6 +7,7 @@ require (
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 	periph.io/x/conn/v3 v3.6.9
 	periph.io/x/devices/v3 v3.6.13-0.20211111202038-7836991f220f
 	periph.io/x/host/v3 v3.7.1
@@ -0,0 +1,120 @@
+// Package button is a door guard for a request-to-exit push button, every
+// press opens the door without authorization.
+package button
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"periph.io/x/conn/v3/gpio"
+)
+
+const (
+	defaultDebounceMS = 50
+	guardType         = "button"
+	exitMessage       = "Exit button pressed"
+)
+
+// ErrHalted is returned by Guard if the pin stops reporting edges
+var ErrHalted = errors.New("button pin halted")
+
+// Pin is a GPIO input with edge detection attached to the button, any
+// gpio.PinIn can be used.
+type Pin interface {
+	In(pull gpio.Pull, edge gpio.Edge) error
+	Read() gpio.Level
+	WaitForEdge(timeout time.Duration) bool
+}
+
+// Guard is a door guard for an exit button
+type Guard struct {
+	// Debounce is how long the button must stay pressed to count as a press,
+	// the default is 50 milliseconds.
+	Debounce time.Duration
+
+	door    int32
+	side    string
+	pin     Pin
+	pressed gpio.Level
+	gate    admitter.Admitter
+	clock   clock
+}
+
+// New returns a Guard for the button on pin, side is the side of the door the
+// button opens it from. If activeLow is set the button pulls the pin low when
+// pressed and the internal pull up is used, otherwise the pull down is used.
+func New(door int32, side string, pin Pin, activeLow bool, gate admitter.Admitter) (*Guard, error) {
+	pull, pressed := gpio.PullDown, gpio.High
+	if activeLow {
+		pull, pressed = gpio.PullUp, gpio.Low
+	}
+	if err := pin.In(pull, gpio.BothEdges); err != nil {
+		return nil, fmt.Errorf("failed to set up button pin: %w", err)
+	}
+	return &Guard{
+		Debounce: defaultDebounceMS * time.Millisecond,
+		door:     door,
+		side:     side,
+		pin:      pin,
+		pressed:  pressed,
+		gate:     gate,
+		clock:    realClock{},
+	}, nil
+}
+
+// Guard begins waiting for button presses. Any error returned is fatal.
+func (g *Guard) Guard() error {
+	for {
+		if err := g.guard(); err != nil {
+			return err
+		}
+	}
+}
+
+// guard is one iteration of the Guard loop, it waits for an edge and admits if
+// the button is still pressed after Debounce.
+func (g *Guard) guard() error {
+	if !g.pin.WaitForEdge(-1) {
+		return ErrHalted
+	}
+	if g.pin.Read() != g.pressed {
+		return nil
+	}
+	<-g.clock.After(g.Debounce)
+	if g.pin.Read() != g.pressed {
+		return nil
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, admitter.Door, g.door)
+	ctx = context.WithValue(ctx, admitter.Side, g.side)
+	ctx = context.WithValue(ctx, admitter.Type, guardType)
+	if err := g.gate.Allow(ctx, exitMessage); err != nil {
+		return fmt.Errorf("failed to allow exit: %w", err)
+	}
+
+	// Holding the button down is one press
+	for g.pin.Read() == g.pressed {
+		start := g.clock.Now()
+		// A halted pin returns at once
+		if !g.pin.WaitForEdge(g.Debounce) && g.clock.Now().Sub(start) < g.Debounce {
+			return ErrHalted
+		}
+	}
+	return nil
+}
+
+// clock is the time source of a Guard, tests replace it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,227 @@
+package button
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/internal/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"periph.io/x/conn/v3/gpio"
+)
+
+var _ Pin = gpio.PinIn(nil)
+
+func TestGuard(t *testing.T) {
+	type step struct {
+		level gpio.Level
+		hold  time.Duration
+	}
+	for name, test := range map[string]struct {
+		activeLow bool
+		steps     []step
+		gateErr   error
+
+		wantAllows int
+		wantErr    error
+	}{
+		"press": {
+			steps: []step{{gpio.High, 50 * time.Millisecond}, {gpio.Low, 50 * time.Millisecond}},
+
+			wantAllows: 1,
+			wantErr:    ErrHalted,
+		},
+		"active low press": {
+			activeLow: true,
+			steps:     []step{{gpio.Low, 50 * time.Millisecond}, {gpio.High, 50 * time.Millisecond}},
+
+			wantAllows: 1,
+			wantErr:    ErrHalted,
+		},
+		"bounce ignored": {
+			steps: []step{
+				{gpio.High, time.Millisecond}, {gpio.Low, time.Millisecond},
+				{gpio.High, time.Millisecond}, {gpio.Low, 50 * time.Millisecond},
+			},
+
+			wantErr: ErrHalted,
+		},
+		"bouncy press is one press": {
+			steps: []step{
+				{gpio.High, time.Millisecond}, {gpio.Low, time.Millisecond},
+				{gpio.High, 50 * time.Millisecond},
+				{gpio.Low, time.Millisecond}, {gpio.High, time.Millisecond},
+				{gpio.Low, 50 * time.Millisecond},
+			},
+
+			wantAllows: 1,
+			wantErr:    ErrHalted,
+		},
+		"held is one press": {
+			steps: []step{{gpio.High, 200 * time.Millisecond}, {gpio.Low, 50 * time.Millisecond}},
+
+			wantAllows: 1,
+			wantErr:    ErrHalted,
+		},
+		"two presses": {
+			steps: []step{
+				{gpio.High, 50 * time.Millisecond}, {gpio.Low, 50 * time.Millisecond},
+				{gpio.High, 50 * time.Millisecond}, {gpio.Low, 50 * time.Millisecond},
+			},
+
+			wantAllows: 2,
+			wantErr:    ErrHalted,
+		},
+		"halted while held": {
+			steps: []step{{gpio.High, 50 * time.Millisecond}},
+
+			wantAllows: 1,
+			wantErr:    ErrHalted,
+		},
+		"admitter errors fatal": {
+			steps:   []step{{gpio.High, 50 * time.Millisecond}},
+			gateErr: errors.New("strike broken"),
+
+			wantAllows: 1,
+			wantErr:    errors.New("failed to allow exit: strike broken"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			released := gpio.Low
+			if test.activeLow {
+				released = gpio.High
+			}
+			clock := fakeclock.New()
+			pin := newTestPin(clock, released)
+
+			a := &testAdmit{}
+			a.Test(t)
+			defer a.AssertExpectations(t)
+			if test.wantAllows > 0 {
+				a.On("Allow", mock.MatchedBy(contextWithFields(t)), exitMessage).Return(test.gateErr).Times(test.wantAllows)
+			}
+
+			g, err := New(7, "B", pin, test.activeLow, a)
+			require.NoError(t, err)
+			g.clock = clock
+			g.Debounce = 10 * time.Millisecond
+			if test.activeLow {
+				require.Equal(t, gpio.PullUp, pin.pull)
+			} else {
+				require.Equal(t, gpio.PullDown, pin.pull)
+			}
+			require.Equal(t, gpio.BothEdges, pin.edge)
+
+			// The button moves at the times of the steps, the pin halts
+			// after the last one
+			var at time.Duration
+			for _, s := range test.steps {
+				pin.change(at, s.level)
+				at += s.hold
+			}
+			require.Equal(t, test.wantErr.Error(), g.Guard().Error())
+		})
+	}
+}
+
+func TestNewPinError(t *testing.T) {
+	pin := newTestPin(fakeclock.New(), gpio.Low)
+	pin.inErr = errors.New("no such pin")
+	_, err := New(7, "B", pin, false, &testAdmit{})
+	require.Error(t, err)
+}
+
+// testPin is a button input which changes at set times on a fake clock, each
+// change is an edge. It halts once there are no more changes.
+type testPin struct {
+	inErr error
+	pull  gpio.Pull
+	edge  gpio.Edge
+
+	clock   *fakeclock.Clock
+	level   gpio.Level
+	changes []change
+	// edges is the number of changes returned by WaitForEdge
+	edges int
+}
+
+// change is the level of a pin from a time
+type change struct {
+	at    time.Duration
+	level gpio.Level
+}
+
+func newTestPin(clock *fakeclock.Clock, level gpio.Level) *testPin {
+	return &testPin{clock: clock, level: level}
+}
+
+func (p *testPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.pull, p.edge = pull, edge
+	return p.inErr
+}
+
+// Read returns the level after the changes so far, including any that were
+// not waited for
+func (p *testPin) Read() gpio.Level {
+	level := p.level
+	for _, c := range p.changes {
+		if c.at <= p.clock.Since() {
+			level = c.level
+		}
+	}
+	return level
+}
+
+// WaitForEdge moves the clock on to the next change, or by timeout if that is
+// sooner. Like real pins, a change that was not waited for is returned at
+// once.
+func (p *testPin) WaitForEdge(timeout time.Duration) bool {
+	if p.edges == len(p.changes) {
+		// halted
+		return false
+	}
+	wait := p.changes[p.edges].at - p.clock.Since()
+	if timeout >= 0 && wait > timeout {
+		<-p.clock.After(timeout)
+		return false
+	}
+	if wait > 0 {
+		<-p.clock.After(wait)
+	}
+	p.edges++
+	return true
+}
+
+// change sets the level of the pin at a time since the clock started, changes
+// must be in order
+func (p *testPin) change(at time.Duration, level gpio.Level) {
+	p.changes = append(p.changes, change{at: at, level: level})
+}
+
+type testAdmit struct {
+	mock.Mock
+}
+
+func (a *testAdmit) Interrogating(ctx context.Context, msg string) {
+	a.Called(ctx, msg)
+}
+
+func (a *testAdmit) Deny(ctx context.Context, msg string, reason error) error {
+	return a.Called(ctx, msg, reason).Error(0)
+}
+
+func (a *testAdmit) Allow(ctx context.Context, msg string) error {
+	return a.Called(ctx, msg).Error(0)
+}
+
+func contextWithFields(t *testing.T) func(ctx context.Context) bool {
+	return func(ctx context.Context) bool {
+		return assert.Equal(t, int32(7), ctx.Value(admitter.Door)) &&
+			assert.Equal(t, "B", ctx.Value(admitter.Side)) &&
+			assert.Equal(t, guardType, ctx.Value(admitter.Type))
+	}
+}
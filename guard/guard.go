@@ -1,5 +1,10 @@
 package guard
 
+import (
+	"fmt"
+	"runtime/debug"
+)
+
 type Guard interface {
 	Guard() error
 }
@@ -10,13 +15,24 @@ type Mux []Guard
 
 // Guard runs all the guards in parallel, the error from the first guard to
 // return will be returend and should be considered fatal. No other guards will
-// be stopped.
+// be stopped. A guard that panics returns the panic as an error so that the
+// caller can fail safely.
 func (m Mux) Guard() error {
 	errChan := make(chan error)
 	for _, g := range m {
 		go func(g Guard) {
-			errChan <- g.Guard()
+			errChan <- guard(g)
 		}(g)
 	}
 	return <-errChan
 }
+
+// guard runs g, recovering any panic as an error
+func guard(g Guard) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("guard panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return g.Guard()
+}
@@ -30,6 +30,25 @@ func TestMux(t *testing.T) {
 	<-g1Done
 }
 
+func TestMuxPanic(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	g1 := &mockGuard{}
+	g1.On("Guard").Return(nil).Run(func(mock.Arguments) {
+		<-done
+	}).Maybe()
+	g2 := &mockGuard{}
+	g2.Test(t)
+	defer g2.AssertExpectations(t)
+	g2.On("Guard").Return(nil).Run(func(mock.Arguments) {
+		panic("oops")
+	}).Once()
+
+	err := Mux{g1, g2}.Guard()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "guard panicked: oops")
+}
+
 type mockGuard struct {
 	mock.Mock
 }
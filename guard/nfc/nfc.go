@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/somakeit/door-controller3/admitter"
@@ -27,11 +28,12 @@ type Guard struct {
 	door   int32
 	side   string
 	reader UIDReader
-	auth   auth.Authorizer
+	auth   auth.Decider
 	gate   admitter.Admitter
 
 	lastTag string
 
+	settings sync.Mutex
 	// ReadTimeout is the time given to read a UID from the UIDReader, the
 	// default is 100 milliseconds.
 	ReadTimeout time.Duration
@@ -44,9 +46,28 @@ type Guard struct {
 	CancelTimeout time.Duration
 }
 
+// SetTimeouts changes ReadTimeout, AuthTimeout and CancelTimeout, it is safe to
+// call while the Guard is guarding. Attempts in progress keep the old
+// timeouts.
+func (g *Guard) SetTimeouts(read, authorize, cancel time.Duration) {
+	g.settings.Lock()
+	defer g.settings.Unlock()
+	g.ReadTimeout = read
+	g.AuthTimeout = authorize
+	g.CancelTimeout = cancel
+}
+
+// timeouts returns ReadTimeout, AuthTimeout and CancelTimeout
+func (g *Guard) timeouts() (read, authorize, cancel time.Duration) {
+	g.settings.Lock()
+	defer g.settings.Unlock()
+	return g.ReadTimeout, g.AuthTimeout, g.CancelTimeout
+}
+
 // New returs a new Guard, door is the id of this door, side of door is usually
-// "A" or "B", reader is an instance of an NFC/RFID reader.
-func New(door int32, side string, reader UIDReader, authority auth.Authorizer, gate admitter.Admitter) (*Guard, error) {
+// "A" or "B", reader is an instance of an NFC/RFID reader. Any Authorizer can
+// be used as authority with auth.Decide.
+func New(door int32, side string, reader UIDReader, authority auth.Decider, gate admitter.Admitter) (*Guard, error) {
 	return &Guard{
 		door:          door,
 		side:          side,
@@ -70,7 +91,8 @@ func (g *Guard) Guard() error {
 
 // guard is one iteration of the Guard loop
 func (g *Guard) guard() error {
-	rawUID, err := g.reader.ReadUID(g.ReadTimeout)
+	readTimeout, authTimeout, cancelTimeout := g.timeouts()
+	rawUID, err := g.reader.ReadUID(readTimeout)
 	if err != nil {
 		// There was no tag, or we couldn't read the tag
 		g.lastTag = ""
@@ -88,7 +110,8 @@ func (g *Guard) guard() error {
 	ctx = context.WithValue(ctx, admitter.Side, g.side)
 	ctx = context.WithValue(ctx, admitter.Type, guardType)
 	ctx = context.WithValue(ctx, admitter.ID, uid)
-	ctx, cancel := context.WithTimeout(ctx, g.AuthTimeout)
+	ctx, details := auth.WithDetails(ctx)
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
 
 	g.gate.Interrogating(ctx, "Authorizing tag...")
 
@@ -105,12 +128,12 @@ func (g *Guard) guard() error {
 			if ctx.Err() != nil {
 				break
 			}
-			rawUID, err := g.reader.ReadUID(g.ReadTimeout)
+			rawUID, err := g.reader.ReadUID(readTimeout)
 			if err != nil || uid != hex.EncodeToString(rawUID) {
 				// Either the tag is gone or there was a read error, show the
 				// authentee some kindness and only cancel them if this
 				// continues to be the case for a short time
-				if !(time.Since(lastSeen) > g.CancelTimeout) {
+				if !(time.Since(lastSeen) > cancelTimeout) {
 					continue
 				}
 				cancel()
@@ -120,14 +143,21 @@ func (g *Guard) guard() error {
 		}
 	}()
 
-	allowed, msg, err := g.auth.Allowed(ctx, g.door, g.side, uid)
+	decision, err := g.auth.Decide(ctx, g.door, g.side, uid)
+	// Admitters read the Decision back from the context
+	details.SetDecision(decision)
+	msg := decision.Message
 	if err != nil {
-		if err := g.gate.Deny(ctx, "Error", err); err != nil {
+		// Authorizers may explain an error, such as a lockout
+		if msg == "" {
+			msg = "Error"
+		}
+		if err := g.gate.Deny(ctx, msg, err); err != nil {
 			return fmt.Errorf("failed to deny access: %w", err)
 		}
 		return nil
 	}
-	if !allowed {
+	if !decision.Allowed {
 		if msg == "" {
 			msg = "Access denied"
 		}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -30,6 +31,7 @@ func TestGuard(t *testing.T) {
 		wantAllowMsg         string
 		wantDenyMsg          string
 		wantDenyReason       error
+		wantDecision         auth.Reason
 	}{
 		"tag allowed": {
 			allow:    true,
@@ -37,6 +39,7 @@ func TestGuard(t *testing.T) {
 
 			wantInterrogatingMsg: "Authorizing tag...",
 			wantAllowMsg:         "Welcome back Bracken",
+			wantDecision:         auth.Granted,
 		},
 
 		"tag denied": {
@@ -46,6 +49,7 @@ func TestGuard(t *testing.T) {
 			wantInterrogatingMsg: "Authorizing tag...",
 			wantDenyMsg:          "Unknown tag",
 			wantDenyReason:       admitter.AccessDenied,
+			wantDecision:         auth.Denied,
 		},
 
 		"tag denied without message": {
@@ -56,6 +60,7 @@ func TestGuard(t *testing.T) {
 			wantInterrogatingMsg: "Authorizing tag...",
 			wantDenyMsg:          "Access denied",
 			wantDenyReason:       admitter.AccessDenied,
+			wantDecision:         auth.Denied,
 		},
 
 		"tag allowed without message": {
@@ -65,6 +70,7 @@ func TestGuard(t *testing.T) {
 
 			wantInterrogatingMsg: "Authorizing tag...",
 			wantAllowMsg:         "Access granted",
+			wantDecision:         auth.Granted,
 		},
 
 		"error from reader": {
@@ -79,6 +85,17 @@ func TestGuard(t *testing.T) {
 			wantInterrogatingMsg: "Authorizing tag...",
 			wantDenyMsg:          "Error",
 			wantDenyReason:       errors.New("server error"),
+			wantDecision:         auth.Failed,
+		},
+
+		"error with message from auth": {
+			allowMsg: "Locked out, try again in 5 s",
+			allowErr: errors.New("locked out"),
+
+			wantInterrogatingMsg: "Authorizing tag...",
+			wantDenyMsg:          "Locked out, try again in 5 s",
+			wantDenyReason:       errors.New("locked out"),
+			wantDecision:         auth.Failed,
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -95,21 +112,67 @@ func TestGuard(t *testing.T) {
 			if test.wantInterrogatingMsg != "" {
 				mockAdmit.On("Interrogating", mock.MatchedBy(contextWithUIDAndFields(t, strUID)), test.wantInterrogatingMsg).Return().Once()
 			}
+			var decision auth.Decision
+			recordDecision := func(args mock.Arguments) {
+				decision = auth.DecisionFrom(args.Get(0).(context.Context))
+			}
 			if test.wantAllowMsg != "" {
-				mockAdmit.On("Allow", mock.MatchedBy(contextWithUIDAndFields(t, strUID)), test.wantAllowMsg).Return(nil).Once()
+				mockAdmit.On("Allow", mock.MatchedBy(contextWithUIDAndFields(t, strUID)), test.wantAllowMsg).Run(recordDecision).Return(nil).Once()
 			}
 			if test.wantDenyMsg != "" {
-				mockAdmit.On("Deny", mock.MatchedBy(contextWithUIDAndFields(t, strUID)), test.wantDenyMsg, test.wantDenyReason).Return(nil).Once()
+				mockAdmit.On("Deny", mock.MatchedBy(contextWithUIDAndFields(t, strUID)), test.wantDenyMsg, test.wantDenyReason).Run(recordDecision).Return(nil).Once()
 			}
 
-			nfc, err := New(7, "B", readerDobule, authDouble, mockAdmit)
+			nfc, err := New(7, "B", readerDobule, auth.Decide(authDouble), mockAdmit)
 			require.NoError(t, err)
 
 			require.NoError(t, nfc.guard())
+			require.Equal(t, test.wantDecision, decision.Reason)
 		})
 	}
 }
 
+func TestGuardDecider(t *testing.T) {
+	readerDobule := &testNFC{}
+	readerDobule.Test(t)
+	readerDobule.On("ReadUID", mock.Anything).Return(rawUID, nil)
+	want := auth.Decision{
+		Allowed:   true,
+		Reason:    auth.Granted,
+		Message:   "Welcome back Bracken",
+		Member:    auth.Member{ID: 7, Name: "Bracken", LastSeen: time.Hour},
+		NewZoneID: 5,
+		Source:    "hms",
+		Cacheable: true,
+	}
+	decider := &testDecider{}
+	decider.Test(t)
+	decider.On("Decide", mock.Anything, int32(7), "B", strUID).Return(want, nil)
+	mockAdmit := &testAdmit{}
+	mockAdmit.Test(t)
+	defer mockAdmit.AssertExpectations(t)
+	mockAdmit.On("Interrogating", mock.Anything, "Authorizing tag...").Return()
+	mockAdmit.On("Allow", mock.MatchedBy(func(ctx context.Context) bool {
+		return assert.Equal(t, want, auth.DecisionFrom(ctx))
+	}), "Welcome back Bracken").Return(nil).Once()
+
+	nfc, err := New(7, "B", readerDobule, decider, mockAdmit)
+	require.NoError(t, err)
+	require.NoError(t, nfc.guard())
+}
+
+func TestSetTimeouts(t *testing.T) {
+	readerDobule := &testNFC{}
+	readerDobule.Test(t)
+	defer readerDobule.AssertExpectations(t)
+	readerDobule.On("ReadUID", 20*time.Millisecond).Return(nil, errors.New("no tag")).Once()
+
+	nfc, err := New(1, "A", readerDobule, auth.Decide(&testAuth{}), &testAdmit{})
+	require.NoError(t, err)
+	nfc.SetTimeouts(20*time.Millisecond, time.Second, time.Second)
+	require.NoError(t, nfc.guard())
+}
+
 func TestGuardFatal(t *testing.T) {
 	for name, test := range map[string]struct {
 		auth    bool
@@ -145,7 +208,7 @@ func TestGuardFatal(t *testing.T) {
 
 			nfc := &Guard{
 				reader:        readerDobule,
-				auth:          authDouble,
+				auth:          auth.Decide(authDouble),
 				gate:          admitDouble,
 				ReadTimeout:   100 * time.Millisecond,
 				AuthTimeout:   time.Second,
@@ -195,7 +258,7 @@ func TestGuardUserCancel(t *testing.T) {
 
 			nfc := &Guard{
 				reader:        readerDobule,
-				auth:          authDouble,
+				auth:          auth.Decide(authDouble),
 				gate:          mockAdmit,
 				ReadTimeout:   100 * time.Millisecond,
 				AuthTimeout:   30 * time.Second,
@@ -219,7 +282,7 @@ func TestGuardDeDupe(t *testing.T) {
 	mockAdmit := &testAdmit{}
 	mockAdmit.Test(t)
 
-	nfc, err := New(1, "A", readerDobule, authDouble, mockAdmit)
+	nfc, err := New(1, "A", readerDobule, auth.Decide(authDouble), mockAdmit)
 	require.NoError(t, err)
 
 	t.Run("first auth succeeds", func(t *testing.T) {
@@ -275,6 +338,15 @@ func (a *testAuth) Allowed(ctx context.Context, door int32, side, id string) (bo
 	return args.Bool(0), args.String(1), args.Error(2)
 }
 
+type testDecider struct {
+	mock.Mock
+}
+
+func (d *testDecider) Decide(ctx context.Context, door int32, side, id string) (auth.Decision, error) {
+	args := d.Called(ctx, door, side, id)
+	return args.Get(0).(auth.Decision), args.Error(1)
+}
+
 type testAdmit struct {
 	mock.Mock
 }
@@ -3,12 +3,15 @@ package pin
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
 )
 
 const (
@@ -31,26 +34,35 @@ type logDiscarder struct{}
 func (logDiscarder) Info(context.Context, ...interface{})  {}
 func (logDiscarder) Error(context.Context, ...interface{}) {}
 
-// PINChecker will check a PIN and assign a tag if approproate and return a
-// message to be displayed.
-type PINChecker interface {
-	CheckPIN(ctx context.Context, door int32, side, pin string) (string, error)
+// Enrollment is implemented by the errors a PINAuthorizer returns for
+// enrollment PINs when it knows whether a card was enrolled. Enrollment PIN
+// errors that do not implement it are considered failed enrollments.
+type Enrollment interface {
+	error
+	Enrolled() bool
 }
 
 // Guard is a pin code rader for the HMS Guardian system, it takes pin codes
-// from a reader terminated by "\n" and sends them to HMS.
+// from a reader terminated by "\n" and sends them to HMS. The results are
+// passed to the Admitter in the same way as tags.
 type Guard struct {
+	// Out is where the prompt and results are written, STDOUT by default
+	Out io.Writer
+
 	in   *bufio.Reader
-	hms  PINChecker
+	auth auth.PINAuthorizer
+	gate admitter.Admitter
 	door int32
 	side string
 }
 
 // New returns a Guard, in must be a pin souce, usually STDIN.
-func New(in io.Reader, hms PINChecker, door int32, side string) *Guard {
+func New(in io.Reader, authority auth.PINAuthorizer, door int32, side string, gate admitter.Admitter) *Guard {
 	return &Guard{
+		Out:  os.Stdout,
 		in:   bufio.NewReader(in),
-		hms:  hms,
+		auth: authority,
+		gate: gate,
 		door: door,
 		side: side,
 	}
@@ -71,7 +83,7 @@ func (g *Guard) guard() error {
 	ctx = context.WithValue(ctx, admitter.Side, g.side)
 	ctx = context.WithValue(ctx, admitter.Type, guardType)
 
-	fmt.Print("Enter pin: ")
+	fmt.Fprint(g.Out, "Enter pin: ")
 	pin, err := g.in.ReadString('\n')
 	if err != nil {
 		Logger.Error(ctx, "Error reading pin: ", err)
@@ -83,15 +95,59 @@ func (g *Guard) guard() error {
 	}
 
 	ctx = context.WithValue(ctx, admitter.ID, pin)
+	ctx, _ = auth.WithDetails(ctx)
 	ctx, cancel := context.WithTimeout(ctx, pinTimeout)
 	defer cancel()
-	msg, err := g.hms.CheckPIN(ctx, g.door, g.side, pin)
-	if err != nil {
+
+	g.gate.Interrogating(ctx, "Authorizing PIN...")
+
+	allowed, msg, err := g.auth.AllowedPIN(ctx, g.door, g.side, pin)
+	switch {
+	case errors.Is(err, auth.ErrEnrollment):
+		// Not a failure, but the door must not open either
+		return g.enrollment(ctx, msg, err)
+	case err != nil:
 		Logger.Error(ctx, "PIN check failed: ", err)
-		fmt.Println("PIN check failed:", err)
-		return nil
+		if msg == "" {
+			msg = "Error"
+		}
+		return g.deny(ctx, msg, err)
+	case !allowed:
+		if msg == "" {
+			msg = "Access denied"
+		}
+		return g.deny(ctx, msg, admitter.AccessDenied)
+	}
+
+	if msg == "" {
+		msg = "Access granted"
+	}
+	fmt.Fprintln(g.Out, msg)
+	if err := g.gate.Allow(ctx, msg); err != nil {
+		return fmt.Errorf("failed to allow access: %w", err)
+	}
+	return nil
+}
+
+// enrollment notifies the admitters of the result of an enrollment PIN
+func (g *Guard) enrollment(ctx context.Context, msg string, result error) error {
+	event := admitter.EnrollmentFailed
+	var enrolled Enrollment
+	if errors.As(result, &enrolled) && enrolled.Enrolled() {
+		event = admitter.Enrolled
+	}
+	Logger.Info(ctx, "Enrollment PIN: ", result)
+	fmt.Fprintln(g.Out, msg)
+	if err := admitter.Notify(ctx, g.gate, event, msg); err != nil {
+		return fmt.Errorf("failed to notify enrollment: %w", err)
+	}
+	return nil
+}
+
+func (g *Guard) deny(ctx context.Context, msg string, reason error) error {
+	fmt.Fprintln(g.Out, msg)
+	if err := g.gate.Deny(ctx, msg, reason); err != nil {
+		return fmt.Errorf("failed to deny access: %w", err)
 	}
-	Logger.Info(ctx, "PIN OK: ", msg)
-	fmt.Println("PIN OK:", msg)
 	return nil
 }
@@ -6,6 +6,9 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -13,16 +16,83 @@ import (
 func TestGuard(t *testing.T) {
 	for name, test := range map[string]struct {
 		input    string // empty for a bad reader
-		pinCalls map[string]error
-		wantErr  bool
+		allow    bool
+		allowMsg string
+		allowErr error
+		gateErr  error
+
+		wantCheck      bool
+		wantAllowMsg   string
+		wantDenyMsg    string
+		wantDenyReason error
+		wantNotify     admitter.Event
+		wantOut        string
+		wantErr        bool
 	}{
 		"pin ok": {
 			input:    "1234\n",
-			pinCalls: map[string]error{"1234": nil},
+			allow:    true,
+			allowMsg: "Welcome back Bracken",
+
+			wantCheck:    true,
+			wantAllowMsg: "Welcome back Bracken",
+			wantOut:      "Enter pin: Welcome back Bracken\n",
+		},
+		"pin denied": {
+			input:    "1234\n",
+			allowMsg: "Invalid pin",
+
+			wantCheck:      true,
+			wantDenyMsg:    "Invalid pin",
+			wantDenyReason: admitter.AccessDenied,
+		},
+		"pin denied without message": {
+			input: "1234\n",
+
+			wantCheck:      true,
+			wantDenyMsg:    "Access denied",
+			wantDenyReason: admitter.AccessDenied,
+		},
+		"enrollment pin": {
+			input:    "1234\n",
+			allowMsg: "Card registered to Bracken",
+			allowErr: testEnrollment(true),
+
+			wantCheck:  true,
+			wantNotify: admitter.Enrolled,
+		},
+		"failed enrollment": {
+			input:    "1234\n",
+			allowMsg: "Card was not registered",
+			allowErr: testEnrollment(false),
+
+			wantCheck:  true,
+			wantNotify: admitter.EnrollmentFailed,
+		},
+		"unexplained enrollment": {
+			input:    "1234\n",
+			allowMsg: "Card was not registered",
+			allowErr: auth.ErrEnrollment,
+
+			wantCheck:  true,
+			wantNotify: admitter.EnrollmentFailed,
 		},
 		"errors non-fatal": {
 			input:    "5678\n",
-			pinCalls: map[string]error{"5678": errors.New("db problem")},
+			allowErr: errors.New("db problem"),
+
+			wantCheck:      true,
+			wantDenyMsg:    "Error",
+			wantDenyReason: errors.New("db problem"),
+		},
+		"admitter errors fatal": {
+			input:   "1234\n",
+			allow:   true,
+			gateErr: errors.New("strike broken"),
+
+			wantCheck:    true,
+			wantAllowMsg: "Access granted",
+			wantErr:      true,
 		},
 		"empty lines not sent": {
 			input: "\n",
@@ -38,14 +108,36 @@ func TestGuard(t *testing.T) {
 			p := &mockPIN{}
 			p.Test(t)
 			defer p.AssertExpectations(t)
-			for pin, err := range test.pinCalls {
-				p.On("CheckPIN", mock.Anything, int32(7), "B", pin).Return("door things", err).Once()
+			if test.wantCheck {
+				pin := test.input[:len(test.input)-1]
+				p.On("AllowedPIN", mock.MatchedBy(contextWithFields(t, pin)), int32(7), "B", pin).Return(test.allow, test.allowMsg, test.allowErr).Once()
 			}
 
-			g := New(reader, p, 7, "B")
+			a := &testNotifier{}
+			a.Test(t)
+			defer a.AssertExpectations(t)
+			if test.wantCheck {
+				a.On("Interrogating", mock.Anything, "Authorizing PIN...").Return().Once()
+			}
+			if test.wantAllowMsg != "" {
+				a.On("Allow", mock.Anything, test.wantAllowMsg).Return(test.gateErr).Once()
+			}
+			if test.wantDenyMsg != "" {
+				a.On("Deny", mock.Anything, test.wantDenyMsg, test.wantDenyReason).Return(test.gateErr).Once()
+			}
+			if test.wantNotify != "" {
+				a.On("Notify", mock.Anything, test.wantNotify, test.allowMsg).Return(test.gateErr).Once()
+			}
+
+			g := New(reader, p, 7, "B", a)
+			out := &bytes.Buffer{}
+			g.Out = out
 
 			err := g.guard()
 			require.Equal(t, test.wantErr, err != nil, "wantErr=%t, err=%v", test.wantErr, err)
+			if test.wantOut != "" {
+				require.Equal(t, test.wantOut, out.String())
+			}
 		})
 	}
 }
@@ -54,7 +146,46 @@ type mockPIN struct {
 	mock.Mock
 }
 
-func (m *mockPIN) CheckPIN(ctx context.Context, door int32, side, pin string) (string, error) {
+func (m *mockPIN) AllowedPIN(ctx context.Context, door int32, side, pin string) (bool, string, error) {
 	args := m.Called(ctx, door, side, pin)
-	return args.String(0), args.Error(1)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
+
+type testAdmit struct {
+	mock.Mock
+}
+
+func (a *testAdmit) Interrogating(ctx context.Context, msg string) {
+	a.Called(ctx, msg)
+}
+
+func (a *testAdmit) Deny(ctx context.Context, msg string, reason error) error {
+	return a.Called(ctx, msg, reason).Error(0)
+}
+
+func (a *testAdmit) Allow(ctx context.Context, msg string) error {
+	return a.Called(ctx, msg).Error(0)
+}
+
+type testNotifier struct {
+	testAdmit
+}
+
+func (a *testNotifier) Notify(ctx context.Context, event admitter.Event, msg string) error {
+	return a.Called(ctx, event, msg).Error(0)
+}
+
+type testEnrollment bool
+
+func (e testEnrollment) Error() string  { return "enrollment pin" }
+func (e testEnrollment) Unwrap() error  { return auth.ErrEnrollment }
+func (e testEnrollment) Enrolled() bool { return bool(e) }
+
+func contextWithFields(t *testing.T, pin string) func(ctx context.Context) bool {
+	return func(ctx context.Context) bool {
+		return assert.Equal(t, int32(7), ctx.Value(admitter.Door)) &&
+			assert.Equal(t, "B", ctx.Value(admitter.Side)) &&
+			assert.Equal(t, guardType, ctx.Value(admitter.Type)) &&
+			assert.Equal(t, pin, ctx.Value(admitter.ID))
+	}
 }
@@ -0,0 +1,308 @@
+// twofactor is a door guard that requires an NFC tag followed by the PIN of
+// the same HMS member.
+package twofactor
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/auth/hms"
+)
+
+const (
+	defaultReadTimeoutMS = 100
+	defaultAuthTimeoutS  = 30
+	defaultPINTimeoutS   = 30
+	guardType            = "twofactor"
+)
+
+// UIDReader is any NFC/RFIC reader that Guard can poll for tag UIDs
+type UIDReader interface {
+	ReadUID(timeout time.Duration) (uid []byte, err error)
+}
+
+// Checker is the part of hms.Client used by Guard, both factors must be
+// checked by HMS so that the member IDs can be compared.
+type Checker interface {
+	GatekeeperCheckRFID(ctx context.Context, door int32, side, tag string) (hms.GatekeeperCheckResult, error)
+	GatekeeperCheckPIN(ctx context.Context, door int32, side, pin string) (hms.GatekeeperCheckResult, error)
+}
+
+// Limits wrap the HMS check of each factor in the same middleware as other
+// guards use, eg a lockout or schedule. A nil func leaves that factor
+// unwrapped.
+type Limits struct {
+	Tags func(auth.Authorizer) auth.Authorizer
+	PINs func(auth.PINAuthorizer) auth.PINAuthorizer
+}
+
+// Guard is a door guard that requires a tag and then a PIN, access is only
+// allowed if both belong to the same member.
+type Guard struct {
+	door   int32
+	side   string
+	reader UIDReader
+	hms    Checker
+	gate   admitter.Admitter
+
+	pins   chan pinEntry
+	pinErr chan error
+
+	lastTag string
+
+	settings sync.Mutex
+	// ReadTimeout is the time given to read a UID from the UIDReader, the
+	// default is 100 milliseconds.
+	ReadTimeout time.Duration
+	// AuthTimeout is the time given to HMS to check each factor. The default
+	// is 30 seconds.
+	AuthTimeout time.Duration
+	// PINTimeout is the time given to enter the PIN after the tag has been
+	// accepted. The default is 30 seconds.
+	PINTimeout time.Duration
+	// limits are set with SetLimits
+	limits Limits
+}
+
+// SetTimeouts changes ReadTimeout, AuthTimeout and PINTimeout, it is safe to
+// call while the Guard is guarding. Attempts in progress keep the old
+// timeouts.
+func (g *Guard) SetTimeouts(read, authorize, pin time.Duration) {
+	g.settings.Lock()
+	defer g.settings.Unlock()
+	g.ReadTimeout = read
+	g.AuthTimeout = authorize
+	g.PINTimeout = pin
+}
+
+// SetLimits changes the Limits applied to each factor, it is safe to call
+// while the Guard is guarding.
+func (g *Guard) SetLimits(limits Limits) {
+	g.settings.Lock()
+	defer g.settings.Unlock()
+	g.limits = limits
+}
+
+// tagAuthorizer returns an Authorizer checking tags with HMS within the
+// Limits, the last result from HMS is kept in check.
+func (g *Guard) tagAuthorizer(check *tagCheck) auth.Authorizer {
+	g.settings.Lock()
+	wrap := g.limits.Tags
+	g.settings.Unlock()
+	if wrap == nil {
+		return check
+	}
+	return wrap(check)
+}
+
+// pinAuthorizer returns a PINAuthorizer checking PINs with HMS within the
+// Limits
+func (g *Guard) pinAuthorizer(check *pinCheck) auth.PINAuthorizer {
+	g.settings.Lock()
+	wrap := g.limits.PINs
+	g.settings.Unlock()
+	if wrap == nil {
+		return check
+	}
+	return wrap(check)
+}
+
+// timeouts returns ReadTimeout, AuthTimeout and PINTimeout
+func (g *Guard) timeouts() (read, authorize, pin time.Duration) {
+	g.settings.Lock()
+	defer g.settings.Unlock()
+	return g.ReadTimeout, g.AuthTimeout, g.PINTimeout
+}
+
+type pinEntry struct {
+	pin string
+	at  time.Time
+}
+
+// New returns a new Guard, pins must be a pin source terminated by "\n",
+// usually STDIN. Reading pins begins immediately.
+func New(door int32, side string, reader UIDReader, pins io.Reader, checker Checker, gate admitter.Admitter) (*Guard, error) {
+	g := &Guard{
+		door:        door,
+		side:        side,
+		reader:      reader,
+		hms:         checker,
+		gate:        gate,
+		pins:        make(chan pinEntry),
+		pinErr:      make(chan error, 1),
+		ReadTimeout: defaultReadTimeoutMS * time.Millisecond,
+		AuthTimeout: defaultAuthTimeoutS * time.Second,
+		PINTimeout:  defaultPINTimeoutS * time.Second,
+	}
+	go g.readPINs(bufio.NewReader(pins))
+	return g, nil
+}
+
+// Guard begins guarding the door. Any error returned is fatal.
+func (g *Guard) Guard() error {
+	for {
+		if err := g.guard(); err != nil {
+			return err
+		}
+	}
+}
+
+// readPINs sends every line from in to pins until in fails
+func (g *Guard) readPINs(in *bufio.Reader) {
+	for {
+		pin, err := in.ReadString('\n')
+		if err != nil {
+			g.pinErr <- fmt.Errorf("failed to read pin: %w", err)
+			return
+		}
+		g.pins <- pinEntry{pin: strings.TrimSuffix(pin, "\n"), at: time.Now()}
+	}
+}
+
+// guard is one iteration of the Guard loop
+func (g *Guard) guard() error {
+	readTimeout, authTimeout, pinTimeout := g.timeouts()
+	rawUID, err := g.reader.ReadUID(readTimeout)
+	if err != nil {
+		g.lastTag = ""
+		return g.discardPINs()
+	}
+
+	uid := hex.EncodeToString(rawUID)
+	if uid == g.lastTag {
+		return g.discardPINs()
+	}
+	g.lastTag = uid
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, admitter.Door, g.door)
+	ctx = context.WithValue(ctx, admitter.Side, g.side)
+	ctx = context.WithValue(ctx, admitter.Type, guardType)
+	ctx = context.WithValue(ctx, admitter.ID, uid)
+	ctx, details := auth.WithDetails(ctx)
+
+	tagCtx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+	g.gate.Interrogating(tagCtx, "Authorizing tag...")
+	tagChecker := &tagCheck{hms: g.hms}
+	allowed, msg, err := g.tagAuthorizer(tagChecker).Allowed(tagCtx, g.door, g.side, uid)
+	cancel()
+	tag := tagChecker.res
+	if tag.MemberID != 0 {
+		details.SetMember(tag.MemberID, tag.MemberName)
+		details.SetNewZone(tag.NewZoneID)
+	}
+	if err != nil {
+		return g.deny(ctx, orDefault(msg, "Error"), err)
+	}
+	if !allowed {
+		return g.deny(ctx, orDefault(msg, "Access denied"), admitter.AccessDenied)
+	}
+
+	accepted := time.Now()
+	pinCtx, cancel := context.WithTimeout(ctx, pinTimeout)
+	defer cancel()
+	g.gate.Interrogating(pinCtx, "Tag accepted, enter PIN...")
+	var pin string
+	for pin == "" {
+		select {
+		case entry := <-g.pins:
+			// Ignore anything typed before the tag was accepted
+			if entry.at.After(accepted) {
+				pin = entry.pin
+			}
+		case err := <-g.pinErr:
+			return err
+		case <-pinCtx.Done():
+			return g.deny(ctx, "PIN not entered in time", admitter.AccessDenied)
+		}
+	}
+	cancel()
+
+	pinCtx, cancel = context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+	g.gate.Interrogating(pinCtx, "Authorizing PIN...")
+	pinChecker := &pinCheck{hms: g.hms, memberID: tag.MemberID}
+	allowed, pinMsg, err := g.pinAuthorizer(pinChecker).AllowedPIN(pinCtx, g.door, g.side, pin)
+	cancel()
+	if err != nil {
+		return g.deny(ctx, orDefault(pinMsg, "Error"), err)
+	}
+	if !allowed {
+		return g.deny(ctx, orDefault(pinMsg, "Invalid PIN"), admitter.AccessDenied)
+	}
+
+	// The new zone is on ctx for an hms.Zones admitter
+	if err := g.gate.Allow(ctx, orDefault(msg, "Access granted")); err != nil {
+		return fmt.Errorf("failed to allow access: %w", err)
+	}
+	return nil
+}
+
+func (g *Guard) deny(ctx context.Context, msg string, reason error) error {
+	if err := g.gate.Deny(ctx, msg, reason); err != nil {
+		return fmt.Errorf("failed to deny access: %w", err)
+	}
+	return nil
+}
+
+// orDefault returns msg, or def if msg is empty
+func orDefault(msg, def string) string {
+	if msg == "" {
+		return def
+	}
+	return msg
+}
+
+// tagCheck is an Authorizer asking HMS about a tag, it keeps the result so
+// that the member can be compared with the PIN's
+type tagCheck struct {
+	hms Checker
+	res hms.GatekeeperCheckResult
+}
+
+func (c *tagCheck) Allowed(ctx context.Context, door int32, side, id string) (allowed bool, message string, err error) {
+	res, err := c.hms.GatekeeperCheckRFID(ctx, door, side, id)
+	if err != nil {
+		return false, "", err
+	}
+	c.res = res
+	return res.AccessGranted, res.Message, nil
+}
+
+// pinCheck is a PINAuthorizer asking HMS about a PIN, it only allows the PIN
+// of memberID so that guessing other members' PINs counts as a denial
+type pinCheck struct {
+	hms      Checker
+	memberID int32
+}
+
+func (c *pinCheck) AllowedPIN(ctx context.Context, door int32, side, pin string) (allowed bool, message string, err error) {
+	res, err := c.hms.GatekeeperCheckPIN(ctx, door, side, pin)
+	if err != nil {
+		return false, "", err
+	}
+	return res.AccessGranted && res.MemberID == c.memberID, "", nil
+}
+
+// discardPINs throws away PINs entered without a tag so that the PIN reader
+// is never blocked, a failure of the PIN reader is returned.
+func (g *Guard) discardPINs() error {
+	for {
+		select {
+		case <-g.pins:
+		case err := <-g.pinErr:
+			return err
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/somakeit/door-controller3/admitter"
+	"github.com/somakeit/door-controller3/auth"
+	"github.com/somakeit/door-controller3/auth/hms"
+	"github.com/somakeit/door-controller3/auth/lockout"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	strUID = "0001f680"
+	rawUID = []byte{0x00, 0x01, 0xf6, 0x80}
+)
+
+func TestGuard(t *testing.T) {
+	for name, test := range map[string]struct {
+		tag    hms.GatekeeperCheckResult
+		tagErr error
+		pin    string // empty to never enter a pin
+		res    hms.GatekeeperCheckResult
+		pinErr error
+
+		wantPINPrompt  bool
+		wantPINCheck   bool
+		wantAllowMsg   string
+		wantDenyMsg    string
+		wantDenyReason error
+		wantZone       bool
+	}{
+		"both factors match": {
+			tag: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7, NewZoneID: 5, Message: "Welcome back Bracken"},
+			pin: "0248",
+			res: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7},
+
+			wantPINPrompt: true,
+			wantPINCheck:  true,
+			wantAllowMsg:  "Welcome back Bracken",
+			wantZone:      true,
+		},
+
+		"tag denied": {
+			tag: hms.GatekeeperCheckResult{MemberID: 7},
+
+			wantDenyMsg:    "Access denied",
+			wantDenyReason: admitter.AccessDenied,
+		},
+
+		"tag error": {
+			tagErr: errors.New("db down"),
+
+			wantDenyMsg:    "Error",
+			wantDenyReason: errors.New("db down"),
+		},
+
+		"pin of another member": {
+			tag: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7},
+			pin: "1234",
+			res: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 99},
+
+			wantPINPrompt:  true,
+			wantPINCheck:   true,
+			wantDenyMsg:    "Invalid PIN",
+			wantDenyReason: admitter.AccessDenied,
+		},
+
+		"pin invalid": {
+			tag: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7},
+			pin: "1234",
+			res: hms.GatekeeperCheckResult{MemberID: 7},
+
+			wantPINPrompt:  true,
+			wantPINCheck:   true,
+			wantDenyMsg:    "Invalid PIN",
+			wantDenyReason: admitter.AccessDenied,
+		},
+
+		"pin error": {
+			tag:    hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7},
+			pin:    "0248",
+			pinErr: errors.New("db down"),
+
+			wantPINPrompt:  true,
+			wantPINCheck:   true,
+			wantDenyMsg:    "Error",
+			wantDenyReason: errors.New("db down"),
+		},
+
+		"pin timeout": {
+			tag: hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7},
+
+			wantPINPrompt:  true,
+			wantDenyMsg:    "PIN not entered in time",
+			wantDenyReason: admitter.AccessDenied,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pinReader, pinWriter := io.Pipe()
+			defer pinWriter.Close()
+
+			readerDouble := &testNFC{}
+			readerDouble.Test(t)
+			readerDouble.On("ReadUID", 100*time.Millisecond).Return(rawUID, nil)
+
+			checker := &testChecker{}
+			checker.Test(t)
+			defer checker.AssertExpectations(t)
+			checker.On("GatekeeperCheckRFID", mock.Anything, int32(7), "B", strUID).Return(test.tag, test.tagErr).Once()
+			if test.wantPINCheck {
+				checker.On("GatekeeperCheckPIN", mock.Anything, int32(7), "B", test.pin).Return(test.res, test.pinErr).Once()
+			}
+
+			mockAdmit := &testAdmit{}
+			mockAdmit.Test(t)
+			defer mockAdmit.AssertExpectations(t)
+			mockAdmit.On("Interrogating", mock.Anything, "Authorizing tag...").Return().Once()
+			if test.wantPINPrompt {
+				mockAdmit.On("Interrogating", mock.Anything, "Tag accepted, enter PIN...").Run(func(mock.Arguments) {
+					if test.pin == "" {
+						return
+					}
+					go func() {
+						// The PIN is typed after the prompt
+						time.Sleep(10 * time.Millisecond)
+						_, _ = pinWriter.Write([]byte(test.pin + "\n"))
+					}()
+				}).Return().Once()
+			}
+			if test.wantPINCheck {
+				mockAdmit.On("Interrogating", mock.Anything, "Authorizing PIN...").Return().Once()
+			}
+			var allowed auth.Decision
+			if test.wantAllowMsg != "" {
+				mockAdmit.On("Allow", mock.Anything, test.wantAllowMsg).Run(func(args mock.Arguments) {
+					allowed = auth.DecisionFrom(args.Get(0).(context.Context))
+				}).Return(nil).Once()
+			}
+			if test.wantDenyMsg != "" {
+				mockAdmit.On("Deny", mock.Anything, test.wantDenyMsg, test.wantDenyReason).Return(nil).Once()
+			}
+
+			g, err := New(7, "B", readerDouble, pinReader, checker, mockAdmit)
+			require.NoError(t, err)
+			g.PINTimeout = 100 * time.Millisecond
+
+			require.NoError(t, g.guard())
+			if test.wantZone {
+				require.Equal(t, test.tag.MemberID, allowed.Member.ID)
+				require.Equal(t, test.tag.NewZoneID, allowed.NewZoneID, "the new zone is for hms.Zones")
+			}
+		})
+	}
+}
+
+func TestGuardIgnoresEarlyPIN(t *testing.T) {
+	pinReader, pinWriter := io.Pipe()
+	defer pinWriter.Close()
+
+	readerDouble := &testNFC{}
+	readerDouble.Test(t)
+	readerDouble.On("ReadUID", mock.Anything).Return(nil, errors.New("no tag")).Once()
+	readerDouble.On("ReadUID", mock.Anything).Return(rawUID, nil)
+
+	checker := &testChecker{}
+	checker.Test(t)
+	checker.On("GatekeeperCheckRFID", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7}, nil)
+
+	mockAdmit := &testAdmit{}
+	mockAdmit.Test(t)
+	defer mockAdmit.AssertExpectations(t)
+	mockAdmit.On("Interrogating", mock.Anything, mock.Anything).Return()
+	mockAdmit.On("Deny", mock.Anything, "PIN not entered in time", admitter.AccessDenied).Return(nil).Once()
+
+	g, err := New(7, "B", readerDouble, pinReader, checker, mockAdmit)
+	require.NoError(t, err)
+	g.PINTimeout = 100 * time.Millisecond
+
+	go func() { _, _ = pinWriter.Write([]byte("0248\n")) }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, g.guard(), "no tag")
+	require.NoError(t, g.guard(), "tag then timeout")
+}
+
+func TestGuardLockout(t *testing.T) {
+	pinReader, pinWriter := io.Pipe()
+	defer pinWriter.Close()
+
+	readerDouble := &testNFC{}
+	readerDouble.Test(t)
+	readerDouble.On("ReadUID", mock.Anything).Return(rawUID, nil).Once()
+	readerDouble.On("ReadUID", mock.Anything).Return(nil, errors.New("no tag")).Once()
+	readerDouble.On("ReadUID", mock.Anything).Return(rawUID, nil).Once()
+
+	checker := &testChecker{}
+	checker.Test(t)
+	defer checker.AssertExpectations(t)
+	checker.On("GatekeeperCheckRFID", mock.Anything, int32(7), "B", strUID).Return(hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 7}, nil).Twice()
+	// The second guess is never checked with HMS
+	checker.On("GatekeeperCheckPIN", mock.Anything, int32(7), "B", "1234").Return(hms.GatekeeperCheckResult{AccessGranted: true, MemberID: 99}, nil).Once()
+
+	mockAdmit := &testAdmit{}
+	mockAdmit.Test(t)
+	defer mockAdmit.AssertExpectations(t)
+	mockAdmit.On("Interrogating", mock.Anything, "Tag accepted, enter PIN...").Run(func(mock.Arguments) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_, _ = pinWriter.Write([]byte("1234\n"))
+		}()
+	}).Return()
+	mockAdmit.On("Interrogating", mock.Anything, mock.Anything).Return()
+	mockAdmit.On("Deny", mock.Anything, "Invalid PIN", admitter.AccessDenied).Return(nil).Once()
+	mockAdmit.On("Deny", mock.Anything, "Locked out, try again in 5 s", mock.MatchedBy(func(err error) bool {
+		return errors.Is(err, lockout.ErrLockedOut)
+	})).Return(nil).Once()
+
+	locks := lockout.New()
+	locks.Threshold = 1
+	g, err := New(7, "B", readerDouble, pinReader, checker, mockAdmit)
+	require.NoError(t, err)
+	g.SetLimits(Limits{
+		Tags: func(a auth.Authorizer) auth.Authorizer { return locks.Tags(a) },
+		PINs: func(p auth.PINAuthorizer) auth.PINAuthorizer { return locks.PINs(p) },
+	})
+
+	require.NoError(t, g.guard(), "PIN of another member")
+	require.NoError(t, g.guard(), "no tag")
+	require.NoError(t, g.guard(), "same PIN is locked out")
+}
+
+func TestGuardFatal(t *testing.T) {
+	pinReader, pinWriter := io.Pipe()
+	require.NoError(t, pinWriter.CloseWithError(errors.New("tty gone")))
+
+	readerDouble := &testNFC{}
+	readerDouble.Test(t)
+	readerDouble.On("ReadUID", mock.Anything).Return(nil, errors.New("no tag"))
+
+	g, err := New(7, "B", readerDouble, pinReader, &testChecker{}, &testAdmit{})
+	require.NoError(t, err)
+	require.Error(t, g.Guard())
+}
+
+type testNFC struct {
+	mock.Mock
+}
+
+func (n *testNFC) ReadUID(timeout time.Duration) ([]byte, error) {
+	args := n.Called(timeout)
+	b, _ := args.Get(0).([]byte)
+	return b, args.Error(1)
+}
+
+type testChecker struct {
+	mock.Mock
+}
+
+func (c *testChecker) GatekeeperCheckRFID(ctx context.Context, door int32, side, tag string) (hms.GatekeeperCheckResult, error) {
+	args := c.Called(ctx, door, side, tag)
+	return args.Get(0).(hms.GatekeeperCheckResult), args.Error(1)
+}
+
+func (c *testChecker) GatekeeperCheckPIN(ctx context.Context, door int32, side, pin string) (hms.GatekeeperCheckResult, error) {
+	args := c.Called(ctx, door, side, pin)
+	return args.Get(0).(hms.GatekeeperCheckResult), args.Error(1)
+}
+
+type testAdmit struct {
+	mock.Mock
+}
+
+func (a *testAdmit) Interrogating(ctx context.Context, msg string) {
+	a.Called(ctx, msg)
+}
+
+func (a *testAdmit) Deny(ctx context.Context, msg string, reason error) error {
+	return a.Called(ctx, msg, reason).Error(0)
+}
+
+func (a *testAdmit) Allow(ctx context.Context, msg string) error {
+	return a.Called(ctx, msg).Error(0)
+}
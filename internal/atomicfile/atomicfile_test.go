@@ -0,0 +1,30 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	require.NoError(t, WriteJSON(path, map[string]int{"a": 1}))
+	require.NoError(t, WriteJSON(path, map[string]int{"b": 2}))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"b": 2}`, string(data))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "no temporary files are left behind")
+
+	require.Error(t, WriteJSON(path, func() {}), "v must marshal")
+	require.Error(t, WriteJSON(filepath.Join(dir, "missing", "state.json"), 1))
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"b": 2}`, string(data), "a failed write leaves the file")
+}
@@ -0,0 +1,43 @@
+// fakeclock is a clock for the tests of admitters and guards that wait, it
+// moves on by the time waited for instead of waiting.
+package fakeclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock that moves on by the time waited for whenever After is
+// called
+type Clock struct {
+	mux        sync.Mutex
+	start, now time.Time
+}
+
+// New returns a Clock starting at midnight on 2020-01-01 UTC
+func New() *Clock {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &Clock{start: start, now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// After moves the clock on by d and returns a channel which already has the
+// new time
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Since returns the time moved on since the clock was made
+func (c *Clock) Since() time.Duration {
+	return c.Now().Sub(c.start)
+}